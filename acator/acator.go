@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"io"
 	"net/url"
+	"strings"
 
 	"github.com/findy-network/findy-agent-auth/acator/authenticator"
 	"github.com/findy-network/findy-agent-auth/acator/enclave"
@@ -23,6 +24,27 @@ type Instance struct {
 	Counter uint32
 	AAGUID  uuid.UUID
 	Origin  *url.URL
+
+	// ResidentKeys are the discoverable credentials of the instance.
+	ResidentKeys []ResidentKey
+}
+
+// ResidentKey is a discoverable credential. Our key handles are stateless, but
+// the discoverable login needs that the authenticator remembers the
+// credentials and user handles per RP.
+type ResidentKey struct {
+	RPID       string
+	CredID     []byte
+	UserHandle []byte
+}
+
+func (i *Instance) residentKey(rpID string) (rk ResidentKey, found bool) {
+	for _, rk := range i.ResidentKeys {
+		if rk.RPID == rpID {
+			return rk, true
+		}
+	}
+	return rk, false
 }
 
 func useDefIfNot(i *Instance) *Instance {
@@ -79,9 +101,10 @@ func tryBuildAssertionResponse(
 	aaGUIDBytes := try.To1(i.AAGUID.MarshalBinary())
 
 	var (
-		found     bool
-		keyHandle enclave.KeyHandle
-		credID    []byte
+		found      bool
+		keyHandle  enclave.KeyHandle
+		credID     []byte
+		userHandle []byte
 	)
 	for _, credential := range ca.Response.AllowedCredentials {
 		if found, keyHandle = enclave.Store.IsKeyHandle(credential.CredentialID); found {
@@ -89,6 +112,14 @@ func tryBuildAssertionResponse(
 			break
 		}
 	}
+	if len(ca.Response.AllowedCredentials) == 0 {
+		glog.V(3).Infoln("no allowed credentials, discoverable login")
+		if rk, rkFound := i.residentKey(ca.Response.RelyingPartyID); rkFound {
+			found, keyHandle = enclave.Store.IsKeyHandle(rk.CredID)
+			credID = rk.CredID
+			userHandle = rk.UserHandle
+		}
+	}
 	assert.That(found, "authenticator not found")
 	assert.INotNil(keyHandle, "key handle cannot be nil")
 
@@ -130,6 +161,7 @@ func tryBuildAssertionResponse(
 			AuthenticatorResponse: protocol.AuthenticatorResponse{ClientDataJSON: ccdByteJSON},
 			AuthenticatorData:     authenticatorRawData,
 			Signature:             sig,
+			UserHandle:            userHandle,
 		},
 	}
 	return car
@@ -222,12 +254,35 @@ func tryBuildCreationResponse(
 	}
 	assert.Equal(`"`+ccr.Credential.ID+`"`, string(try.To1(ccr.RawID.MarshalJSON())))
 
+	if isResidentKey(creation.Response.AuthenticatorSelection) {
+		glog.V(3).Infoln("storing resident key for", creation.Response.RelyingParty.ID)
+		i.ResidentKeys = append(i.ResidentKeys, ResidentKey{
+			RPID:       creation.Response.RelyingParty.ID,
+			CredID:     khID,
+			UserHandle: tryUserHandle(creation.Response.User.ID),
+		})
+	}
+
 	glog.V(13).Infof("\n%s ==\n%s", ccr.Credential.ID, string(try.To1(ccr.RawID.MarshalJSON())))
 	strCcr := string(try.To1(json.MarshalIndent(ccr, "", "\t")))
 	glog.V(13).Infoln("CCR json:\n", strCcr)
 	return ccr
 }
 
+func isResidentKey(sel protocol.AuthenticatorSelection) bool {
+	return sel.ResidentKey == protocol.ResidentKeyRequirementRequired ||
+		sel.ResidentKey == protocol.ResidentKeyRequirementPreferred ||
+		(sel.RequireResidentKey != nil && *sel.RequireResidentKey)
+}
+
+// tryUserHandle decodes the user ID of the CredentialCreation JSON which is
+// base64 URL encoded.
+func tryUserHandle(id any) []byte {
+	s, ok := id.(string)
+	assert.That(ok, "user ID must be string")
+	return try.To1(base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "=")))
+}
+
 func checkClientData(d []byte) bool {
 	var ccd protocol.CollectedClientData
 	try.To(json.Unmarshal(d, &ccd))
@@ -18,6 +18,8 @@ import (
 
 	"github.com/findy-network/findy-agent-auth/acator"
 	"github.com/findy-network/findy-agent-auth/acator/enclave"
+	"github.com/findy-network/findy-agent-auth/ceremony"
+	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/golang/glog"
 	"github.com/google/uuid"
 	"github.com/lainio/err2"
@@ -38,10 +40,24 @@ type Cmd struct {
 	Token         string `json:"token,omitempty"`
 	Origin        string `json:"origin,omitempty"`
 
+	// Transaction is the data to confirm with the confirm sub command.
+	Transaction string `json:"transaction,omitempty"`
+
+	// DPoP tells to send the DPoP proof in the login, i.e. the tokens are
+	// bound to the DPoP key. DPoPKey is the key handle ID (base64url) of the
+	// enclave. If it's empty, a new key is created and returned in the Result.
+	// With the DPoPKey the Token is sent with the proofs of the key.
+	DPoP    bool   `json:"dpop,omitempty"`
+	DPoPKey string `json:"dpop_key,omitempty"`
+
 	RegisterBegin  Endpoint `json:"register_1,omitempty"`
 	RegisterFinish Endpoint `json:"register_2,omitempty"`
 	LoginBegin     Endpoint `json:"login_1,omitempty"`
 	LoginFinish    Endpoint `json:"login_2,omitempty"`
+	StepUpBegin    Endpoint `json:"stepup_1,omitempty"`
+	StepUpFinish   Endpoint `json:"stepup_2,omitempty"`
+	ConfirmBegin   Endpoint `json:"confirm_1,omitempty"`
+	ConfirmFinish  Endpoint `json:"confirm_2,omitempty"`
 
 	CookiePath string `json:"cookie_path,omitempty"`
 	CookieFile string `json:"cookie_file,omitempty"`
@@ -63,8 +79,18 @@ func (ac *Cmd) Validate() (err error) {
 	defer err2.Handle(&err)
 
 	assert.NotEmpty(ac.SubCmd, "sub command needed")
-	assert.That(ac.SubCmd == "register" || ac.SubCmd == "login",
-		"wrong sub command: %s: want: register|login", ac.SubCmd)
+	assert.That(ac.SubCmd == "register" || ac.SubCmd == "login" ||
+		ac.SubCmd == "stepup" || ac.SubCmd == "confirm",
+		"wrong sub command: %s: want: register|login|stepup|confirm", ac.SubCmd)
+	if ac.SubCmd == "stepup" {
+		assert.NotEmpty(ac.Token, "JWT needed for step-up")
+		assert.ThatNot(ac.Legacy, "legacy mode doesn't support step-up")
+	}
+	if ac.SubCmd == "confirm" {
+		assert.NotEmpty(ac.Token, "JWT needed for confirm")
+		assert.NotEmpty(ac.Transaction, "transaction data needed")
+		assert.ThatNot(ac.Legacy, "legacy mode doesn't support confirm")
+	}
 	assert.NotEmpty(ac.UserName, "user name needed")
 	assert.NotEmpty(ac.URL, "connection url cannot be empty")
 	assert.NotEmpty(ac.AAGUID, "authenticator ID needed")
@@ -101,6 +127,18 @@ func (ac *Cmd) setDefaults() {
 	if ac.LoginFinish.Method == "" {
 		ac.LoginFinish.Method = "POST"
 	}
+	if ac.StepUpBegin.Method == "" {
+		ac.StepUpBegin.Method = "POST"
+	}
+	if ac.StepUpFinish.Method == "" {
+		ac.StepUpFinish.Method = "POST"
+	}
+	if ac.ConfirmBegin.Method == "" {
+		ac.ConfirmBegin.Method = "POST"
+	}
+	if ac.ConfirmFinish.Method == "" {
+		ac.ConfirmFinish.Method = "POST"
+	}
 
 	if ac.RegisterBegin.Path == "" {
 		ac.RegisterBegin.Path = "%s/attestation/options"
@@ -114,6 +152,18 @@ func (ac *Cmd) setDefaults() {
 	if ac.LoginFinish.Path == "" {
 		ac.LoginFinish.Path = "%s/assertion/result"
 	}
+	if ac.StepUpBegin.Path == "" {
+		ac.StepUpBegin.Path = "%s/stepup/options"
+	}
+	if ac.StepUpFinish.Path == "" {
+		ac.StepUpFinish.Path = "%s/stepup/result"
+	}
+	if ac.ConfirmBegin.Path == "" {
+		ac.ConfirmBegin.Path = "%s/transaction/options"
+	}
+	if ac.ConfirmFinish.Path == "" {
+		ac.ConfirmFinish.Path = "%s/transaction/result"
+	}
 }
 
 func (ac *Cmd) setMiddlePayloads() {
@@ -123,6 +173,9 @@ func (ac *Cmd) setMiddlePayloads() {
 	if ac.LoginBegin.MiddlePL == "" {
 		ac.LoginBegin.MiddlePL = `{"publicKey": %s}`
 	}
+	if ac.StepUpBegin.MiddlePL == "" {
+		ac.StepUpBegin.MiddlePL = `{"publicKey": %s}`
+	}
 }
 
 // setInPayloads, NOTE: use only for webuathn.io dialect.
@@ -175,8 +228,13 @@ func (ac *Cmd) setOldDefaults() {
 }
 
 type Result struct {
-	SubCmd string `json:"sub_cmd,omitempty"`
-	Token  string `json:"token"`
+	SubCmd  string `json:"sub_cmd,omitempty"`
+	Token   string `json:"token"`
+	DPoPKey string `json:"dpop_key,omitempty"`
+
+	// OnboardingID is returned by the registration when the cloud agent
+	// allocation is pending. The onboarding status is polled with it.
+	OnboardingID string `json:"onboarding_id,omitempty"`
 }
 
 func (r Result) String() string {
@@ -189,14 +247,7 @@ func (ac *Cmd) Exec(_ io.Writer) (r Result, err error) {
 
 	try.To(ac.Validate())
 
-	if ac.SecEnclave != nil {
-		glog.V(3).Infoln("------ using callers secure enclave")
-		enclave.Store = ac.SecEnclave
-	} else {
-		glog.V(5).Infoln("using master key, no secure enclave")
-		assert.NotEmpty(ac.Key) // just make sure
-		enclave.Store = enclave.New(ac.Key)
-	}
+	enclave.Store = ac.secureEnclave()
 
 	cmd := cmdModes[ac.SubCmd]
 
@@ -204,6 +255,18 @@ func (ac *Cmd) Exec(_ io.Writer) (r Result, err error) {
 	return *try.To1(execute[cmd](ec)), nil
 }
 
+// secureEnclave returns the caller's secure enclave, or the enclave of the
+// master key.
+func (ac *Cmd) secureEnclave() enclave.Secure {
+	if ac.SecEnclave != nil {
+		glog.V(3).Infoln("------ using callers secure enclave")
+		return ac.SecEnclave
+	}
+	glog.V(5).Infoln("using master key, no secure enclave")
+	assert.NotEmpty(ac.Key) // just make sure
+	return enclave.New(ac.Key)
+}
+
 func (ac Cmd) TryReadJSON(r io.Reader) Cmd {
 	var newCmd Cmd
 	try.To(json.NewDecoder(r).Decode(&newCmd))
@@ -227,6 +290,8 @@ type cmdMode int
 const (
 	register cmdMode = iota + 1
 	login
+	stepUp
+	confirm
 )
 
 type cmdFunc func(ec *execCmd) (*Result, error)
@@ -236,6 +301,16 @@ type execCmd struct {
 	*acator.Instance
 
 	*http.Client
+
+	// ceremonyID is received from the begin call and sent in the finish call
+	// when the server supports the cookie-less ceremony mode.
+	ceremonyID string
+
+	// dpopProof is sent in the next request.
+	dpopProof string
+
+	// onboardingID is received from the registration.
+	onboardingID string
 }
 
 func newExecCmd(cmd *Cmd) (ec *execCmd) {
@@ -257,12 +332,16 @@ var (
 	cmdModes = map[string]cmdMode{
 		"register": register,
 		"login":    login,
+		"stepup":   stepUp,
+		"confirm":  confirm,
 	}
 
 	execute = []cmdFunc{
 		empty,
 		registerUser,
 		loginUser,
+		stepUpUser,
+		confirmTransaction,
 	}
 )
 
@@ -329,7 +408,8 @@ func registerUser(ec *execCmd) (result *Result, err error) {
 		try.To(os.WriteFile(ec.CookieFile, buf.Bytes(), 0664))
 		glog.V(3).Infof("saving %d cookies", len(cookies))
 	}
-	return &Result{SubCmd: "register", Token: string(b)}, nil
+	return &Result{SubCmd: "register", Token: string(b),
+		OnboardingID: ec.onboardingID}, nil
 }
 
 func loginUser(ec *execCmd) (_ *Result, err error) {
@@ -374,6 +454,11 @@ func loginUser(ec *execCmd) (_ *Result, err error) {
 	if ec.LoginBegin.Method == "GET" {
 		finishURL = fmt.Sprintf(ec.LoginFinish.Path, ec.URL, ec.UserName)
 	}
+	if ec.DPoP {
+		kh := try.To1(ec.dpopKeyHandle())
+		ec.dpopProof = try.To1(NewDPoPProof(kh, ec.LoginFinish.Method,
+			finishURL, ""))
+	}
 
 	r2 := ec.tryHTTPRequest(ec.LoginFinish.Method, finishURL, js)
 	defer r2.Close()
@@ -386,9 +471,74 @@ func loginUser(ec *execCmd) (_ *Result, err error) {
 		result.Token = string(b)
 	}
 	result.SubCmd = "login"
+	if ec.DPoP {
+		result.DPoPKey = ec.DPoPKey
+	}
 	return &result, nil
 }
 
+// stepUpUser runs the step-up re-authentication with the JWT of the login,
+// and returns the elevated JWT, which is needed e.g. to register a new
+// authenticator.
+func stepUpUser(ec *execCmd) (_ *Result, err error) {
+	defer err2.Handle(&err, "step-up user")
+
+	ec.checkCookiePath()
+
+	beginURL := fmt.Sprintf(ec.StepUpBegin.Path, ec.URL)
+	r := ec.tryHTTPRequest(ec.StepUpBegin.Method, beginURL, strings.NewReader("{}"))
+	defer r.Close()
+
+	var js io.Reader
+	if ec.StepUpBegin.MiddlePL != "" {
+		resp := string(try.To1(io.ReadAll(r)))
+		pl := fmt.Sprintf(ec.StepUpBegin.MiddlePL, resp)
+		js = try.To1(acator.Login(ec.Instance, strings.NewReader(pl)))
+	} else {
+		js = try.To1(acator.Login(ec.Instance, r))
+	}
+
+	finishURL := fmt.Sprintf(ec.StepUpFinish.Path, ec.URL)
+	r2 := ec.tryHTTPRequest(ec.StepUpFinish.Method, finishURL, js)
+	defer r2.Close()
+
+	b := try.To1(io.ReadAll(r2))
+	return &Result{SubCmd: "stepup", Token: string(b)}, nil
+}
+
+// confirmTransaction confirms the transaction data, and returns the signed
+// receipt. The challenge is signed only if it's derived from the data.
+func confirmTransaction(ec *execCmd) (_ *Result, err error) {
+	defer err2.Handle(&err, "confirm transaction")
+
+	ec.checkCookiePath()
+
+	pl := try.To1(json.Marshal(struct {
+		Data string `json:"data"`
+	}{Data: ec.Transaction}))
+	beginURL := fmt.Sprintf(ec.ConfirmBegin.Path, ec.URL)
+	r := ec.tryHTTPRequest(ec.ConfirmBegin.Method, beginURL, bytes.NewReader(pl))
+	defer r.Close()
+
+	resp := try.To1(io.ReadAll(r))
+	var options struct {
+		Challenge   protocol.URLEncodedBase64   `json:"challenge"`
+		Transaction ceremony.TransactionBinding `json:"transaction"`
+	}
+	try.To(json.Unmarshal(resp, &options))
+	try.To(options.Transaction.Verify(ec.Transaction, options.Challenge))
+
+	js := try.To1(acator.Login(ec.Instance,
+		strings.NewReader(fmt.Sprintf(`{"publicKey": %s}`, resp))))
+
+	finishURL := fmt.Sprintf(ec.ConfirmFinish.Path, ec.URL)
+	r2 := ec.tryHTTPRequest(ec.ConfirmFinish.Method, finishURL, js)
+	defer r2.Close()
+
+	b := try.To1(io.ReadAll(r2))
+	return &Result{SubCmd: "confirm", Token: string(b)}, nil
+}
+
 func (ec *execCmd) tryHTTPRequest(method, addr string, msg io.Reader) (reader io.ReadCloser) {
 	glog.V(13).Infof("=== '%v'", addr)
 	URL := try.To1(url.Parse(addr))
@@ -399,10 +549,30 @@ func (ec *execCmd) tryHTTPRequest(method, addr string, msg io.Reader) (reader io
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("Origin", ec.Instance.Origin.String())
 	request.Header.Add("Accept", "*/*")
-	// if we want to register a new authenticator, we must send valid JWT
-	if ec.Token != "" {
+	// step-up and the registration of a new authenticator need the JWT, the
+	// DPoP bound JWT is sent with the proof of the request
+	switch {
+	case ec.Token != "" && ec.DPoP && ec.DPoPKey != "":
+		request.Header.Add("Authorization", ceremony.DPoPHeader+" "+ec.Token)
+		// the proof given by the caller, e.g. for the login, is kept
+		if ec.dpopProof == "" {
+			kh := try.To1(ec.dpopKeyHandle())
+			ec.dpopProof = try.To1(NewDPoPProof(kh, method, URL.String(), ec.Token))
+		}
+	case ec.Token != "":
 		request.Header.Add("Authorization", "Bearer "+ec.Token)
 	}
+	// we ask for the cookie-less mode, servers not supporting it use cookies
+	request.Header.Set(ceremony.ModeHeader, ceremony.ModeToken)
+	if ec.dpopProof != "" {
+		request.Header.Set(ceremony.DPoPHeader, ec.dpopProof)
+		ec.dpopProof = ""
+	}
+	if ec.ceremonyID != "" {
+		glog.V(3).Infoln("using ceremony ID instead of cookies")
+		request.Header.Set(ceremony.Header, ec.ceremonyID)
+		ec.ceremonyID = ""
+	}
 	if rawCookies := os.Getenv("COOKIE"); rawCookies != "" {
 		glog.V(3).Infoln("setting cookies from env (COOKIE):\n", rawCookies)
 		request.Header.Add("Cookie", rawCookies)
@@ -427,6 +597,13 @@ func (ec *execCmd) tryHTTPRequest(method, addr string, msg io.Reader) (reader io
 
 	echoRespToStdout(response)
 
+	if id := response.Header.Get(ceremony.Header); id != "" {
+		ec.ceremonyID = id
+	}
+	if id := response.Header.Get(ceremony.OnboardingHeader); id != "" {
+		ec.onboardingID = id
+	}
+
 	return response.Body
 }
 
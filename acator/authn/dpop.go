@@ -0,0 +1,106 @@
+package authn
+
+import (
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/acator/enclave"
+	"github.com/findy-network/findy-agent-auth/ceremony"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// DPoPProof creates the DPoP proof (RFC 9449) for the HTTP request with the
+// DPoP key of the Cmd. The access token is given when the proof is sent with
+// the DPoP bound token to the resource server.
+func (ac *Cmd) DPoPProof(method, url, accessToken string) (_ string, err error) {
+	defer err2.Handle(&err, "DPoP proof")
+
+	if ac.DPoPKey == "" {
+		return "", errors.New("DPoP key missing")
+	}
+	id := try.To1(base64.RawURLEncoding.DecodeString(ac.DPoPKey))
+	found, kh := ac.secureEnclave().IsKeyHandle(id)
+	if !found {
+		return "", errors.New("DPoP key not in the enclave")
+	}
+	return NewDPoPProof(kh, method, url, accessToken)
+}
+
+// NewDPoPProof creates the DPoP proof signed with the ES256 key handle.
+func NewDPoPProof(kh enclave.KeyHandle, method, url, accessToken string) (
+	_ string, err error,
+) {
+	defer err2.Handle(&err, "new DPoP proof")
+
+	var pub webauthncose.EC2PublicKeyData
+	try.To(cbor.Unmarshal(try.To1(kh.CBORPublicKey()), &pub))
+	header := map[string]any{
+		"typ": ceremony.DPoPType,
+		"alg": "ES256",
+		"jwk": map[string]string{
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   b64(pad32(pub.XCoord)),
+			"y":   b64(pad32(pub.YCoord)),
+		},
+	}
+	claims := ceremony.DPoPClaims{
+		Method: method,
+		URL:    url,
+	}
+	jti := make([]byte, 16)
+	try.To1(rand.Read(jti))
+	claims.ID = b64(jti)
+	claims.IssuedAt = jwt.NewNumericDate(time.Now())
+	if accessToken != "" {
+		claims.AccessTokenHash = ceremony.AccessTokenHash(accessToken)
+	}
+
+	input := b64(try.To1(json.Marshal(header))) + "." +
+		b64(try.To1(json.Marshal(claims)))
+
+	// the key handle gives ASN.1 signature, JWS needs R || S
+	var sig struct{ R, S *big.Int }
+	_ = try.To1(asn1.Unmarshal(try.To1(kh.Sign([]byte(input))), &sig))
+	raw := append(pad32(sig.R.Bytes()), pad32(sig.S.Bytes())...)
+
+	return input + "." + b64(raw), nil
+}
+
+// dpopKeyHandle returns the DPoP key handle of the execution. The new key is
+// created to the enclave if the Cmd doesn't have it.
+func (ec *execCmd) dpopKeyHandle() (_ enclave.KeyHandle, err error) {
+	defer err2.Handle(&err, "DPoP key")
+
+	if ec.DPoPKey != "" {
+		id := try.To1(base64.RawURLEncoding.DecodeString(ec.DPoPKey))
+		found, kh := enclave.Store.IsKeyHandle(id)
+		if !found {
+			return nil, errors.New("DPoP key not in the enclave")
+		}
+		return kh, nil
+	}
+	kh := try.To1(enclave.Store.NewKeyHandle())
+	ec.DPoPKey = b64(kh.ID())
+	return kh, nil
+}
+
+func pad32(b []byte) []byte {
+	if len(b) >= 32 {
+		return b
+	}
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
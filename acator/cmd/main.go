@@ -144,7 +144,11 @@ func init() {
 	startServerCmd.StringVar(&authnCmd.LoginFinish.Payload, "log-finish-pl",
 		authnCmd.LoginFinish.Payload, "format string to build endpoint payload JSON template")
 
-	startServerCmd.StringVar(&authnCmd.SubCmd, "subcmd", authnCmd.SubCmd, "sub command: login|register")
+	startServerCmd.StringVar(&authnCmd.SubCmd, "subcmd", authnCmd.SubCmd, "sub command: login|register|stepup|confirm")
+	startServerCmd.StringVar(&authnCmd.Token, "token", authnCmd.Token, "JWT for stepup, or elevated JWT for registering a new authenticator")
+	startServerCmd.StringVar(&authnCmd.Transaction, "tx", authnCmd.Transaction, "transaction data to confirm")
+	startServerCmd.BoolVar(&authnCmd.DPoP, "dpop", authnCmd.DPoP, "bind the login tokens to the DPoP key")
+	startServerCmd.StringVar(&authnCmd.DPoPKey, "dpop-key", authnCmd.DPoPKey, "DPoP key handle ID, a new key is created if not given")
 	startServerCmd.StringVar(&authnCmd.UserName, "name", authnCmd.UserName, "user name")
 	startServerCmd.StringVar(&authnCmd.AAGUID, "aaguid", authnCmd.AAGUID, "AAGUID")
 	startServerCmd.StringVar(&authnCmd.Key, "key", authnCmd.Key, "authenticator master key")
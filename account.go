@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/enclave"
+	"github.com/findy-network/findy-agent-auth/user"
+	"github.com/golang/glog"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// removeAccount offboards the user's cloud agent from the agency, removes the
+// user and revokes the user's tokens. If the agency fails, the user isn't
+// removed, and the deletion can be tried again. The deletion is recorded with
+// the actor, i.e. the DID of the user or the admin, before the user is removed
+// that no account disappears without the record.
+//
+// If the allocator cannot offboard, the deletion fails, and the account is
+// disabled and left to the admin, who removes the cloud agent in the agency
+// and then deletes the account with offboarded.
+func removeAccount(ctx context.Context, u *user.User, actor string, offboarded bool) (err error) {
+	defer err2.Handle(&err, "remove account")
+
+	deletion := try.To1(u.OffboardCloudAgent(ctx, findyAdmin,
+		time.Duration(timeoutSecs)*time.Second))
+	deletion.Actor = actor
+	if deletion.Offboard == user.OffboardRetained {
+		if !offboarded {
+			try.To(pendDeletion(u, actor, deletion.OffboardError))
+			return fmt.Errorf("%w: %w: %s", errConflict, errOffboardPending, u.Name)
+		}
+		deletion.Offboard = user.OffboardManual
+		deletion.OffboardError = ""
+	}
+
+	try.To(enclave.PutDeletion(deletion))
+	try.To(enclave.RemoveUser(u.Name))
+	try.To(revokeUserTokens(u.Name))
+
+	glog.Infof("account deleted, DID: %s, actor: %s, cloud agent: %s",
+		deletion.DID, actor, deletion.Offboard)
+	return nil
+}
+
+// pendDeletion disables the account, which waits for the admin to remove the
+// cloud agent, and revokes the user's tokens.
+func pendDeletion(u *user.User, actor, reason string) (err error) {
+	defer err2.Handle(&err, "pend deletion")
+
+	if u.PendingDeletion == nil {
+		u.PendingDeletion = &user.PendingDeletion{
+			Requested: time.Now(),
+			Actor:     actor,
+			Reason:    reason,
+		}
+	}
+	u.Disabled = true
+	try.To(enclave.PutUser(u))
+	try.To(revokeUserTokens(u.Name))
+
+	glog.Warningf("deletion of %s waits for the admin, DID: %s", u.Name, u.DID)
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/enclave"
+	"github.com/findy-network/findy-agent-auth/token"
+	"github.com/findy-network/findy-agent-auth/user"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestAdminDeleteAccount(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	admin := user.New(findyAdmin, findyAdmin, "")
+	admin.DID = findyAdmin
+	admin.AddCredential(webauthn.Credential{ID: []byte("admin-cred")})
+	try.To(enclave.PutUser(admin))
+	defer func() { _ = enclave.RemoveUser(findyAdmin) }()
+
+	const name = "deleted-by-admin"
+	u := user.New(name, name, "")
+	u.DID = "deleted-by-admin-did"
+	u.AddCredential(webauthn.Credential{ID: []byte("cred")})
+	try.To(enclave.PutUser(u))
+
+	elevated := func(did string) string {
+		ts, _ := try.To2(token.IssueElevated(did, did,
+			&token.Auth{Time: time.Now()}, time.Minute))
+		return ts
+	}
+	r := newMuxWithRoutes()
+	call := func(username, token string) int {
+		req := httptest.NewRequest("DELETE", "/admin/users/"+username, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+
+	assert.Equal(call(name, ""), http.StatusBadRequest)
+	assert.Equal(call(name, try.To1(token.Build(admin.DID, admin.DisplayName, nil))),
+		http.StatusUnauthorized)
+	assert.Equal(call(name, elevated(u.DID)), http.StatusForbidden)
+	assert.Equal(call(findyAdmin, elevated(admin.DID)), http.StatusBadRequest)
+	assert.Equal(call("not-exists", elevated(admin.DID)), http.StatusBadRequest)
+
+	// the agent cannot be offboarded, the account waits for the admin
+	assert.Equal(call(name, elevated(admin.DID)), http.StatusConflict)
+	pending := try.To1(enclave.GetExistingUser(name))
+	assert.That(pending.Disabled)
+	assert.NotNil(pending.PendingDeletion)
+	assert.Equal(pending.PendingDeletion.Actor, admin.DID)
+	assert.Equal(call(name+"?offboarded=maybe", elevated(admin.DID)),
+		http.StatusBadRequest)
+
+	assert.Equal(call(name+"?offboarded=true", elevated(admin.DID)), http.StatusOK)
+	_, exists := try.To2(enclave.GetUser(name))
+	assert.ThatNot(exists)
+
+	var deletion *user.Deletion
+	for _, d := range try.To1(enclave.GetDeletions()) {
+		if d.DID == u.DID {
+			deletion = d
+		}
+	}
+	assert.NotNil(deletion)
+	assert.Equal(deletion.Actor, admin.DID)
+	assert.Equal(deletion.Offboard, user.OffboardManual)
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/enclave"
+	"github.com/findy-network/findy-agent-auth/user"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// The page sizes of the user list.
+const (
+	adminDefaultPageSize = 50
+	adminMaxPageSize     = 500
+)
+
+// adminUser is the user presentation of the admin API.
+type adminUser struct {
+	Name           string                `json:"name"`
+	DisplayName    string                `json:"displayName"`
+	DID            string                `json:"did,omitempty"`
+	Onboarding     string                `json:"onboarding"`
+	Disabled       bool                  `json:"disabled,omitempty"`
+	ReRegistration bool                  `json:"reRegistration,omitempty"`
+	Credentials    []user.CredentialInfo `json:"credentials"`
+
+	PendingDeletion *adminPendingDeletion `json:"pendingDeletion,omitempty"`
+}
+
+// adminPendingDeletion is the deletion of the account, which waits for the
+// admin to remove the cloud agent in the agency.
+type adminPendingDeletion struct {
+	Requested time.Time `json:"requested"`
+	Actor     string    `json:"actor"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+type adminUserPage struct {
+	Users      []adminUser `json:"users"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+}
+
+// adminDeletion is the record of the deleted account in the admin API.
+type adminDeletion struct {
+	ID            string    `json:"id"`
+	DID           string    `json:"did,omitempty"`
+	Deleted       time.Time `json:"deleted"`
+	Actor         string    `json:"actor"`
+	Offboard      string    `json:"offboard"`
+	OffboardError string    `json:"offboardError,omitempty"`
+}
+
+type reRegistrationCode struct {
+	Code    string    `json:"registrationCode"`
+	Expires time.Time `json:"expires"`
+}
+
+func newAdminUser(u *user.User) adminUser {
+	au := adminUser{
+		Name:           u.Name,
+		DisplayName:    u.DisplayName,
+		DID:            u.DID,
+		Onboarding:     u.OnboardingStatus(),
+		Disabled:       u.Disabled,
+		ReRegistration: u.ReRegistration != nil,
+		Credentials:    u.CredentialInfos(),
+	}
+	if d := u.PendingDeletion; d != nil {
+		au.PendingDeletion = &adminPendingDeletion{
+			Requested: d.Requested,
+			Actor:     d.Actor,
+			Reason:    d.Reason,
+		}
+	}
+	return au
+}
+
+// adminListUsers returns the page of the users ordered by the name. The next
+// page is read with the cursor of the previous page. The elevated JWT of the
+// admin is required.
+func adminListUsers(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	_ = try.To1(authorizedAdmin(w, r))
+
+	defer err2.Handle(&err, markErrBadRequest)
+
+	query := r.URL.Query()
+	limit := adminDefaultPageSize
+	if s := query.Get("limit"); s != "" {
+		limit = try.To1(strconv.Atoi(s))
+		if limit < 1 || limit > adminMaxPageSize {
+			err2.Throwf("limit must be 1-%d", adminMaxPageSize)
+		}
+	}
+	var after string
+	if cursor := query.Get("cursor"); cursor != "" {
+		var ok bool
+		if after, ok = enclave.UsersCursorName(cursor); !ok {
+			err2.Throwf("invalid cursor")
+		}
+	}
+
+	defer err2.Handle(&err, markErrInternal)
+
+	users, next := try.To2(enclave.GetUsers(after, limit))
+	page := adminUserPage{Users: make([]adminUser, 0, len(users))}
+	for _, u := range users {
+		page.Users = append(page.Users, newAdminUser(u))
+	}
+	if next != "" {
+		page.NextCursor = enclave.UsersCursor(next)
+	}
+	jsonResponse(w, page, nil)
+}
+
+// adminListDeletions returns the records of the deleted accounts, the latest
+// first. The elevated JWT of the admin is required.
+func adminListDeletions(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	_ = try.To1(authorizedAdmin(w, r))
+
+	defer err2.Handle(&err, markErrInternal)
+
+	deletions := try.To1(enclave.GetDeletions())
+	sort.Slice(deletions, func(i, j int) bool {
+		return deletions[i].Deleted.After(deletions[j].Deleted)
+	})
+	list := make([]adminDeletion, 0, len(deletions))
+	for _, d := range deletions {
+		list = append(list, adminDeletion{
+			ID:            d.ID,
+			DID:           d.DID,
+			Deleted:       d.Deleted,
+			Actor:         d.Actor,
+			Offboard:      d.Offboard,
+			OffboardError: d.OffboardError,
+		})
+	}
+	jsonResponse(w, list, nil)
+}
+
+// adminListOffboardings returns the users whose deletion waits for the admin
+// to remove the cloud agent in the agency, the oldest first. The admin deletes
+// the account with the offboarded query after that. The elevated JWT of the
+// admin is required.
+func adminListOffboardings(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	_ = try.To1(authorizedAdmin(w, r))
+
+	defer err2.Handle(&err, markErrInternal)
+
+	users, _ := try.To2(enclave.GetUsers("", 0))
+	list := make([]adminUser, 0)
+	for _, u := range users {
+		if u.PendingDeletion != nil {
+			list = append(list, newAdminUser(u))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].PendingDeletion.Requested.Before(list[j].PendingDeletion.Requested)
+	})
+	jsonResponse(w, list, nil)
+}
+
+// adminGetUser returns the user of the request path. The elevated JWT of the
+// admin is required.
+func adminGetUser(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	_ = try.To1(authorizedAdmin(w, r))
+
+	defer err2.Handle(&err, markErrBadRequest)
+
+	u := try.To1(enclave.GetExistingUser(mux.Vars(r)["username"]))
+	jsonResponse(w, newAdminUser(u), nil)
+}
+
+// adminGetUserByDID returns the user of the DID in the request path. The
+// elevated JWT of the admin is required.
+func adminGetUserByDID(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	_ = try.To1(authorizedAdmin(w, r))
+
+	defer err2.Handle(&err, markErrBadRequest)
+
+	did := mux.Vars(r)["did"]
+	u, exists := try.To2(enclave.GetUserByDID(did))
+	if !exists {
+		err2.Throwf("user of DID (%s) not exist", did)
+	}
+	jsonResponse(w, newAdminUser(u), nil)
+}
+
+// adminDisableUser disables the user of the request path and revokes the
+// user's tokens. The elevated JWT of the admin is required.
+func adminDisableUser(w http.ResponseWriter, r *http.Request) {
+	setDisabled(w, r, true)
+}
+
+// adminEnableUser enables the disabled user of the request path. The elevated
+// JWT of the admin is required.
+func adminEnableUser(w http.ResponseWriter, r *http.Request) {
+	setDisabled(w, r, false)
+}
+
+func setDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	admin := try.To1(authorizedAdmin(w, r))
+
+	defer err2.Handle(&err, markErrBadRequest)
+
+	u := try.To1(adminTargetUser(r, admin))
+
+	defer err2.Handle(&err, markErrInternal)
+
+	u.Disabled = disabled
+	if !disabled {
+		// the enabled account isn't deleted anymore
+		u.PendingDeletion = nil
+	}
+	try.To(enclave.PutUser(u))
+	if disabled {
+		try.To(revokeUserTokens(u.Name))
+	}
+
+	jsonResponse(w, newAdminUser(u), nil)
+	glog.Infof("admin %s set user %s disabled: %v", admin.Name, u.Name, disabled)
+}
+
+// adminRemoveCredential removes the user's credential and revokes the tokens
+// issued to it. The last usable credential cannot be removed, but the
+// re-registration can be forced instead. The elevated JWT of the admin is
+// required.
+func adminRemoveCredential(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	admin := try.To1(authorizedAdmin(w, r))
+
+	defer err2.Handle(&err, markErrBadRequest)
+
+	u := try.To1(enclave.GetExistingUser(mux.Vars(r)["username"]))
+	credID := try.To1(requestCredentialID(r))
+	try.To(markCredentialErr(u.RemoveCredential(credID)))
+
+	defer err2.Handle(&err, markErrInternal)
+
+	try.To(enclave.PutUser(u))
+	try.To(revokeCredentialTokens(u.Name, credID))
+
+	jsonResponse(w, newAdminUser(u), nil)
+	glog.Infof("admin %s removed credential of user %s", admin.Name, u.Name)
+}
+
+// adminForceReRegistration removes all the user's credentials and revokes the
+// user's tokens. The returned one-time registration code is given to the user,
+// who registers the new authenticator with it. The user keeps the cloud agent.
+// The elevated JWT of the admin is required.
+func adminForceReRegistration(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	admin := try.To1(authorizedAdmin(w, r))
+
+	defer err2.Handle(&err, markErrBadRequest)
+
+	u := try.To1(adminTargetUser(r, admin))
+
+	defer err2.Handle(&err, markErrInternal)
+
+	code := try.To1(u.ForceReRegistration(user.DefaultReRegistrationLifetime))
+	try.To(enclave.PutUser(u))
+	try.To(revokeUserTokens(u.Name))
+
+	jsonResponse(w, reRegistrationCode{
+		Code:    code,
+		Expires: u.ReRegistration.Expires,
+	}, nil)
+	glog.Infof("admin %s forced re-registration of user %s", admin.Name, u.Name)
+}
+
+// adminDeleteAccount removes the user of the request path like deleteAccount.
+// The offboarded query tells that the admin has removed the cloud agent in the
+// agency, which the allocator cannot do. The elevated JWT of the admin is
+// required.
+func adminDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	admin := try.To1(authorizedAdmin(w, r))
+
+	defer err2.Handle(&err, markErrBadRequest)
+
+	u := try.To1(adminTargetUser(r, admin))
+	offboarded := false
+	if s := r.URL.Query().Get("offboarded"); s != "" {
+		offboarded = try.To1(strconv.ParseBool(s))
+	}
+
+	defer err2.Handle(&err, markErrInternal)
+
+	try.To(removeAccount(r.Context(), u, admin.DID, offboarded))
+
+	jsonResponse(w, "Account Deleted", nil)
+	glog.Infof("admin %s deleted account %s", admin.Name, u.Name)
+}
+
+// adminTargetUser returns the user of the request path. The admin cannot
+// target itself, i.e. lock itself out.
+func adminTargetUser(r *http.Request, admin *user.User) (u *user.User, err error) {
+	defer err2.Handle(&err)
+
+	username := mux.Vars(r)["username"]
+	if username == admin.Name {
+		return nil, errors.New("admin cannot target itself")
+	}
+	return enclave.GetExistingUser(username)
+}
+
+// authorizedAdmin returns the admin user if the request carries the elevated
+// JWT of the admin.
+func authorizedAdmin(w http.ResponseWriter, r *http.Request) (u *user.User, err error) {
+	defer err2.Handle(&err)
+
+	claims, err := loginClaims(r)
+	if errors.Is(err, errUnauthorized) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid token", errBadRequest)
+	}
+	u, exists := try.To2(enclave.GetUserByDID(claims.Username))
+	if !exists || u.Name != findyAdmin {
+		glog.Warningln("admin required, DID:", claims.Username)
+		return nil, fmt.Errorf("%w: %w", errForbidden, errAdminRequired)
+	}
+	return u, requireElevated(w, claims, u)
+}
+
+// requireEnabled checks that the admin hasn't disabled the user.
+func requireEnabled(u *user.User) error {
+	if u.Disabled {
+		return fmt.Errorf("%w: %w: %s", errForbidden, errAccountDisabled, u.Name)
+	}
+	return nil
+}
+
+// authorizeNewAuthenticator checks that the existing user can register the
+// new authenticator: with the registration code of the forced re-registration,
+// or with the elevated JWT of the user.
+func authorizeNewAuthenticator(w http.ResponseWriter, r *http.Request, u *user.User, code string) error {
+	if err := requireEnabled(u); err != nil {
+		return err
+	}
+	if u.ReRegistration != nil && code != "" {
+		if !u.VerifyReRegistration(code, time.Now()) {
+			return fmt.Errorf("%w: invalid registration code", errUnauthorized)
+		}
+		return nil
+	}
+	claims, err := loginClaims(r)
+	if errors.Is(err, errUnauthorized) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%w: invalid token", errBadRequest)
+	}
+	return requireElevated(w, claims, u)
+}
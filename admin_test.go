@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/acator/authn"
+	"github.com/findy-network/findy-agent-auth/enclave"
+	"github.com/findy-network/findy-agent-auth/token"
+	"github.com/findy-network/findy-agent-auth/user"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestAdminAPI(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	admin := user.New(findyAdmin, findyAdmin, "")
+	admin.DID = findyAdmin
+	admin.AddCredential(webauthn.Credential{ID: []byte("admin-cred")})
+	try.To(enclave.PutUser(admin))
+	defer func() { _ = enclave.RemoveUser(findyAdmin) }()
+
+	names := []string{"admin-api-b", "admin-api-a", "admin-api-c"}
+	for _, name := range names {
+		u := user.New(name, name, "")
+		u.DID = name + "-did"
+		u.AddCredential(webauthn.Credential{ID: []byte("first")})
+		u.AddCredential(webauthn.Credential{ID: []byte("second")})
+		try.To(enclave.PutUser(u))
+	}
+
+	elevated := func(did string) string {
+		ts, _ := try.To2(token.IssueElevated(did, did,
+			&token.Auth{Time: time.Now()}, time.Minute))
+		return ts
+	}
+	adminToken := elevated(admin.DID)
+	r := newMuxWithRoutes()
+	call := func(method, path, token string) (int, []byte) {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		return res.StatusCode, try.To1(io.ReadAll(res.Body))
+	}
+	get := func(path string) (u adminUser) {
+		code, data := call("GET", path, adminToken)
+		assert.Equal(code, http.StatusOK)
+		try.To(json.Unmarshal(data, &u))
+		return u
+	}
+
+	t.Run("authorization", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		code, _ := call("GET", urlAdminUsers, "")
+		assert.Equal(code, http.StatusBadRequest)
+		code, _ = call("GET", urlAdminUsers,
+			try.To1(token.Build(admin.DID, admin.DisplayName, nil)))
+		assert.Equal(code, http.StatusUnauthorized)
+		code, _ = call("GET", urlAdminUsers, elevated("admin-api-a-did"))
+		assert.Equal(code, http.StatusForbidden)
+		code, _ = call("GET", urlAdminUsers+"?limit=0", adminToken)
+		assert.Equal(code, http.StatusBadRequest)
+		cursor := base64.RawURLEncoding.EncodeToString([]byte("admin-api-"))
+		code, _ = call("GET", urlAdminUsers+"?cursor="+cursor, adminToken)
+		assert.Equal(code, http.StatusBadRequest)
+	})
+	t.Run("list and lookup", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		var listed []string
+		for cursor, more := "", true; more; more = cursor != "" {
+			code, data := call("GET", urlAdminUsers+"?limit=2&cursor="+cursor, adminToken)
+			assert.Equal(code, http.StatusOK)
+			var page adminUserPage
+			try.To(json.Unmarshal(data, &page))
+			assert.That(len(page.Users) <= 2)
+			for _, u := range page.Users {
+				if strings.HasPrefix(u.Name, "admin-api-") {
+					listed = append(listed, u.Name)
+				}
+			}
+			assert.ThatNot(strings.Contains(page.NextCursor, "admin"))
+			cursor = page.NextCursor
+		}
+		assert.DeepEqual(listed, []string{"admin-api-a", "admin-api-b", "admin-api-c"})
+
+		u := get("/admin/users/admin-api-a")
+		assert.Equal(u.DID, "admin-api-a-did")
+		assert.SLen(u.Credentials, 2)
+		assert.Equal(get("/admin/dids/admin-api-b-did").Name, "admin-api-b")
+		code, _ := call("GET", "/admin/dids/not-exists", adminToken)
+		assert.Equal(code, http.StatusBadRequest)
+	})
+	t.Run("disable and enable", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		userToken := try.To1(token.Build("admin-api-a-did", "admin-api-a", nil))
+		code, _ := call("GET", "/credentials/admin-api-a", userToken)
+		assert.Equal(code, http.StatusOK)
+
+		code, _ = call("POST", "/admin/users/"+findyAdmin+"/disable", adminToken)
+		assert.Equal(code, http.StatusBadRequest)
+		code, _ = call("POST", "/admin/users/admin-api-a/disable", adminToken)
+		assert.Equal(code, http.StatusOK)
+		assert.That(get("/admin/users/admin-api-a").Disabled)
+		code, _ = call("GET", "/credentials/admin-api-a", userToken)
+		assert.Equal(code, http.StatusForbidden)
+
+		code, _ = call("POST", "/admin/users/admin-api-a/enable", adminToken)
+		assert.Equal(code, http.StatusOK)
+		code, _ = call("GET", "/credentials/admin-api-a", userToken)
+		assert.Equal(code, http.StatusOK)
+	})
+	t.Run("remove credential", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		first := base64.RawURLEncoding.EncodeToString([]byte("first"))
+		second := base64.RawURLEncoding.EncodeToString([]byte("second"))
+		code, _ := call("DELETE", "/admin/users/admin-api-b/credentials/"+first, adminToken)
+		assert.Equal(code, http.StatusOK)
+		code, _ = call("DELETE", "/admin/users/admin-api-b/credentials/"+second, adminToken)
+		assert.Equal(code, http.StatusBadRequest)
+		assert.SLen(get("/admin/users/admin-api-b").Credentials, 1)
+	})
+	t.Run("delete account", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		code, _ := call("DELETE", "/admin/users/"+findyAdmin, adminToken)
+		assert.Equal(code, http.StatusBadRequest)
+		code, _ = call("DELETE", "/admin/users/not-exists", adminToken)
+		assert.Equal(code, http.StatusBadRequest)
+		code, _ = call("DELETE", "/admin/users/admin-api-c", elevated("admin-api-a-did"))
+		assert.Equal(code, http.StatusForbidden)
+
+		code, _ = call("DELETE", "/admin/users/admin-api-c", adminToken)
+		assert.Equal(code, http.StatusConflict)
+
+		// the retained agent is the admin's work item
+		code, _ = call("GET", urlAdminOffboardings, elevated("admin-api-a-did"))
+		assert.Equal(code, http.StatusForbidden)
+		code, data := call("GET", urlAdminOffboardings, adminToken)
+		assert.Equal(code, http.StatusOK)
+		var pending []adminUser
+		try.To(json.Unmarshal(data, &pending))
+		assert.SLen(pending, 1)
+		assert.Equal(pending[0].Name, "admin-api-c")
+		assert.That(pending[0].Disabled)
+		assert.Equal(pending[0].PendingDeletion.Actor, admin.DID)
+
+		code, _ = call("DELETE", "/admin/users/admin-api-c?offboarded=true", adminToken)
+		assert.Equal(code, http.StatusOK)
+		_, exists := try.To2(enclave.GetUser("admin-api-c"))
+		assert.ThatNot(exists)
+		_, data = call("GET", urlAdminOffboardings, adminToken)
+		try.To(json.Unmarshal(data, &pending))
+		assert.SLen(pending, 0)
+
+		code, _ = call("GET", urlAdminDeletions, elevated("admin-api-a-did"))
+		assert.Equal(code, http.StatusForbidden)
+		code, data = call("GET", urlAdminDeletions, adminToken)
+		assert.Equal(code, http.StatusOK)
+		var deletions []adminDeletion
+		try.To(json.Unmarshal(data, &deletions))
+		var deletion *adminDeletion
+		for i := range deletions {
+			if deletions[i].DID == "admin-api-c-did" {
+				deletion = &deletions[i]
+			}
+		}
+		assert.NotNil(deletion)
+		assert.Equal(deletion.Actor, admin.DID)
+		assert.Equal(deletion.Offboard, user.OffboardManual)
+	})
+}
+
+func TestAdminForceReRegistration(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	admin := user.New(findyAdmin, findyAdmin, "")
+	admin.DID = findyAdmin
+	admin.AddCredential(webauthn.Credential{ID: []byte("admin-cred")})
+	try.To(enclave.PutUser(admin))
+	defer func() { _ = enclave.RemoveUser(findyAdmin) }()
+
+	server := httptest.NewServer(newMuxWithRoutes())
+	defer server.Close()
+
+	const name = "re-register-user"
+	cmd := authn.Cmd{
+		SubCmd:   "register",
+		UserName: name,
+		URL:      server.URL,
+		AAGUID:   "12c85a48-4baf-47bd-b51f-f192871a1511",
+		Key:      "15308490f1e4026284594dd08d31291bc8ef2aeac730d0daf6ff87bb92d4336c",
+		Origin:   defaultOrigin,
+	}
+	_ = try.To1(cmd.Exec(nil))
+	did := try.To1(enclave.GetExistingUser(name)).DID
+	assert.NotEmpty(did)
+
+	adminToken, _ := try.To2(token.IssueElevated(admin.DID, admin.DisplayName,
+		&token.Auth{Time: time.Now()}, time.Minute))
+	req := try.To1(http.NewRequest("POST",
+		server.URL+"/admin/users/"+url.PathEscape(name)+"/reregister", nil))
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	res := try.To1(http.DefaultClient.Do(req))
+	defer res.Body.Close()
+	assert.Equal(res.StatusCode, http.StatusOK)
+	var code reRegistrationCode
+	try.To(json.NewDecoder(res.Body).Decode(&code))
+	assert.NotEmpty(code.Code)
+
+	// the lost authenticator cannot log in anymore
+	cmd.SubCmd = "login"
+	_, err := cmd.Exec(nil)
+	assert.Error(err)
+
+	beginRegistration := func(code string) int {
+		res := try.To1(http.Post(server.URL+urlBeginRegister, "application/json",
+			strings.NewReader(fmt.Sprintf(`{"username":"%s","registrationCode":"%s"}`,
+				name, code))))
+		defer res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(beginRegistration(""), http.StatusBadRequest)
+	assert.Equal(beginRegistration("invalid"), http.StatusUnauthorized)
+
+	cmd.SubCmd = "register"
+	cmd.Key = "4db9d1e5f05ad5a9c1c1ba1ce5ab7bf5a2abb8f0c3b5cd8f6d3a1e5c4b2a1908"
+	cmd.RegisterBegin.Payload = `{"username":"%s","registrationCode":"` + code.Code + `"}`
+	_ = try.To1(cmd.Exec(nil))
+
+	u := try.To1(enclave.GetExistingUser(name))
+	assert.SLen(u.Credentials, 1)
+	assert.Equal(u.DID, did)
+	assert.That(u.ReRegistration == nil)
+
+	cmd.SubCmd = "login"
+	_ = try.To1(cmd.Exec(nil))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/findy-network/findy-agent-auth/enclave"
+	"github.com/golang/glog"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// envAdminBootstrapToken is the environment variable for the admin bootstrap
+// token, which is used when the token isn't given with the flag.
+const envAdminBootstrapToken = "FAA_ADMIN_BOOTSTRAP_TOKEN"
+
+// adminBootstrap is the hash of the one-time token required to register the
+// admin. It's nil when the admin exists, and then the admin's credentials can
+// be added only with the elevated JWT of the admin.
+var adminBootstrap struct {
+	sync.Mutex
+	hash []byte
+}
+
+// setupAdminBootstrap sets the admin bootstrap token if the admin isn't
+// registered yet. The token is taken from the flag or the environment, and if
+// it isn't given, it's generated and printed once.
+func setupAdminBootstrap() (err error) {
+	defer err2.Handle(&err, "admin bootstrap")
+
+	adminBootstrap.Lock()
+	defer adminBootstrap.Unlock()
+
+	adminBootstrap.hash = nil
+	if u, exists := try.To2(enclave.GetUser(findyAdmin)); exists && u.IsRegistered() {
+		glog.V(1).Infoln("admin registered, bootstrap token not in use")
+		return nil
+	}
+	bootstrapToken := adminBootstrapToken
+	if bootstrapToken == "" {
+		bootstrapToken = os.Getenv(envAdminBootstrapToken)
+	}
+	if bootstrapToken == "" {
+		buf := make([]byte, 32)
+		try.To1(rand.Read(buf))
+		bootstrapToken = base64.RawURLEncoding.EncodeToString(buf)
+		glog.Warningf("admin (%s) bootstrap token, shown only once: %s",
+			findyAdmin, bootstrapToken)
+	}
+	hash := sha256.Sum256([]byte(bootstrapToken))
+	adminBootstrap.hash = hash[:]
+	return nil
+}
+
+// verifyAdminBootstrap checks the bootstrap token of the admin registration.
+func verifyAdminBootstrap(bootstrapToken string) error {
+	adminBootstrap.Lock()
+	defer adminBootstrap.Unlock()
+
+	hash := sha256.Sum256([]byte(bootstrapToken))
+	if adminBootstrap.hash == nil || bootstrapToken == "" ||
+		subtle.ConstantTimeCompare(hash[:], adminBootstrap.hash) != 1 {
+		glog.Warningln("admin registration without valid bootstrap token")
+		return fmt.Errorf("%w: admin bootstrap token required", errUnauthorized)
+	}
+	return nil
+}
+
+// consumeAdminBootstrap invalidates the bootstrap token after the admin is
+// registered.
+func consumeAdminBootstrap() {
+	adminBootstrap.Lock()
+	defer adminBootstrap.Unlock()
+
+	if adminBootstrap.hash != nil {
+		glog.Infoln("admin registered, bootstrap token consumed")
+		adminBootstrap.hash = nil
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/acator/authn"
+	"github.com/findy-network/findy-agent-auth/ceremony"
+	"github.com/findy-network/findy-agent-auth/enclave"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestAdminBootstrap(t *testing.T) {
+	defer assert.PushTester(t)()
+	defer func(tok string) { adminBootstrapToken = tok }(adminBootstrapToken)
+	defer func() { _ = enclave.RemoveUser(findyAdmin) }()
+
+	const bootstrapToken = "bootstrap-token-for-test"
+	adminBootstrapToken = bootstrapToken
+	try.To(setupAdminBootstrap())
+
+	server := httptest.NewServer(newMuxWithRoutes())
+	defer server.Close()
+
+	beginRegistration := func(tok string) int {
+		res := try.To1(http.Post(server.URL+urlBeginRegister, "application/json",
+			strings.NewReader(fmt.Sprintf(`{"username":"%s","bootstrapToken":"%s"}`,
+				findyAdmin, tok))))
+		defer res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(beginRegistration(""), http.StatusUnauthorized)
+	assert.Equal(beginRegistration("wrong"), http.StatusUnauthorized)
+	_, exists := try.To2(enclave.GetUser(findyAdmin))
+	assert.ThatNot(exists)
+
+	// the ceremony going on isn't interrupted
+	assert.Equal(beginRegistration(bootstrapToken), http.StatusOK)
+	pending := try.To1(enclave.GetExistingUser(findyAdmin))
+	assert.Equal(beginRegistration(bootstrapToken), http.StatusConflict)
+	assert.Equal(try.To1(enclave.GetExistingUser(findyAdmin)).ID, pending.ID)
+
+	// the abandoned ceremony doesn't lock the admin out, even over the restart,
+	// but it's reclaimed only with the token
+	abandon := func() {
+		u := try.To1(enclave.GetExistingUser(findyAdmin))
+		u.Created = time.Now().Add(-2 * time.Duration(ceremonyTimeoutSecs) * time.Second)
+		try.To(enclave.PutUser(u))
+	}
+	abandon()
+	try.To(setupAdminBootstrap())
+	assert.That(adminBootstrap.hash != nil, "admin not registered")
+	assert.Equal(beginRegistration(""), http.StatusUnauthorized)
+	assert.Equal(try.To1(enclave.GetExistingUser(findyAdmin)).ID, pending.ID)
+	assert.Equal(beginRegistration(bootstrapToken), http.StatusOK)
+	abandon()
+
+	// the legacy API takes the token only from the header
+	oldBeginRegistration := func(header, query string) int {
+		req := try.To1(http.NewRequest("GET", server.URL+
+			"/register/begin/"+findyAdmin+"?bootstrap="+query, nil))
+		req.Header.Set(ceremony.BootstrapHeader, header)
+		res := try.To1(http.DefaultClient.Do(req))
+		defer res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(oldBeginRegistration("", bootstrapToken), http.StatusUnauthorized)
+	assert.Equal(oldBeginRegistration(bootstrapToken, ""), http.StatusOK)
+	abandon()
+
+	cmd := authn.Cmd{
+		SubCmd:   "register",
+		UserName: findyAdmin,
+		URL:      server.URL,
+		AAGUID:   "12c85a48-4baf-47bd-b51f-f192871a1511",
+		Key:      "15308490f1e4026284594dd08d31291bc8ef2aeac730d0daf6ff87bb92d4336c",
+		Origin:   defaultOrigin,
+	}
+	cmd.RegisterBegin.Payload = `{"username":"%s","bootstrapToken":"` + bootstrapToken + `"}`
+	_ = try.To1(cmd.Exec(nil))
+	admin := try.To1(enclave.GetExistingUser(findyAdmin))
+	assert.Equal(admin.DID, findyAdmin)
+	assert.That(adminBootstrap.hash == nil)
+
+	// the token is consumed, and the admin's new authenticator needs the
+	// elevated JWT of the admin
+	assert.Equal(beginRegistration(bootstrapToken), http.StatusBadRequest)
+	try.To(setupAdminBootstrap())
+	assert.That(adminBootstrap.hash == nil, "admin exists")
+}
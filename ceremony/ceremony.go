@@ -0,0 +1,31 @@
+/*
+Package ceremony has the HTTP headers and the wire types of the WebAuthn
+ceremonies, the DPoP proofs and the transaction confirmations, which are
+shared by the server and the clients. The package doesn't depend on the server
+packages, that the clients don't need to import the server's session
+management, the token signing or the enclave.
+*/
+package ceremony
+
+const (
+	// Header carries the ceremony ID from the begin to the finish call. It
+	// allows the client to run several ceremonies in parallel.
+	Header = "X-Ceremony-ID"
+
+	// ModeHeader is sent by the client in the begin call. If its value is
+	// ModeToken the ceremony ID isn't stored to the session cookie, and the
+	// client must send it in the finish call. Native and headless clients
+	// don't need to keep cookies then.
+	ModeHeader = "X-Ceremony-Mode"
+	ModeToken  = "token"
+
+	// OnboardingHeader carries the opaque onboarding ID in the response of
+	// the registration when the cloud agent allocation is pending. The client
+	// polls the onboarding status with it.
+	OnboardingHeader = "X-Onboarding-ID"
+
+	// BootstrapHeader carries the one-time bootstrap token of the admin
+	// registration in the begin call of the legacy API, which doesn't have the
+	// request body. The token isn't sent in the URL, that it isn't logged.
+	BootstrapHeader = "X-Bootstrap-Token"
+)
@@ -0,0 +1,31 @@
+package ceremony
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// DPoPHeader is the header of the DPoP proof (RFC 9449). The DPoP bound access
+// tokens are sent with the DPoP authorization scheme.
+const DPoPHeader = "DPoP"
+
+// DPoPType is the typ header of the DPoP proofs.
+const DPoPType = "dpop+jwt"
+
+// DPoPClaims are the claims of the DPoP proof. The jti and iat claims are
+// required.
+type DPoPClaims struct {
+	Method          string `json:"htm"`
+	URL             string `json:"htu"`
+	AccessTokenHash string `json:"ath,omitempty"`
+
+	jwt.RegisteredClaims
+}
+
+// AccessTokenHash returns the ath claim of the access token.
+func AccessTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,46 @@
+package ceremony
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/go-webauthn/webauthn/protocol"
+)
+
+// ErrTransactionMismatch is returned when the transaction data doesn't match
+// the challenge.
+var ErrTransactionMismatch = errors.New("transaction doesn't match the challenge")
+
+// TransactionBinding tells how the challenge of the transaction confirmation
+// is bound to the transaction data:
+//
+//	challenge = SHA-256(nonce || SHA-256(data))
+type TransactionBinding struct {
+	Hash  protocol.URLEncodedBase64 `json:"hash"`
+	Nonce protocol.URLEncodedBase64 `json:"nonce"`
+}
+
+// TransactionHash returns the SHA-256 hash of the transaction data.
+func TransactionHash(data string) protocol.URLEncodedBase64 {
+	h := sha256.Sum256([]byte(data))
+	return h[:]
+}
+
+// Challenge returns the WebAuthn challenge of the binding.
+func (b TransactionBinding) Challenge() protocol.URLEncodedBase64 {
+	h := sha256.New()
+	h.Write(b.Nonce)
+	h.Write(b.Hash)
+	return h.Sum(nil)
+}
+
+// Verify checks that the binding is for the data and the challenge. The
+// clients use it before they sign the challenge.
+func (b TransactionBinding) Verify(data string, challenge []byte) error {
+	if !bytes.Equal(b.Hash, TransactionHash(data)) ||
+		!bytes.Equal(b.Challenge(), challenge) {
+		return ErrTransactionMismatch
+	}
+	return nil
+}
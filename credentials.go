@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/findy-network/findy-agent-auth/enclave"
+	"github.com/findy-network/findy-agent-auth/token"
+	"github.com/findy-network/findy-agent-auth/user"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+type credentialNickname struct {
+	Nickname string `json:"nickname"`
+}
+
+// listCredentials returns the user's credentials (authenticators) with their
+// metadata. Valid JWT of the user is required.
+func listCredentials(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	u, _ := try.To2(authorizedUser(r))
+
+	jsonResponse(w, u.CredentialInfos(), nil)
+	glog.V(1).Infoln("list credentials", u.Name)
+}
+
+// renameCredential sets the nickname of the user's credential. The elevated JWT
+// of the user is required.
+func renameCredential(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	u := try.To1(authorizedElevatedUser(w, r))
+	credID := try.To1(requestCredentialID(r))
+
+	var nick credentialNickname
+	try.To(json.NewDecoder(r.Body).Decode(&nick))
+
+	try.To(markCredentialErr(u.SetCredentialNickname(credID, nick.Nickname)))
+	try.To(enclave.PutUser(u))
+
+	jsonResponse(w, "Credential Renamed", nil)
+	glog.V(1).Infoln("rename credential", u.Name)
+}
+
+// revokeCredential removes the user's credential and revokes the tokens issued
+// to it. The last usable credential cannot be removed. The elevated JWT of the
+// user is required.
+func revokeCredential(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	u := try.To1(authorizedElevatedUser(w, r))
+	credID := try.To1(requestCredentialID(r))
+
+	try.To(markCredentialErr(u.RemoveCredential(credID)))
+	try.To(enclave.PutUser(u))
+	try.To(revokeCredentialTokens(u.Name, credID))
+
+	jsonResponse(w, "Credential Revoked", nil)
+	glog.V(1).Infoln("revoke credential", u.Name)
+}
+
+// deleteAccount removes the user with the credentials and the cloud agent, and
+// revokes the user's tokens. If the cloud agent cannot be offboarded, the
+// account is disabled and left to the admin. The elevated JWT of the user is
+// required.
+func deleteAccount(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	u := try.To1(authorizedElevatedUser(w, r))
+
+	defer err2.Handle(&err, markErrInternal)
+
+	try.To(removeAccount(r.Context(), u, u.DID, false))
+
+	jsonResponse(w, "Account Deleted", nil)
+	glog.V(1).Infoln("delete account", u.Name)
+}
+
+// loginClaims returns the claims of our own login token of the request. The
+// access tokens of the OIDC clients are refused as unauthorized, they aren't
+// logins to us.
+func loginClaims(r *http.Request) (*token.Claims, error) {
+	claims, err := token.FromLoginRequest(r)
+	if errors.Is(err, token.ErrClientToken) {
+		glog.Warningln("OIDC client token used as login token")
+		return nil, markErrUnauthorized(err)
+	}
+	return claims, err
+}
+
+// authorizedUser returns the user of the request path and the claims of the
+// request's token if it's the valid JWT of the user.
+func authorizedUser(r *http.Request) (u *user.User, claims *token.Claims, err error) {
+	defer err2.Handle(&err, markErrBadRequest)
+
+	username, ok := mux.Vars(r)["username"]
+	if !ok || username == "" {
+		return nil, nil, errors.New("must supply a valid username")
+	}
+	u, exists := try.To2(enclave.GetUser(username))
+	claims, err = loginClaims(r)
+	if errors.Is(err, errUnauthorized) {
+		return nil, nil, err
+	}
+	if !exists || err != nil || u.DID == "" || claims.Username != u.DID {
+		glog.Warningln("credentials, invalid JWT", username)
+		return nil, nil, errors.New("invalid token")
+	}
+	return u, claims, requireEnabled(u)
+}
+
+// authorizedElevatedUser returns the user like authorizedUser, but the JWT
+// must be the elevated token of the step-up re-authentication.
+func authorizedElevatedUser(w http.ResponseWriter, r *http.Request) (u *user.User, err error) {
+	defer err2.Handle(&err)
+
+	u, claims := try.To2(authorizedUser(r))
+	return u, requireElevated(w, claims, u)
+}
+
+func requestCredentialID(r *http.Request) (id []byte, err error) {
+	defer err2.Handle(&err, markErrBadRequest)
+
+	return base64.RawURLEncoding.DecodeString(mux.Vars(r)["credID"])
+}
+
+func markCredentialErr(err error) error {
+	if errors.Is(err, user.ErrCredentialNotFound) ||
+		errors.Is(err, user.ErrLastCredential) {
+		return fmt.Errorf("%w: %w", errBadRequest, err)
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/enclave"
+	"github.com/findy-network/findy-agent-auth/token"
+	"github.com/findy-network/findy-agent-auth/user"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestCredentialManagement(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	const name = "cred-mgmt-user"
+	u := user.New(name, name, "")
+	u.DID = "cred-mgmt-did"
+	u.AddCredential(webauthn.Credential{ID: []byte("first")})
+	u.AddCredential(webauthn.Credential{ID: []byte("second")})
+	try.To(enclave.PutUser(u))
+
+	ts := try.To1(token.Build(u.DID, u.DisplayName, nil))
+	elevated, _ := try.To2(token.IssueElevated(u.DID, u.DisplayName,
+		&token.Auth{Time: time.Now()}, time.Minute))
+	first := base64.RawURLEncoding.EncodeToString([]byte("first"))
+	second := base64.RawURLEncoding.EncodeToString([]byte("second"))
+	r := newMuxWithRoutes()
+
+	call := func(method, path, body, token string) (int, []byte) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		return res.StatusCode, try.To1(io.ReadAll(res.Body))
+	}
+
+	code, _ := call("GET", "/credentials/"+name, "", "")
+	assert.Equal(code, http.StatusBadRequest)
+	code, _ = call("GET", "/credentials/"+name, "",
+		try.To1(token.Build("other-did", "other", nil)))
+	assert.Equal(code, http.StatusBadRequest)
+
+	code, _ = call("PUT", "/credentials/"+name+"/"+first,
+		`{"nickname":"my phone"}`, ts)
+	assert.Equal(code, http.StatusUnauthorized)
+	code, _ = call("PUT", "/credentials/"+name+"/"+first,
+		`{"nickname":"my phone"}`, elevated)
+	assert.Equal(code, http.StatusOK)
+
+	code, data := call("GET", "/credentials/"+name, "", ts)
+	assert.Equal(code, http.StatusOK)
+	var infos []user.CredentialInfo
+	try.To(json.Unmarshal(data, &infos))
+	assert.SLen(infos, 2)
+	assert.Equal(infos[0].ID, first)
+	assert.Equal(infos[0].Nickname, "my phone")
+	assert.NotNil(infos[0].Created)
+
+	code, _ = call("DELETE", "/credentials/"+name+"/"+first, "", ts)
+	assert.Equal(code, http.StatusUnauthorized)
+	code, _ = call("DELETE", "/credentials/"+name+"/"+first, "", elevated)
+	assert.Equal(code, http.StatusOK)
+	code, _ = call("DELETE", "/credentials/"+name+"/"+first, "", elevated)
+	assert.Equal(code, http.StatusBadRequest)
+	code, _ = call("DELETE", "/credentials/"+name+"/"+second, "", elevated)
+	assert.Equal(code, http.StatusBadRequest)
+
+	stored := try.To1(enclave.GetExistingUser(name))
+	assert.SLen(stored.Credentials, 1)
+	assert.SLen(stored.CredentialMetas, 1)
+
+	code, _ = call("DELETE", "/users/"+name, "", ts)
+	assert.Equal(code, http.StatusUnauthorized)
+	// the agency cannot offboard, the account is disabled for the admin
+	code, _ = call("DELETE", "/users/"+name, "", elevated)
+	assert.Equal(code, http.StatusConflict)
+	stored = try.To1(enclave.GetExistingUser(name))
+	assert.That(stored.Disabled)
+	assert.Equal(stored.PendingDeletion.Actor, u.DID)
+	code, _ = call("GET", "/credentials/"+name, "", ts)
+	assert.NotEqual(code, http.StatusOK)
+	try.To(enclave.RemoveUser(name))
+}
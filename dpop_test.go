@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/findy-network/findy-agent-auth/acator/authn"
+	"github.com/findy-network/findy-agent-auth/ceremony"
+	"github.com/findy-network/findy-agent-auth/token"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestDPoP(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	server := httptest.NewServer(newMuxWithRoutes())
+	defer server.Close()
+
+	cmd := authn.Cmd{
+		SubCmd:   "register",
+		UserName: "dpop-user",
+		URL:      server.URL,
+		AAGUID:   "12c85a48-4baf-47bd-b51f-f192871a1511",
+		Key:      "15308490f1e4026284594dd08d31291bc8ef2aeac730d0daf6ff87bb92d4336c",
+		Origin:   defaultOrigin,
+	}
+	_ = try.To1(cmd.Exec(nil))
+
+	login := func() (*AccessToken, *token.Claims, string) {
+		cmd.SubCmd = "login"
+		r := try.To1(cmd.Exec(nil))
+		var at AccessToken
+		try.To(json.Unmarshal([]byte(r.Token), &at))
+		return &at, try.To1(token.Parse(at.Token)), r.DPoPKey
+	}
+
+	at, claims, _ := login()
+	assert.That(claims.Confirmation == nil)
+	assert.Empty(at.TokenType)
+
+	cmd.DPoP = true
+	at, claims, key := login()
+	assert.NotEmpty(key)
+	assert.That(claims.Confirmation != nil)
+	assert.Equal(at.TokenType, "DPoP")
+
+	// the same key can be used again
+	cmd.DPoPKey = key
+	_, again, _ := login()
+	assert.Equal(again.Confirmation.JKT, claims.Confirmation.JKT)
+
+	resource := func(proofFor string) error {
+		const url = "http://api.example.com/resource"
+		r := httptest.NewRequest("GET", url, nil)
+		r.Header.Set("Authorization", "DPoP "+at.Token)
+		r.Header.Set(ceremony.DPoPHeader, try.To1(cmd.DPoPProof("GET", proofFor, at.Token)))
+		_, err := token.FromDPoP(r)
+		return err
+	}
+	assert.NoError(resource("http://api.example.com/resource"))
+	assert.Error(resource("http://api.example.com/other"))
+
+	assert.NotEmpty(at.RefreshToken)
+	refresh := func(proof string) int {
+		req := try.To1(http.NewRequest("POST", server.URL+urlRefresh,
+			strings.NewReader(`{"refresh_token":"`+at.RefreshToken+`"}`)))
+		if proof != "" {
+			req.Header.Set(ceremony.DPoPHeader, proof)
+		}
+		res := try.To1(http.DefaultClient.Do(req))
+		defer res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(refresh(""), http.StatusBadRequest)
+	assert.Equal(refresh(try.To1(cmd.DPoPProof("POST",
+		server.URL+urlRefresh, ""))), http.StatusOK)
+
+	// the bound token isn't a bearer token to our endpoints
+	credentialsURL := server.URL + strings.Replace(urlCredentials,
+		"{username}", "dpop-user", 1)
+	list := func(scheme, proof string) int {
+		req := try.To1(http.NewRequest("GET", credentialsURL, nil))
+		req.Header.Set("Authorization", scheme+" "+at.Token)
+		if proof != "" {
+			req.Header.Set(ceremony.DPoPHeader, proof)
+		}
+		res := try.To1(http.DefaultClient.Do(req))
+		defer res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(list("Bearer", ""), http.StatusBadRequest)
+	assert.Equal(list(ceremony.DPoPHeader, ""), http.StatusBadRequest)
+	assert.Equal(list(ceremony.DPoPHeader, try.To1(cmd.DPoPProof("GET",
+		credentialsURL, at.Token))), http.StatusOK)
+
+	// the client sends the proofs with the bound token
+	cmd.SubCmd = "stepup"
+	cmd.Token = at.Token
+	var elevated AccessToken
+	try.To(json.Unmarshal([]byte(try.To1(cmd.Exec(nil)).Token), &elevated))
+	assert.That(try.To1(token.Parse(elevated.Token)).Elevated())
+}
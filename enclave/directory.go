@@ -0,0 +1,184 @@
+package enclave
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"sort"
+	"sync"
+
+	"github.com/findy-network/findy-agent-auth/user"
+	"github.com/findy-network/findy-common-go/crypto/db"
+	"github.com/findy-network/findy-common-go/dto"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// namesKey is the key of the user directory in the meta bucket. The keys of
+// the user bucket are hashes, which cannot be read in the name order. That's
+// why the sorted names are kept in one encrypted value, and the page of the
+// users is read without decrypting all of the users.
+var namesKey = []byte("user-names")
+
+var (
+	namesLock sync.Mutex
+
+	// cursorAEAD encrypts the opaque IDs of the clients, i.e. the cursors of
+	// the user list and the onboarding IDs, that the names aren't shown in
+	// the URLs.
+	cursorAEAD cipher.AEAD
+)
+
+// deriveCursorKey derives the key of the cursors from the master key like
+// deriveIndexKey.
+func deriveCursorKey(masterKey []byte) []byte {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write([]byte("findy-agent-auth enclave cursor"))
+	return mac.Sum(nil)
+}
+
+func initCursor(masterKey []byte) (err error) {
+	defer err2.Handle(&err, "init cursor")
+
+	block := try.To1(aes.NewCipher(deriveCursorKey(masterKey)))
+	cursorAEAD = try.To1(cipher.NewGCM(block))
+	return nil
+}
+
+// UsersCursor returns the opaque cursor of the user list, which continues
+// after the user name.
+func UsersCursor(name string) string {
+	return seal([]byte(name), cursorData)
+}
+
+// UsersCursorName returns the user name of the cursor made by UsersCursor.
+func UsersCursorName(cursor string) (string, bool) {
+	name, ok := unseal(cursor, cursorData)
+	return string(name), ok
+}
+
+// The additional data of the sealed IDs, which keeps the IDs of the different
+// purposes apart.
+var (
+	cursorData     = []byte("cursor")
+	onboardingData = []byte("onboarding")
+)
+
+// seal encrypts the data to the opaque ID of the client.
+func seal(data, additional []byte) string {
+	nonce := make([]byte, cursorAEAD.NonceSize())
+	try.To1(rand.Read(nonce))
+	return base64.RawURLEncoding.EncodeToString(
+		cursorAEAD.Seal(nonce, nonce, data, additional))
+}
+
+// unseal returns the data of the ID made by seal.
+func unseal(id string, additional []byte) ([]byte, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil || len(data) < cursorAEAD.NonceSize() {
+		return nil, false
+	}
+	nonce, sealed := data[:cursorAEAD.NonceSize()], data[cursorAEAD.NonceSize():]
+	plain, err := cursorAEAD.Open(nil, nonce, sealed, additional)
+	if err != nil {
+		return nil, false
+	}
+	return plain, true
+}
+
+// GetUsers returns at most limit users ordered by the name, starting after
+// the user named after. The next is the name to continue from, or empty if
+// there are no more users. Only the users of the page are read.
+func GetUsers(after string, limit int) (users []*user.User, next string, err error) {
+	defer err2.Handle(&err)
+
+	names := try.To1(getNames())
+	i := sort.Search(len(names), func(i int) bool { return names[i] > after })
+	for ; i < len(names); i++ {
+		if limit > 0 && len(users) == limit {
+			next = users[limit-1].Name
+			break
+		}
+		// the name of the interrupted removal is skipped
+		if u, exists := try.To2(GetUser(names[i])); exists {
+			users = append(users, u)
+		}
+	}
+	return users, next, nil
+}
+
+// getNames returns the sorted names of the user directory.
+func getNames() (names []string, err error) {
+	defer err2.Handle(&err, "user names")
+
+	value := &db.Data{Write: decrypt}
+	found := try.To1(db.GetKeyValueFromBucket(buckets[metaByte],
+		&db.Data{Data: namesKey},
+		value,
+	))
+	if found {
+		dto.FromGOB(value.Data, &names)
+	}
+	return names, nil
+}
+
+func putNames(names []string) error {
+	return db.AddKeyValueToBucket(buckets[metaByte],
+		&db.Data{
+			Data: dto.ToGOB(names),
+			Read: encrypt,
+		},
+		&db.Data{Data: namesKey},
+	)
+}
+
+// addName adds the name to the user directory if it isn't there yet.
+func addName(name string) (err error) {
+	defer err2.Handle(&err, "add user name")
+
+	namesLock.Lock()
+	defer namesLock.Unlock()
+
+	names := try.To1(getNames())
+	i := sort.SearchStrings(names, name)
+	if i < len(names) && names[i] == name {
+		return nil
+	}
+	names = append(names, "")
+	copy(names[i+1:], names[i:])
+	names[i] = name
+	return putNames(names)
+}
+
+// removeName removes the name from the user directory.
+func removeName(name string) (err error) {
+	defer err2.Handle(&err, "remove user name")
+
+	namesLock.Lock()
+	defer namesLock.Unlock()
+
+	names := try.To1(getNames())
+	i := sort.SearchStrings(names, name)
+	if i == len(names) || names[i] != name {
+		return nil
+	}
+	return putNames(append(names[:i], names[i+1:]...))
+}
+
+// indexNames builds the user directory of the users.
+func indexNames(users []*user.User) (err error) {
+	defer err2.Handle(&err, "index user names")
+
+	namesLock.Lock()
+	defer namesLock.Unlock()
+
+	names := make([]string, 0, len(users))
+	for _, u := range users {
+		names = append(names, u.Name)
+	}
+	sort.Strings(names)
+	return putNames(names)
+}
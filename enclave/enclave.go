@@ -2,20 +2,25 @@
 Package enclave is a server-side Secure Enclave. It offers a secure and sealed
 storage to store indy wallet keys on the Agency server.
 
-Urgent! This version does not implement internal hash(), encrypt, and decrypt()
-functions. We must implement these three functions before production. We will
-offer implementations of them when the server-side crypto solution and the Key
-Storage is selected. Possible candidates are AWS Nitro, etc. We also bring
-addon/plugin system for cryptos when first implementation is done.
+The values are encrypted with the master key, and the index keys (email, DID,
+etc.) are HMAC-SHA256 hashes keyed with the index key derived from the master
+key. The sealed boxes of the older format, where the index keys are unsalted
+MD5 hashes, are migrated when they are opened. We still need the server-side
+Key Storage for the master key. Possible candidates are AWS Nitro, etc.
 */
 package enclave
 
 import (
-	"crypto/md5"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/findy-network/findy-agent-auth/token"
+	"github.com/findy-network/findy-agent-auth/transaction"
 	"github.com/findy-network/findy-agent-auth/user"
 	"github.com/findy-network/findy-common-go/crypto"
 	"github.com/findy-network/findy-common-go/crypto/db"
@@ -26,14 +31,25 @@ import (
 
 const userByte = 0
 const userSessionByte = 1
+const userIDByte = 2
+const refreshTokenByte = 3
+const revokedByte = 4
+const userDIDByte = 5
+const onboardingByte = 6
+const deletionByte = 7
+const metaByte = 8
+const ceremonyByte = 9
+const transactionByte = 10
+const issuedByte = 11
 
 var (
-	buckets           = [][]byte{{01, 01}, {01, 02}}
+	buckets           = [][]byte{{01, 01}, {01, 02}, {01, 03}, {01, 04}, {01, 05}, {01, 06}, {01, 07}, {01, 8}, {01, 9}, {01, 10}, {01, 11}, {01, 12}}
 	sealedBoxFilename string
 
 	// Key must be set from production environment, SHA-256, 32 bytes
 	hexKey    = "15308490f1e4026284594dd08d31291bc8ef2aeac730d0daf6ff87bb92d4336c"
 	theCipher *crypto.Cipher
+	indexKey  []byte
 )
 
 // InitSealedBox initialize enclave's sealed box. This must be called once
@@ -42,18 +58,31 @@ func InitSealedBox(filename, backupName, key string) (err error) {
 	if key == "" {
 		key = hexKey
 	}
+	defer err2.Handle(&err, "init enclave")
+
 	k, _ := hex.DecodeString(key)
 	theCipher = crypto.NewCipher(k)
+	indexKey = deriveIndexKey(k)
+	try.To(initCursor(k))
 	glog.V(1).Infoln("init enclave", filename)
 	sealedBoxFilename = filename
 	if backupName == "" {
 		backupName = "backup-" + sealedBoxFilename
 	}
-	return db.Init(db.Cfg{
+	try.To(db.Init(db.Cfg{
 		Filename:   sealedBoxFilename,
 		BackupName: backupName,
 		Buckets:    buckets,
-	})
+	}))
+	return migrate()
+}
+
+// deriveIndexKey derives the key of the index hashes from the master key, i.e.
+// the same key isn't used for the encryption and the hashing.
+func deriveIndexKey(masterKey []byte) []byte {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write([]byte("findy-agent-auth enclave index"))
+	return mac.Sum(nil)
 }
 
 // WipeSealedBox closes and destroys the enclave permanently. This version only
@@ -70,10 +99,18 @@ func BackupTicker(interval time.Duration) (done chan<- struct{}) {
 	return db.BackupTicker(interval)
 }
 
-// PutUser saves the user to database.
+// PutUser saves the user to database. It also maintains the indexes from the
+// user's WebAuthn ID (user handle) and DID to the user, and the user directory.
 func PutUser(u *user.User) (err error) {
 	defer err2.Handle(&err)
 
+	// the directory is updated first, it skips the names without the user
+	if !try.To1(db.GetKeyValueFromBucket(buckets[userByte],
+		&db.Data{Data: u.Key(), Read: hash},
+		&db.Data{Write: plain},
+	)) {
+		try.To(addName(u.Name))
+	}
 	try.To(db.AddKeyValueToBucket(buckets[userByte],
 		&db.Data{
 			Data: u.Data(),
@@ -84,10 +121,48 @@ func PutUser(u *user.User) (err error) {
 			Read: hash,
 		},
 	))
+	try.To(db.AddKeyValueToBucket(buckets[userIDByte],
+		&db.Data{
+			Data: u.Key(),
+			Read: encrypt,
+		},
+		&db.Data{
+			Data: u.WebAuthnID(),
+			Read: hash,
+		},
+	))
+	if u.DID != "" {
+		try.To(putDIDIndex(u))
+	}
+	if u.IsOnboardingPending() {
+		try.To(db.AddKeyValueToBucket(buckets[onboardingByte],
+			&db.Data{
+				Data: u.Key(),
+				Read: encrypt,
+			},
+			&db.Data{
+				Data: u.Key(),
+				Read: hash,
+			},
+		))
+	}
 
 	return nil
 }
 
+func putDIDIndex(u *user.User) error {
+	return db.AddKeyValueToBucket(buckets[userDIDByte],
+		&db.Data{
+			Data: u.Key(),
+			Read: encrypt,
+		},
+		&db.Data{
+			Data: []byte(u.DID),
+			Read: hash,
+		},
+	)
+}
+
 // GetUser returns user by name if exists in enclave
 func GetUser(name string) (u *user.User, exist bool, err error) {
 	defer err2.Handle(&err)
@@ -122,16 +197,177 @@ func GetExistingUser(name string) (u *user.User, err error) {
 	return u, err
 }
 
+// GetUserByWebAuthnID returns user by its WebAuthn ID aka user handle if
+// exists in enclave. The stale index entry, e.g. of the user created again
+// with the same name, doesn't find the user.
+func GetUserByWebAuthnID(id []byte) (u *user.User, exist bool, err error) {
+	defer err2.Handle(&err)
+
+	value := &db.Data{
+		Write: decrypt,
+	}
+	already := try.To1(db.GetKeyValueFromBucket(buckets[userIDByte],
+		&db.Data{
+			Data: id,
+			Read: hash,
+		},
+		value,
+	))
+	if !already {
+		return nil, false, nil
+	}
+	u, exist = try.To2(GetUser(string(value.Data)))
+	if !exist || !bytes.Equal(u.WebAuthnID(), id) {
+		return nil, false, nil
+	}
+	return u, true, nil
+}
+
+// GetExistingUserByWebAuthnID returns user by its WebAuthn ID aka user handle
+// if exists in enclave
+func GetExistingUserByWebAuthnID(id []byte) (u *user.User, err error) {
+	defer err2.Handle(&err)
+
+	u, already := try.To2(GetUserByWebAuthnID(id))
+
+	if !already {
+		return nil, fmt.Errorf("user (%v) not exist", id)
+	}
+
+	return u, err
+}
+
+// GetUserByDID returns user by its DID if exists in enclave. PutUser and the
+// migration maintain the DID index, i.e. all the users are found from it.
+func GetUserByDID(did string) (u *user.User, exist bool, err error) {
+	defer err2.Handle(&err)
+
+	if did == "" {
+		return nil, false, nil
+	}
+	value := &db.Data{
+		Write: decrypt,
+	}
+	already := try.To1(db.GetKeyValueFromBucket(buckets[userDIDByte],
+		&db.Data{
+			Data: []byte(did),
+			Read: hash,
+		},
+		value,
+	))
+	if !already {
+		return nil, false, nil
+	}
+	u, exist = try.To2(GetUser(string(value.Data)))
+	if !exist || u.DID != did {
+		return nil, false, nil
+	}
+	return u, true, nil
+}
+
 func RemoveUser(name string) (err error) {
 	defer err2.Handle(&err)
 
-	_ = try.To1(GetExistingUser(name))
-	return db.RmKeyValueFromBucket(buckets[userByte], &db.Data{
+	u := try.To1(GetExistingUser(name))
+	if u.DID != "" {
+		try.To(db.RmKeyValueFromBucket(buckets[userDIDByte], &db.Data{
+			Data: []byte(u.DID),
+			Read: hash,
+		}))
+	}
+	try.To(db.RmKeyValueFromBucket(buckets[userIDByte], &db.Data{
+		Data: u.WebAuthnID(),
+		Read: hash,
+	}))
+	try.To(RemovePendingOnboarding(name))
+	try.To(db.RmKeyValueFromBucket(buckets[userByte], &db.Data{
+		Data: []byte(name),
+		Read: hash,
+	}))
+	return removeName(name)
+}
+
+// GetPendingOnboardings returns the names of the users whose cloud agent
+// allocation is retried. PutUser adds the users to the list.
+func GetPendingOnboardings() (names []string, err error) {
+	defer err2.Handle(&err)
+
+	values := try.To1(db.GetAllValuesFromBucket(buckets[onboardingByte], decrypt))
+	names = make([]string, 0, len(values))
+	for _, v := range values {
+		names = append(names, string(v))
+	}
+	return names, nil
+}
+
+// RemovePendingOnboarding removes the user from the pending onboardings.
+func RemovePendingOnboarding(name string) (err error) {
+	defer err2.Handle(&err)
+
+	return db.RmKeyValueFromBucket(buckets[onboardingByte], &db.Data{
 		Data: []byte(name),
 		Read: hash,
 	})
 }
 
+// OnboardingID returns the opaque ID of the user's onboarding status, which is
+// given to the client in the registration. It's the user name and the random
+// ID of the onboarding record sealed together, i.e. the status cannot be asked
+// without the ID, and the ID isn't valid for the re-created user of the same
+// name.
+func OnboardingID(u *user.User) string {
+	if u.Onboarding == nil {
+		return ""
+	}
+	return seal([]byte(u.Name+"\x00"+u.Onboarding.ID), onboardingData)
+}
+
+// GetOnboardingUser returns the user of the onboarding ID made by
+// OnboardingID.
+func GetOnboardingUser(id string) (u *user.User, exists bool, err error) {
+	defer err2.Handle(&err)
+
+	data, ok := unseal(id, onboardingData)
+	if !ok {
+		return nil, false, nil
+	}
+	name, onboardingID, _ := strings.Cut(string(data), "\x00")
+	u, exists = try.To2(GetUser(name))
+	if !exists || u.Onboarding == nil || onboardingID == "" ||
+		!hmac.Equal([]byte(u.Onboarding.ID), []byte(onboardingID)) {
+		return nil, false, nil
+	}
+	return u, true, nil
+}
+
+// PutDeletion saves the record of the deleted account.
+func PutDeletion(d *user.Deletion) (err error) {
+	defer err2.Handle(&err)
+
+	return db.AddKeyValueToBucket(buckets[deletionByte],
+		&db.Data{
+			Data: d.Data(),
+			Read: encrypt,
+		},
+		&db.Data{
+			Data: d.Key(),
+			Read: hash,
+		},
+	)
+}
+
+// GetDeletions returns the records of the deleted accounts.
+func GetDeletions() (list []*user.Deletion, err error) {
+	defer err2.Handle(&err)
+
+	values := try.To1(db.GetAllValuesFromBucket(buckets[deletionByte], decrypt))
+	list = make([]*user.Deletion, 0, len(values))
+	for _, v := range values {
+		list = append(list, user.NewDeletionFromData(v))
+	}
+	return list, nil
+}
+
 // PutSessionUser saves the user to database.
 func PutSessionUser(userID []byte, u *user.User) (err error) {
 	defer err2.Handle(&err)
@@ -194,14 +430,249 @@ func RemoveSessionUser(userID []byte) (err error) {
 	})
 }
 
+// PutCeremony saves the encoded ceremony of the session package by its key.
+func PutCeremony(key string, data []byte) (err error) {
+	defer err2.Handle(&err)
+
+	return db.AddKeyValueToBucket(buckets[ceremonyByte],
+		&db.Data{
+			Data: data,
+			Read: encrypt,
+		},
+		&db.Data{
+			Data: []byte(key),
+			Read: hash,
+		},
+	)
+}
+
+// GetCeremony returns the encoded ceremony by its key if exists in enclave.
+func GetCeremony(key string) (data []byte, exist bool, err error) {
+	defer err2.Handle(&err)
+
+	value := &db.Data{
+		Write: decrypt,
+	}
+	already := try.To1(db.GetKeyValueFromBucket(buckets[ceremonyByte],
+		&db.Data{
+			Data: []byte(key),
+			Read: hash,
+		},
+		value,
+	))
+	return value.Data, already, nil
+}
+
+// GetCeremonies returns all the encoded ceremonies.
+func GetCeremonies() (list [][]byte, err error) {
+	defer err2.Handle(&err)
+
+	return db.GetAllValuesFromBucket(buckets[ceremonyByte], decrypt)
+}
+
+func RemoveCeremony(key string) (err error) {
+	defer err2.Handle(&err)
+
+	return db.RmKeyValueFromBucket(buckets[ceremonyByte], &db.Data{
+		Data: []byte(key),
+		Read: hash,
+	})
+}
+
+// PutTransaction saves the record of the confirmed transaction.
+func PutTransaction(r *transaction.Record) (err error) {
+	defer err2.Handle(&err)
+
+	return db.AddKeyValueToBucket(buckets[transactionByte],
+		&db.Data{
+			Data: r.Data(),
+			Read: encrypt,
+		},
+		&db.Data{
+			Data: r.Key(),
+			Read: hash,
+		},
+	)
+}
+
+// GetTransaction returns the record of the confirmed transaction by its
+// receipt ID if exists in enclave.
+func GetTransaction(id string) (r *transaction.Record, exist bool, err error) {
+	defer err2.Handle(&err)
+
+	value := &db.Data{
+		Write: decrypt,
+	}
+	already := try.To1(db.GetKeyValueFromBucket(buckets[transactionByte],
+		&db.Data{
+			Data: []byte(id),
+			Read: hash,
+		},
+		value,
+	))
+	if !already {
+		return nil, already, nil
+	}
+	return transaction.NewRecordFromData(value.Data), already, nil
+}
+
+// PutRefreshToken saves the refresh token to database.
+func PutRefreshToken(rt *token.RefreshToken) (err error) {
+	defer err2.Handle(&err)
+
+	return db.AddKeyValueToBucket(buckets[refreshTokenByte],
+		&db.Data{
+			Data: rt.Data(),
+			Read: encrypt,
+		},
+		&db.Data{
+			Data: []byte(rt.ID),
+			Read: hash,
+		},
+	)
+}
+
+// GetRefreshToken returns the refresh token by its ID if exists in enclave.
+func GetRefreshToken(id string) (rt *token.RefreshToken, exist bool, err error) {
+	defer err2.Handle(&err)
+
+	value := &db.Data{
+		Write: decrypt,
+	}
+	already := try.To1(db.GetKeyValueFromBucket(buckets[refreshTokenByte],
+		&db.Data{
+			Data: []byte(id),
+			Read: hash,
+		},
+		value,
+	))
+	if !already {
+		return nil, already, err
+	}
+
+	return token.NewRefreshTokenFromData(value.Data), already, err
+}
+
+// GetRefreshTokens returns all the refresh tokens.
+func GetRefreshTokens() (rts []*token.RefreshToken, err error) {
+	defer err2.Handle(&err)
+
+	values := try.To1(db.GetAllValuesFromBucket(buckets[refreshTokenByte], decrypt))
+	rts = make([]*token.RefreshToken, 0, len(values))
+	for _, v := range values {
+		rts = append(rts, token.NewRefreshTokenFromData(v))
+	}
+	return rts, nil
+}
+
+func RemoveRefreshToken(id string) (err error) {
+	defer err2.Handle(&err)
+
+	return db.RmKeyValueFromBucket(buckets[refreshTokenByte], &db.Data{
+		Data: []byte(id),
+		Read: hash,
+	})
+}
+
+// PutIssued saves the record of the issued access token.
+func PutIssued(i *token.Issued) (err error) {
+	defer err2.Handle(&err)
+
+	return db.AddKeyValueToBucket(buckets[issuedByte],
+		&db.Data{
+			Data: i.Data(),
+			Read: encrypt,
+		},
+		&db.Data{
+			Data: []byte(i.JTI),
+			Read: hash,
+		},
+	)
+}
+
+// GetIssued returns the records of the issued access tokens.
+func GetIssued() (list []*token.Issued, err error) {
+	defer err2.Handle(&err)
+
+	values := try.To1(db.GetAllValuesFromBucket(buckets[issuedByte], decrypt))
+	list = make([]*token.Issued, 0, len(values))
+	for _, v := range values {
+		list = append(list, token.NewIssuedFromData(v))
+	}
+	return list, nil
+}
+
+func RemoveIssued(jti string) (err error) {
+	defer err2.Handle(&err)
+
+	return db.RmKeyValueFromBucket(buckets[issuedByte], &db.Data{
+		Data: []byte(jti),
+		Read: hash,
+	})
+}
+
+// PutRevoked adds the token to the revocation list.
+func PutRevoked(r token.Revoked) (err error) {
+	defer err2.Handle(&err)
+
+	return db.AddKeyValueToBucket(buckets[revokedByte],
+		&db.Data{
+			Data: r.Data(),
+			Read: encrypt,
+		},
+		&db.Data{
+			Data: []byte(r.JTI),
+			Read: hash,
+		},
+	)
+}
+
+// IsRevoked tells if the token ID (jti) is in the revocation list.
+func IsRevoked(jti string) (revoked bool, err error) {
+	defer err2.Handle(&err)
+
+	return db.GetKeyValueFromBucket(buckets[revokedByte],
+		&db.Data{
+			Data: []byte(jti),
+			Read: hash,
+		},
+		&db.Data{
+			Write: decrypt,
+		},
+	)
+}
+
+// GetRevoked returns the revocation list.
+func GetRevoked() (list []token.Revoked, err error) {
+	defer err2.Handle(&err)
+
+	values := try.To1(db.GetAllValuesFromBucket(buckets[revokedByte], decrypt))
+	list = make([]token.Revoked, 0, len(values))
+	for _, v := range values {
+		list = append(list, *token.NewRevokedFromData(v))
+	}
+	return list, nil
+}
+
+func RemoveRevoked(jti string) (err error) {
+	defer err2.Handle(&err)
+
+	return db.RmKeyValueFromBucket(buckets[revokedByte], &db.Data{
+		Data: []byte(jti),
+		Read: hash,
+	})
+}
+
 // all of the following has same signature. They also panic on error
 
-// hash makes the cryptographic hash of the map key value. This prevents us to
-// store key value index (email, DID) to the DB aka sealed box as plain text.
-// Please use salt when implementing this.
+// hash makes the keyed cryptographic hash (HMAC-SHA256) of the map key value.
+// This prevents us to store key value index (email, DID) to the DB aka sealed
+// box as plain text, and without the key the index cannot be used to confirm
+// if the email is registered.
 func hash(key []byte) (k []byte) {
-	h := md5.Sum(key)
-	return h[:]
+	mac := hmac.New(sha256.New, indexKey)
+	mac.Write(key)
+	return mac.Sum(nil)
 }
 
 // encrypt encrypts the actual wallet key value. This is used when data is
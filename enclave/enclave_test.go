@@ -1,11 +1,18 @@
 package enclave
 
 import (
+	"encoding/base64"
+	"errors"
 	"flag"
 	"os"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/findy-network/findy-agent-auth/transaction"
 	"github.com/findy-network/findy-agent-auth/user"
+	"github.com/findy-network/findy-common-go/crypto/db"
 	"github.com/lainio/err2/assert"
 	"github.com/lainio/err2/try"
 )
@@ -82,3 +89,192 @@ func TestRemoveUser(t *testing.T) {
 	err = RemoveUser(emailNotCreated)
 	assert.Error(err)
 }
+
+func TestGetUserByWebAuthnID(t *testing.T) {
+	assert.PushTester(t)
+	defer assert.PopTester()
+
+	const userByID = "byid@example.com"
+
+	u := user.New(userByID, userByID, "")
+	try.To(PutUser(u))
+
+	found := try.To1(GetExistingUserByWebAuthnID(u.WebAuthnID()))
+	assert.Equal(found.Name, userByID)
+
+	// the index of the replaced user is stale
+	replaced := user.New(userByID, userByID, "")
+	try.To(PutUser(replaced))
+	_, exists := try.To2(GetUserByWebAuthnID(u.WebAuthnID()))
+	assert.ThatNot(exists)
+	found = try.To1(GetExistingUserByWebAuthnID(replaced.WebAuthnID()))
+	assert.Equal(found.ID, replaced.ID)
+
+	try.To(RemoveUser(userByID))
+	_, exists = try.To2(GetUserByWebAuthnID(replaced.WebAuthnID()))
+	assert.ThatNot(exists)
+}
+
+func TestGetUserByDID(t *testing.T) {
+	assert.PushTester(t)
+	defer assert.PopTester()
+
+	const userByDID = "bydid@example.com"
+	const did = "did:example:bydid"
+
+	u := user.New(userByDID, userByDID, "")
+	try.To(PutUser(u))
+	_, exists := try.To2(GetUserByDID(did))
+	assert.ThatNot(exists)
+
+	u.DID = did
+	try.To(PutUser(u))
+	found, exists := try.To2(GetUserByDID(did))
+	assert.That(exists)
+	assert.Equal(found.Name, userByDID)
+
+	// the users aren't scanned without the index
+	try.To(db.RmKeyValueFromBucket(buckets[userDIDByte], &db.Data{
+		Data: []byte(did),
+		Read: hash,
+	}))
+	_, exists = try.To2(GetUserByDID(did))
+	assert.ThatNot(exists)
+	try.To(PutUser(u))
+
+	try.To(RemoveUser(userByDID))
+	_, exists = try.To2(GetUserByDID(did))
+	assert.ThatNot(exists)
+}
+
+func TestDeletions(t *testing.T) {
+	assert.PushTester(t)
+	defer assert.PopTester()
+
+	d := &user.Deletion{
+		ID:       "deletion-id",
+		DID:      "deleted-did",
+		Deleted:  time.Now(),
+		Offboard: user.OffboardRetained,
+	}
+	try.To(PutDeletion(d))
+
+	list := try.To1(GetDeletions())
+	assert.SLen(list, 1)
+	assert.Equal(list[0].DID, d.DID)
+	assert.Equal(list[0].Offboard, user.OffboardRetained)
+}
+
+func TestCeremonies(t *testing.T) {
+	assert.PushTester(t)
+	defer assert.PopTester()
+
+	try.To(PutCeremony("registration/id", []byte("ceremony")))
+	data, found := try.To2(GetCeremony("registration/id"))
+	assert.That(found)
+	assert.Equal(string(data), "ceremony")
+	assert.SLen(try.To1(GetCeremonies()), 1)
+
+	try.To(RemoveCeremony("registration/id"))
+	_, found = try.To2(GetCeremony("registration/id"))
+	assert.ThatNot(found)
+}
+
+func TestOnboardingID(t *testing.T) {
+	assert.PushTester(t)
+	defer assert.PopTester()
+
+	const name = "onboarding.user@example.com"
+	u := user.New(name, name, "")
+	assert.Empty(OnboardingID(u))
+	u.OnboardingFailed(errors.New("down"), time.Now(), time.Second)
+	try.To(PutUser(u))
+	defer func() { try.To(RemoveUser(name)) }()
+
+	id := OnboardingID(u)
+	assert.NotEqual(id, OnboardingID(u))
+	assert.ThatNot(strings.Contains(id, base64.RawURLEncoding.EncodeToString([]byte(name))))
+	got, exists := try.To2(GetOnboardingUser(id))
+	assert.That(exists)
+	assert.Equal(got.Name, name)
+
+	// the cursor of the name isn't the onboarding ID
+	_, exists = try.To2(GetOnboardingUser(UsersCursor(name)))
+	assert.ThatNot(exists)
+	_, exists = try.To2(GetOnboardingUser(name))
+	assert.ThatNot(exists)
+	_, exists = try.To2(GetOnboardingUser(""))
+	assert.ThatNot(exists)
+
+	// the ID isn't valid for the re-created user of the same name
+	try.To(RemoveUser(name))
+	recreated := user.New(name, name, "")
+	recreated.OnboardingFailed(errors.New("down"), time.Now(), time.Second)
+	try.To(PutUser(recreated))
+	_, exists = try.To2(GetOnboardingUser(id))
+	assert.ThatNot(exists)
+}
+
+func TestTransactions(t *testing.T) {
+	assert.PushTester(t)
+	defer assert.PopTester()
+
+	try.To(PutTransaction(&transaction.Record{ID: "receipt-id", Payload: "data"}))
+	r, found := try.To2(GetTransaction("receipt-id"))
+	assert.That(found)
+	assert.Equal(r.Payload, "data")
+	_, found = try.To2(GetTransaction("other-id"))
+	assert.ThatNot(found)
+}
+
+func TestGetUsers(t *testing.T) {
+	assert.PushTester(t)
+	defer assert.PopTester()
+
+	names := []string{"page-c@example.com", "page-a@example.com", "page-b@example.com"}
+	for _, name := range names {
+		try.To(PutUser(user.New(name, name, "")))
+		defer func(name string) { try.To(RemoveUser(name)) }(name)
+	}
+
+	var all []string
+	next := "page-"
+	for {
+		users, cursor := try.To2(GetUsers(next, 2))
+		for _, u := range users {
+			if strings.HasPrefix(u.Name, "page-") {
+				all = append(all, u.Name)
+			}
+		}
+		if cursor == "" {
+			break
+		}
+		next = cursor
+	}
+	assert.DeepEqual(all, []string{"page-a@example.com", "page-b@example.com",
+		"page-c@example.com"})
+
+	try.To(RemoveUser("page-b@example.com"))
+	try.To(PutUser(user.New("page-b@example.com", "page-b", "")))
+	assert.That(sort.StringsAreSorted(try.To1(getNames())))
+	users, _ := try.To2(GetUsers("page-a@example.com", 1))
+	assert.SLen(users, 1)
+	assert.Equal(users[0].Name, "page-b@example.com")
+}
+
+func TestUsersCursor(t *testing.T) {
+	assert.PushTester(t)
+	defer assert.PopTester()
+
+	cursor := UsersCursor("cursor@example.com")
+	assert.ThatNot(strings.Contains(cursor, "cursor"))
+	assert.NotEqual(cursor, UsersCursor("cursor@example.com"))
+	name, ok := UsersCursorName(cursor)
+	assert.That(ok)
+	assert.Equal(name, "cursor@example.com")
+
+	for _, c := range []string{"", "cursor@example.com", cursor[:len(cursor)-2] + "AA", "!!"} {
+		_, ok = UsersCursorName(c)
+		assert.ThatNot(ok, c)
+	}
+}
@@ -0,0 +1,176 @@
+package enclave
+
+import (
+	"crypto/md5"
+	"fmt"
+	"strconv"
+
+	"github.com/findy-network/findy-agent-auth/session"
+	"github.com/findy-network/findy-agent-auth/token"
+	"github.com/findy-network/findy-agent-auth/transaction"
+	"github.com/findy-network/findy-agent-auth/user"
+	"github.com/findy-network/findy-common-go/crypto/db"
+	"github.com/golang/glog"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// The format versions of the sealed box.
+const (
+	// FormatMD5 is the original format, which doesn't have the version
+	// marker. The index keys are unsalted MD5 hashes.
+	FormatMD5 = 1
+
+	// FormatHMAC has the HMAC-SHA256 index keys.
+	FormatHMAC = 2
+
+	// FormatNames has the user directory, i.e. the sorted user names.
+	FormatNames = 3
+
+	// FormatVersion is the current format.
+	FormatVersion = FormatNames
+)
+
+// formatKey is the key of the format version marker in the meta bucket. The
+// marker isn't secret, and it's stored as plain text to tell the formats
+// apart without the keys.
+var formatKey = []byte("format-version")
+
+// GetFormatVersion returns the format version of the sealed box.
+func GetFormatVersion() (version int, err error) {
+	defer err2.Handle(&err, "format version")
+
+	value := &db.Data{Write: plain}
+	found := try.To1(db.GetKeyValueFromBucket(buckets[metaByte],
+		&db.Data{Data: formatKey},
+		value,
+	))
+	if !found {
+		return FormatMD5, nil
+	}
+	return strconv.Atoi(string(value.Data))
+}
+
+func setFormatVersion(version int) error {
+	return db.AddKeyValueToBucket(buckets[metaByte],
+		&db.Data{Data: []byte(strconv.Itoa(version))},
+		&db.Data{Data: formatKey},
+	)
+}
+
+// migrate re-keys the sealed box of the old format with the current index
+// hashes, and builds the user directory. The new entry is added before the old
+// one is removed, which is why the interrupted migration is run again safely
+// at the next start. The version marker is written last.
+func migrate() (err error) {
+	defer err2.Handle(&err, "migrate")
+
+	version := try.To1(GetFormatVersion())
+	switch {
+	case version == FormatVersion:
+		return nil
+	case version > FormatVersion:
+		return fmt.Errorf("unsupported format version: %d", version)
+	}
+	glog.Infof("migrating enclave from format %d to %d", version, FormatVersion)
+
+	if version < FormatHMAC {
+		try.To(rekeyAll())
+	}
+	values := try.To1(db.GetAllValuesFromBucket(buckets[userByte], decrypt))
+	users := make([]*user.User, 0, len(values))
+	for _, v := range values {
+		users = append(users, user.NewFromData(v))
+	}
+	try.To(indexNames(users))
+
+	try.To(setFormatVersion(FormatVersion))
+	glog.Infof("enclave migrated, %d users", len(users))
+	return nil
+}
+
+// rekeyAll re-keys all of the buckets of FormatMD5. The meta bucket has the
+// plain keys.
+func rekeyAll() (err error) {
+	defer err2.Handle(&err)
+
+	users := try.To1(rekey(userByte, func(v []byte) []byte {
+		return user.NewFromData(v).Key()
+	}))
+	for _, v := range users {
+		u := user.NewFromData(v)
+		try.To(rekeyIndex(userIDByte, u.WebAuthnID(), u.Key()))
+		if u.DID != "" {
+			try.To(rekeyIndex(userDIDByte, []byte(u.DID), u.Key()))
+		}
+	}
+	_ = try.To1(rekey(userSessionByte, func(v []byte) []byte {
+		return user.NewFromData(v).WebAuthnID()
+	}))
+	_ = try.To1(rekey(refreshTokenByte, func(v []byte) []byte {
+		return []byte(token.NewRefreshTokenFromData(v).ID)
+	}))
+	_ = try.To1(rekey(revokedByte, func(v []byte) []byte {
+		return []byte(token.NewRevokedFromData(v).JTI)
+	}))
+	_ = try.To1(rekey(onboardingByte, func(v []byte) []byte {
+		return v // the value is the user name
+	}))
+	_ = try.To1(rekey(deletionByte, func(v []byte) []byte {
+		return user.NewDeletionFromData(v).Key()
+	}))
+	_ = try.To1(rekey(ceremonyByte, func(v []byte) []byte {
+		return []byte(try.To1(session.CeremonyKey(v)))
+	}))
+	_ = try.To1(rekey(transactionByte, func(v []byte) []byte {
+		return transaction.NewRecordFromData(v).Key()
+	}))
+	_ = try.To1(rekey(issuedByte, func(v []byte) []byte {
+		return []byte(token.NewIssuedFromData(v).JTI)
+	}))
+	return nil
+}
+
+// rekey re-keys the entries of the bucket. The keyOf returns the original key
+// of the decrypted value. It returns the decrypted values.
+func rekey(bucket int, keyOf func(value []byte) []byte) (values [][]byte, err error) {
+	defer err2.Handle(&err, "bucket %d", bucket)
+
+	values = try.To1(db.GetAllValuesFromBucket(buckets[bucket], decrypt))
+	for _, v := range values {
+		try.To(rekeyIndex(bucket, keyOf(v), v))
+	}
+	return values, nil
+}
+
+// rekeyIndex stores the value with the current hash of the key, and removes
+// the entry of the old hash.
+func rekeyIndex(bucket int, key, value []byte) (err error) {
+	defer err2.Handle(&err)
+
+	try.To(db.AddKeyValueToBucket(buckets[bucket],
+		&db.Data{
+			Data: value,
+			Read: encrypt,
+		},
+		&db.Data{
+			Data: key,
+			Read: hash,
+		},
+	))
+	return db.RmKeyValueFromBucket(buckets[bucket], &db.Data{
+		Data: key,
+		Read: md5Hash,
+	})
+}
+
+// plain copies the value as is.
+func plain(value []byte) (k []byte) {
+	return append(value[:0:0], value...)
+}
+
+// md5Hash is the index hash of FormatMD5.
+func md5Hash(key []byte) (k []byte) {
+	h := md5.Sum(key)
+	return h[:]
+}
@@ -0,0 +1,145 @@
+package enclave
+
+import (
+	"testing"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/session"
+	"github.com/findy-network/findy-agent-auth/token"
+	"github.com/findy-network/findy-agent-auth/transaction"
+	"github.com/findy-network/findy-agent-auth/user"
+	"github.com/findy-network/findy-common-go/crypto/db"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func putLegacy(bucket int, key, value []byte) {
+	try.To(db.AddKeyValueToBucket(buckets[bucket],
+		&db.Data{Data: value, Read: encrypt},
+		&db.Data{Data: key, Read: md5Hash},
+	))
+}
+
+func isIndexed(bucket int, key []byte, keyHash func([]byte) []byte) bool {
+	return try.To1(db.GetKeyValueFromBucket(buckets[bucket],
+		&db.Data{Data: key, Read: keyHash},
+		&db.Data{Write: decrypt},
+	))
+}
+
+// legacyCeremonies stores the ceremonies of the session package like FormatMD5.
+type legacyCeremonies struct{}
+
+func (legacyCeremonies) PutCeremony(key string, data []byte) error {
+	putLegacy(ceremonyByte, []byte(key), data)
+	return nil
+}
+
+func (legacyCeremonies) GetCeremony(string) ([]byte, bool, error) { return nil, false, nil }
+func (legacyCeremonies) RemoveCeremony(string) error              { return nil }
+func (legacyCeremonies) GetCeremonies() ([][]byte, error)         { return nil, nil }
+
+func TestMigrate(t *testing.T) {
+	assert.PushTester(t)
+	defer assert.PopTester()
+
+	assert.Equal(try.To1(GetFormatVersion()), FormatVersion)
+	assert.NotDeepEqual(hash([]byte(emailAddress)), md5Hash([]byte(emailAddress)))
+
+	const name = "legacy@example.com"
+	u := user.New(name, name, "")
+	u.DID = "legacy-did"
+	rt := &token.RefreshToken{ID: "legacy-refresh", Username: name,
+		Expires: time.Now().Add(time.Hour)}
+	revoked := token.Revoked{JTI: "legacy-jti", Expires: time.Now().Add(time.Hour).Unix()}
+
+	putLegacy(userByte, u.Key(), u.Data())
+	putLegacy(userIDByte, u.WebAuthnID(), u.Key())
+	putLegacy(userDIDByte, []byte(u.DID), u.Key())
+	putLegacy(userSessionByte, u.WebAuthnID(), u.Data())
+	putLegacy(refreshTokenByte, []byte(rt.ID), rt.Data())
+	putLegacy(revokedByte, []byte(revoked.JTI), revoked.Data())
+	putLegacy(onboardingByte, u.Key(), u.Key())
+	deletion := &user.Deletion{ID: "legacy-deletion", DID: "legacy-deleted-did"}
+	putLegacy(deletionByte, deletion.Key(), deletion.Data())
+	ceremonyID := try.To1(session.NewCeremonyStore(time.Minute, legacyCeremonies{}).
+		Put("registration", &webauthn.SessionData{Challenge: "legacy"}, nil))
+	ceremonyKey := []byte("registration/" + ceremonyID)
+	rec := &transaction.Record{ID: "legacy-receipt", DID: u.DID}
+	putLegacy(transactionByte, rec.Key(), rec.Data())
+	issued := &token.Issued{JTI: "legacy-issued", Username: name,
+		Expires: time.Now().Add(time.Hour)}
+	putLegacy(issuedByte, []byte(issued.JTI), issued.Data())
+	try.To(db.RmKeyValueFromBucket(buckets[metaByte], &db.Data{Data: formatKey}))
+
+	assert.Equal(try.To1(GetFormatVersion()), FormatMD5)
+	_, exists := try.To2(GetUser(name))
+	assert.ThatNot(exists)
+
+	try.To(migrate())
+	assert.Equal(try.To1(GetFormatVersion()), FormatVersion)
+
+	// the interrupted migration is run again
+	putLegacy(userByte, u.Key(), u.Data())
+	try.To(db.RmKeyValueFromBucket(buckets[metaByte], &db.Data{Data: formatKey}))
+	try.To(migrate())
+
+	migrated := try.To1(GetExistingUser(name))
+	assert.Equal(migrated.DID, u.DID)
+	_ = try.To1(GetExistingUserByWebAuthnID(u.WebAuthnID()))
+	_ = try.To1(GetExistingSessionUser(u.WebAuthnID()))
+	assert.That(isIndexed(userDIDByte, []byte(u.DID), hash))
+	users, _ := try.To2(GetUsers("legacy", 1))
+	assert.SLen(users, 1)
+	assert.Equal(users[0].Name, name)
+	_, exists = try.To2(GetRefreshToken(rt.ID))
+	assert.That(exists)
+	assert.That(try.To1(IsRevoked(revoked.JTI)))
+
+	for _, b := range []int{userByte, userIDByte, userSessionByte} {
+		assert.ThatNot(isIndexed(b, u.Key(), md5Hash))
+		assert.ThatNot(isIndexed(b, u.WebAuthnID(), md5Hash))
+	}
+	assert.ThatNot(isIndexed(userDIDByte, []byte(u.DID), md5Hash))
+
+	// every bucket with the index hashes is migrated
+	legacyKeys := map[int][]byte{
+		userByte:         u.Key(),
+		userSessionByte:  u.WebAuthnID(),
+		userIDByte:       u.WebAuthnID(),
+		refreshTokenByte: []byte(rt.ID),
+		revokedByte:      []byte(revoked.JTI),
+		userDIDByte:      []byte(u.DID),
+		onboardingByte:   u.Key(),
+		deletionByte:     deletion.Key(),
+		ceremonyByte:     ceremonyKey,
+		transactionByte:  rec.Key(),
+		issuedByte:       []byte(issued.JTI),
+	}
+	for b := range buckets {
+		if b == metaByte {
+			continue // the plain keys
+		}
+		key, covered := legacyKeys[b]
+		assert.That(covered, "bucket %d not covered", b)
+		assert.That(isIndexed(b, key, hash), "bucket %d not migrated", b)
+		assert.ThatNot(isIndexed(b, key, md5Hash), "bucket %d has old keys", b)
+	}
+
+	try.To(setFormatVersion(FormatVersion + 1))
+	assert.Error(migrate())
+	try.To(setFormatVersion(FormatVersion))
+
+	try.To(RemoveUser(name))
+	try.To(RemoveSessionUser(u.WebAuthnID()))
+	try.To(RemoveRefreshToken(rt.ID))
+	try.To(RemoveRevoked(revoked.JTI))
+	try.To(RemovePendingOnboarding(name))
+	try.To(db.RmKeyValueFromBucket(buckets[deletionByte],
+		&db.Data{Data: deletion.Key(), Read: hash}))
+	try.To(RemoveCeremony(string(ceremonyKey)))
+	try.To(db.RmKeyValueFromBucket(buckets[transactionByte],
+		&db.Data{Data: rec.Key(), Read: hash}))
+	try.To(RemoveIssued(issued.JTI))
+}
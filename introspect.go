@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/findy-network/findy-agent-auth/ceremony"
+	"github.com/findy-network/findy-agent-auth/enclave"
+	"github.com/findy-network/findy-agent-auth/token"
+	"github.com/golang/glog"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// envIntrospectClients is the environment variable for the introspection
+// clients, which is used when the clients aren't given with the flag.
+const envIntrospectClients = "FAA_INTROSPECT_CLIENTS"
+
+// introspectClients are the SHA-256 hashes of the client secrets of the
+// introspection clients by the client ID.
+var introspectClients map[string][]byte
+
+// introspection is the RFC 7662 introspection response. The inactive token
+// has only the active field.
+type introspection struct {
+	Active       bool     `json:"active"`
+	TokenType    string   `json:"token_type,omitempty"`
+	Username     string   `json:"username,omitempty"`
+	Subject      string   `json:"sub,omitempty"`
+	Issuer       string   `json:"iss,omitempty"`
+	Audience     []string `json:"aud,omitempty"`
+	Expires      int64    `json:"exp,omitempty"`
+	IssuedAt     int64    `json:"iat,omitempty"`
+	JTI          string   `json:"jti,omitempty"`
+	AMR          []string `json:"amr,omitempty"`
+	CredentialID string   `json:"cid,omitempty"`
+	ClientID     string   `json:"client_id,omitempty"`
+
+	Confirmation *token.Confirmation `json:"cnf,omitempty"`
+}
+
+// introspect is the RFC 7662 token introspection endpoint for the agency
+// services. The token is active when it's valid and not revoked, its user
+// exists and still has a usable credential, and the credential of the token
+// (cid claim) is still usable. The client must authenticate with the client
+// secret or the client certificate.
+func introspect(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	clientID, ok := introspectClient(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="introspect"`)
+		glog.Warningln("introspect, client authentication failed:", clientID)
+		try.To(markErrUnauthorized(fmt.Errorf("invalid client")))
+	}
+
+	defer err2.Handle(&err, markErrBadRequest)
+
+	ts := r.PostFormValue("token")
+	if ts == "" {
+		err2.Throwf("token missing")
+	}
+
+	defer err2.Handle(&err, markErrInternal)
+
+	res := try.To1(introspectToken(ts))
+	w.Header().Set("Cache-Control", "no-store")
+	jsonResponse(w, res, nil)
+	glog.V(1).Infoln("introspect by", clientID, "active:", res.Active)
+}
+
+// introspectToken returns the introspection response of the token. Only the
+// storage errors are returned, the invalid tokens are just inactive.
+func introspectToken(ts string) (_ *introspection, err error) {
+	defer err2.Handle(&err, "introspect token")
+
+	inactive := &introspection{Active: false}
+
+	claims, err := token.Parse(ts)
+	if err != nil {
+		glog.V(3).Infoln("introspect:", err)
+		return inactive, nil
+	}
+	u, exists := try.To2(enclave.GetUserByDID(claims.Username))
+	if !exists || u.Disabled || len(u.WebAuthnCredentials()) == 0 {
+		return inactive, nil
+	}
+	if claims.CredentialID != "" {
+		credID, err := base64.RawURLEncoding.DecodeString(claims.CredentialID)
+		if err != nil || !u.IsUsableCredential(credID) {
+			return inactive, nil
+		}
+	}
+	res := &introspection{
+		Active:       true,
+		TokenType:    "Bearer",
+		Username:     u.Name,
+		Subject:      claims.Username,
+		Issuer:       claims.Issuer,
+		Audience:     claims.Audience,
+		JTI:          claims.ID,
+		AMR:          claims.AMR,
+		CredentialID: claims.CredentialID,
+		ClientID:     claims.ClientID,
+		Confirmation: claims.Confirmation,
+	}
+	if claims.Confirmation != nil {
+		res.TokenType = ceremony.DPoPHeader
+	}
+	if claims.ExpiresAt != nil {
+		res.Expires = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		res.IssuedAt = claims.IssuedAt.Unix()
+	}
+	return res, nil
+}
+
+// introspectClient authenticates the introspection client and returns its
+// ID. The client certificate verified with the introspection CA is accepted
+// as is. Otherwise the client secret is needed in the basic authentication
+// header (RFC 6749 2.3.1) or in the form.
+func introspectClient(r *http.Request) (clientID string, ok bool) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName, true
+	}
+	clientID, secret, found := r.BasicAuth()
+	if !found {
+		clientID, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	hash, exists := introspectClients[clientID]
+	if !exists || secret == "" {
+		return clientID, false
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return clientID, subtle.ConstantTimeCompare(sum[:], hash) == 1
+}
+
+// parseIntrospectClients parses the clients given as id:secret pairs
+// separated with comma.
+func parseIntrospectClients(s string) (clients map[string][]byte, err error) {
+	clients = make(map[string][]byte)
+	for _, c := range splitList(s) {
+		id, secret, found := strings.Cut(c, ":")
+		if !found || id == "" || secret == "" {
+			return nil, fmt.Errorf("illegal introspection client: %s", id)
+		}
+		sum := sha256.Sum256([]byte(secret))
+		clients[id] = sum[:]
+	}
+	return clients, nil
+}
+
+// setupIntrospection reads the introspection clients from the flag or the
+// environment.
+func setupIntrospection() (err error) {
+	defer err2.Handle(&err, "introspection clients")
+
+	clients := introspectClientsStr
+	if clients == "" {
+		clients = os.Getenv(envIntrospectClients)
+	}
+	introspectClients = try.To1(parseIntrospectClients(clients))
+	if len(introspectClients) == 0 && introspectClientCA == "" {
+		glog.V(1).Infoln("no introspection clients, introspection disabled")
+	}
+	return nil
+}
+
+// introspectTLSConfig returns the TLS config which verifies the client
+// certificates of the introspection clients if they are given.
+func introspectTLSConfig() (_ *tls.Config, err error) {
+	defer err2.Handle(&err, "introspection CA")
+
+	if introspectClientCA == "" {
+		return nil, nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(try.To1(os.ReadFile(introspectClientCA))) {
+		return nil, fmt.Errorf("no certificates in %s", introspectClientCA)
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}, nil
+}
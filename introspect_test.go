@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/findy-network/findy-agent-auth/enclave"
+	"github.com/findy-network/findy-agent-auth/user"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestParseIntrospectClients(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	clients := try.To1(parseIntrospectClients("svc-a:secret-a, svc-b:secret:b"))
+	assert.MLen(clients, 2)
+	assert.MKeyExists(clients, "svc-b")
+
+	_, err := parseIntrospectClients("svc-a")
+	assert.Error(err)
+	_, err = parseIntrospectClients("svc-a:")
+	assert.Error(err)
+}
+
+func TestIntrospect(t *testing.T) {
+	defer assert.PushTester(t)()
+	defer func(c map[string][]byte) { introspectClients = c }(introspectClients)
+
+	introspectClients = try.To1(parseIntrospectClients("agency:s3cret"))
+
+	const name = "introspect-user"
+	u := user.New(name, name, "")
+	u.DID = "introspect-did"
+	phone := &webauthn.Credential{ID: []byte("phone")}
+	laptop := &webauthn.Credential{ID: []byte("laptop")}
+	u.AddCredential(*phone)
+	u.AddCredential(*laptop)
+	try.To(enclave.PutUser(u))
+
+	r := newMuxWithRoutes()
+	call := func(ts string, auth func(req *http.Request, form url.Values)) (int, *introspection) {
+		form := url.Values{"token": {ts}}
+		req := httptest.NewRequest("POST", urlIntrospect, nil)
+		auth(req, form)
+		req.Body = io.NopCloser(strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var res introspection
+		if w.Code == http.StatusOK {
+			try.To(json.Unmarshal(w.Body.Bytes(), &res))
+		}
+		return w.Code, &res
+	}
+	basic := func(req *http.Request, _ url.Values) { req.SetBasicAuth("agency", "s3cret") }
+
+	at := try.To1(loginTokens(u, phone, ""))
+
+	t.Run("client authentication", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		code, _ := call(at.Token, func(*http.Request, url.Values) {})
+		assert.Equal(code, http.StatusUnauthorized)
+		code, _ = call(at.Token, func(req *http.Request, _ url.Values) {
+			req.SetBasicAuth("agency", "wrong")
+		})
+		assert.Equal(code, http.StatusUnauthorized)
+
+		code, res := call(at.Token, basic)
+		assert.Equal(code, http.StatusOK)
+		assert.That(res.Active)
+
+		code, res = call(at.Token, func(_ *http.Request, form url.Values) {
+			form.Set("client_id", "agency")
+			form.Set("client_secret", "s3cret")
+		})
+		assert.Equal(code, http.StatusOK)
+		assert.That(res.Active)
+
+		code, res = call(at.Token, func(req *http.Request, _ url.Values) {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+				{Subject: pkix.Name{CommonName: "agency-service"}},
+			}}}
+		})
+		assert.Equal(code, http.StatusOK)
+		assert.That(res.Active)
+
+		code, _ = call("", basic)
+		assert.Equal(code, http.StatusBadRequest)
+	})
+	t.Run("token state", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		code, res := call(at.Token, basic)
+		assert.Equal(code, http.StatusOK)
+		assert.That(res.Active)
+		assert.Equal(res.Username, name)
+		assert.Equal(res.Subject, u.DID)
+		assert.Equal(res.TokenType, "Bearer")
+		assert.NotEmpty(res.JTI)
+		assert.That(res.Expires > res.IssuedAt)
+
+		_, res = call("garbage", basic)
+		assert.ThatNot(res.Active)
+		assert.Empty(res.Username)
+	})
+	t.Run("revoked", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		stolen := try.To1(loginTokens(u, laptop, ""))
+		_, res := call(stolen.Token, basic)
+		assert.That(res.Active)
+
+		try.To(u.RemoveCredential(laptop.ID))
+		try.To(enclave.PutUser(u))
+		try.To(revokeCredentialTokens(u.Name, laptop.ID))
+		_, res = call(stolen.Token, basic)
+		assert.ThatNot(res.Active)
+
+		_, res = call(at.Token, basic)
+		assert.That(res.Active)
+		try.To(enclave.RemoveUser(name))
+		_, res = call(at.Token, basic)
+		assert.ThatNot(res.Active)
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -11,8 +12,12 @@ import (
 	"strings"
 	"time"
 
+	"github.com/findy-network/findy-agent-auth/ceremony"
 	"github.com/findy-network/findy-agent-auth/enclave"
+	"github.com/findy-network/findy-agent-auth/mds"
+	"github.com/findy-network/findy-agent-auth/oidc"
 	"github.com/findy-network/findy-agent-auth/session"
+	"github.com/findy-network/findy-agent-auth/token"
 	"github.com/findy-network/findy-agent-auth/user"
 	myhttp "github.com/findy-network/findy-common-go/http"
 	"github.com/findy-network/findy-common-go/jwt"
@@ -30,40 +35,103 @@ import (
 
 const defaultPort = 8080
 const defaultTimeoutSecs = 30
+const defaultConditionalTimeoutSecs = 600
+const defaultCeremonyTimeoutSecs = 300
 
 var (
-	loggingFlags   string
-	port           = defaultPort
-	agencyAddr     string
-	agencyPort     int
-	agencyInsecure bool
-	rpID           string
-	rpOrigin       string
-	jwtSecret      string
-	webAuthn       *webauthn.WebAuthn
-	sessionStore   *session.Store
-	enclaveFile    = "fido-enclave.bolt"
-	enclaveBackup  = ""
-	enclaveKey     = "15308490f1e4026284594dd08d31291bc8ef2aeac730d0daf6ff87bb92d4336c"
-	backupInterval = 24 // hours
-	findyAdmin     = "findy-root"
-	certPath       = ""
-	allowCors      = false
-	isHTTPS        = false
-	testUI         = false
-	timeoutSecs    = defaultTimeoutSecs
+	loggingFlags          string
+	port                  = defaultPort
+	agencyAddr            string
+	agencyPort            int
+	agencyInsecure        bool
+	allocatorKind         = user.AllocatorGRPC
+	onboardingBackoffSecs = int(user.DefaultOnboardingBackoff / time.Second)
+	localDIDMethod        = user.DIDMethodKey
+	rpID                  string
+	rpOrigin              string
+	jwtSecret             string
+	webAuthn              *webauthn.WebAuthn
+	sessionStore          *session.Store
+	enclaveFile           = "fido-enclave.bolt"
+	enclaveBackup         = ""
+	enclaveKey            = "15308490f1e4026284594dd08d31291bc8ef2aeac730d0daf6ff87bb92d4336c"
+	backupInterval        = 24 // hours
+	findyAdmin            = "findy-root"
+	adminBootstrapToken   = ""
+	certPath              = ""
+	allowCors             = false
+	isHTTPS               = false
+	testUI                = false
+	timeoutSecs           = defaultTimeoutSecs
+	clonePolicy           = clonePolicyLog
+
+	residentKey           = ""
+	attachment            = ""
+	userVerification      = ""
+	algorithms            = ""
+	registrationHints     = ""
+	adminUserVerification = ""
+	adminAttachment       = ""
+
+	conditionalTimeoutSecs = defaultConditionalTimeoutSecs
+	ceremonyTimeoutSecs    = defaultCeremonyTimeoutSecs
+
+	jwtKeys        = ""
+	jwtKeysRefresh = 5 // minutes
+	jwtLifetime    = 0 // minutes, 0 is the default of the refresh setting
+	jwtIssuer      = ""
+	jwtAudience    = ""
+	jwtClaims      = ""
+
+	refreshLifetimeHours = int(token.DefaultRefreshLifetime / time.Hour)
+	stepUpLifetimeMins   = int(token.DefaultElevatedLifetime / time.Minute)
+
+	introspectClientsStr = ""
+	introspectClientCA   = ""
+
+	oidcIssuer   = ""
+	oidcClients  = ""
+	oidcLoginURL = ""
+
+	sessionKeys     = ""
+	sessionKeysFile = ""
+
+	attestation  = string(protocol.PreferNoAttestation)
+	mdsFile      = ""
+	mdsRoot      = ""
+	mdsRefresh   = 1 // hours
+	aaguidsAllow = ""
+	aaguidsDeny  = ""
 
 	// startServereCmd = flag.NewFlagSet("server", flag.ExitOnError)
 
 	defaultOrigin = fmt.Sprintf("http://localhost:%d", port)
 
 	// our errors
-	errInternal   = errors.New("server failure")
-	errBadRequest = errors.New("bad request")
+	errInternal     = errors.New("server failure")
+	errBadRequest   = errors.New("bad request")
+	errUnauthorized = errors.New("unauthorized")
+	errForbidden    = errors.New("forbidden")
+	errConflict     = errors.New("conflict")
+
+	errStepUpRequired = errors.New("step-up authentication required")
+	errAdminRequired  = errors.New("admin required")
+
+	errAccountDisabled = errors.New("account disabled")
+	errOffboardPending = errors.New("cloud agent must be removed by the admin")
+
+	errRegistrationPending = errors.New("registration in progress")
+
+	errOnboardingPending = errors.New("cloud agent allocation pending")
+	errDIDInUse          = errors.New("DID allocated to other user")
 )
 
 type AccessToken struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+
+	// TokenType is DPoP when the tokens are bound to the client's DPoP key.
+	TokenType string `json:"token_type,omitempty"`
 }
 
 func init() {
@@ -72,21 +140,56 @@ func init() {
 	flag.StringVar(&agencyAddr, "agency", "guest", "agency gRPC server addr")
 	flag.IntVar(&agencyPort, "gport", 50051, "agency gRPC server port")
 	flag.BoolVar(&agencyInsecure, "agency-insecure", false, "establish insecure connection to agency")
+	flag.StringVar(&allocatorKind, "allocator", allocatorKind, "cloud agent allocator: grpc|local|noop")
+	flag.StringVar(&localDIDMethod, "local-did", localDIDMethod, "DID method of the local allocator: key|peer")
+	flag.IntVar(&onboardingBackoffSecs, "onboarding-backoff", onboardingBackoffSecs, "first retry delay of the failed cloud agent allocation in seconds, doubled after every failure")
 	flag.StringVar(&rpID, "domain", "localhost", "RPID, usually domain without a scheme and port (deprecated)")
 	flag.StringVar(&rpID, "rpid", "http://localhost", "usually domain without a scheme and port")
 	flag.StringVar(&rpOrigin, "origin", defaultOrigin, "origin URL for Webauthn requests  (deprecated)")
 	flag.StringVar(&rpOrigin, "origins", defaultOrigin, "origin URLs for Webauthn requests, separated with comma")
 	flag.StringVar(&jwtSecret, "jwt-secret", "", "secure key for JWT token generation")
+	flag.StringVar(&jwtKeys, "jwt-keys", jwtKeys, "PEM files of ES256 or EdDSA JWT signing keys, separated with comma, first is current, rest are for verification")
+	flag.IntVar(&jwtKeysRefresh, "jwt-keys-refresh", jwtKeysRefresh, "JWT key files change check interval in minutes")
+	flag.IntVar(&jwtLifetime, "jwt-lifetime", jwtLifetime, "JWT lifetime in minutes, default is 15 with refresh tokens, otherwise 4320")
+	flag.StringVar(&jwtIssuer, "jwt-issuer", jwtIssuer, "JWT issuer (iss) claim")
+	flag.StringVar(&jwtAudience, "jwt-audience", jwtAudience, "JWT audience (aud) claim, separated with comma")
+	flag.StringVar(&jwtClaims, "jwt-claims", jwtClaims, "optional JWT claims separated with comma: auth_time|amr|aaguid|cid|uv")
+	flag.IntVar(&refreshLifetimeHours, "refresh-lifetime", refreshLifetimeHours, "refresh token lifetime in hours, 0 disables refresh tokens")
+	flag.IntVar(&stepUpLifetimeMins, "stepup-lifetime", stepUpLifetimeMins, "lifetime of the elevated tokens of the step-up authentication in minutes")
+	flag.StringVar(&introspectClientsStr, "introspect-clients", introspectClientsStr, "token introspection clients as id:secret pairs, separated with comma (env: "+envIntrospectClients+")")
+	flag.StringVar(&introspectClientCA, "introspect-client-ca", introspectClientCA, "CA certificate file of the token introspection clients' TLS certificates, requires -local-tls")
+	flag.StringVar(&oidcIssuer, "oidc-issuer", oidcIssuer, "OIDC issuer, the public base URL of this server")
+	flag.StringVar(&oidcClients, "oidc-clients", oidcClients, "JSON file of the OIDC clients, if given the OIDC provider is in use")
+	flag.StringVar(&oidcLoginURL, "oidc-login-url", oidcLoginURL, "login page URL of the OIDC provider, it gets the "+oidc.RequestParam+" query parameter")
 	flag.StringVar(&enclaveFile, "sec-file", enclaveFile, "secure enclave DB file name")
 	flag.StringVar(&enclaveBackup, "sec-backup-file", enclaveBackup, "secure enclave DB backup base file name")
 	flag.StringVar(&enclaveKey, "sec-key", enclaveKey, "sec-enc master key, SHA-256, 32-byte hex coded")
 	flag.IntVar(&backupInterval, "sec-backup-interval", backupInterval, "secure enclave backup interval in hours")
 	flag.StringVar(&findyAdmin, "admin", findyAdmin, "admin ID used for this agency ecosystem")
+	flag.StringVar(&adminBootstrapToken, "admin-bootstrap-token", adminBootstrapToken, "one-time token to register the admin, generated and printed if not given (env: "+envAdminBootstrapToken+")")
 	flag.StringVar(&certPath, "cert-path", certPath, "cert root path where server and client certificates exist")
 	flag.BoolVar(&allowCors, "cors", allowCors, "allow cross-origin requests")
 	flag.BoolVar(&isHTTPS, "local-tls", isHTTPS, "serve HTTPS")
 	flag.BoolVar(&testUI, "test-ui", testUI, "render test UI home page")
 	flag.IntVar(&timeoutSecs, "timeout", timeoutSecs, "GRPC call timeout in seconds")
+	flag.StringVar(&residentKey, "resident-key", residentKey, "resident key requirement for registration: discouraged|preferred|required")
+	flag.StringVar(&attachment, "attachment", attachment, "authenticator attachment for registration: platform|cross-platform")
+	flag.StringVar(&userVerification, "user-verification", userVerification, "user verification for registration: discouraged|preferred|required")
+	flag.StringVar(&algorithms, "algorithms", algorithms, "allowed COSE algorithm IDs for registration, separated with comma, e.g. -7,-8")
+	flag.StringVar(&registrationHints, "hints", registrationHints, "WebAuthn hints for registration, separated with comma: security-key|client-device|hybrid")
+	flag.StringVar(&adminUserVerification, "admin-user-verification", adminUserVerification, "user verification for admin registration")
+	flag.StringVar(&adminAttachment, "admin-attachment", adminAttachment, "authenticator attachment for admin registration")
+	flag.IntVar(&conditionalTimeoutSecs, "conditional-timeout", conditionalTimeoutSecs, "conditional mediation (autofill UI) challenge lifetime in seconds")
+	flag.IntVar(&ceremonyTimeoutSecs, "ceremony-timeout", ceremonyTimeoutSecs, "registration and login challenge lifetime in seconds")
+	flag.StringVar(&sessionKeys, "session-keys", sessionKeys, "session cookie keys, hex coded hashkey[:encryptionkey], separated with comma, first is current (env: "+envSessionKeys+")")
+	flag.StringVar(&sessionKeysFile, "session-keys-file", sessionKeysFile, "file of session cookie keys, one per line, first is current")
+	flag.StringVar(&attestation, "attestation", attestation, "attestation conveyance preference: none|indirect|direct|enterprise")
+	flag.StringVar(&mdsFile, "mds-file", mdsFile, "FIDO MDS3 BLOB file, if given only authenticators in it are accepted")
+	flag.StringVar(&mdsRoot, "mds-root", mdsRoot, "FIDO MDS3 root certificate file, default is FIDO Alliance's root")
+	flag.IntVar(&mdsRefresh, "mds-refresh-interval", mdsRefresh, "FIDO MDS3 BLOB file refresh check interval in hours")
+	flag.StringVar(&aaguidsAllow, "aaguid-allow", aaguidsAllow, "allowed authenticator AAGUIDs, separated with comma")
+	flag.StringVar(&aaguidsDeny, "aaguid-deny", aaguidsDeny, "denied authenticator AAGUIDs, separated with comma")
+	flag.StringVar(&clonePolicy, "clone-policy", clonePolicy, "what to do when authenticator is suspected cloned: log|reject|disable")
 }
 
 func main() {
@@ -99,7 +202,10 @@ func main() {
 	var handler http.Handler = r
 	if allowCors {
 		hCors := cors.New(cors.Options{
-			AllowedOrigins:   strings.Split(rpOrigin, ","),
+			AllowedOrigins: strings.Split(rpOrigin, ","),
+			AllowedHeaders: []string{"Origin", "Accept", "Content-Type", "X-Requested-With",
+				"Authorization", ceremony.Header, ceremony.ModeHeader},
+			ExposedHeaders:   []string{ceremony.Header, "Retry-After"},
 			AllowCredentials: true,
 			Debug:            true,
 		})
@@ -107,6 +213,14 @@ func main() {
 	}
 
 	backupTickerDone := enclave.BackupTicker(time.Duration(backupInterval) * time.Hour)
+	mdsTickerDone := mds.RefreshTicker(time.Duration(mdsRefresh) * time.Hour)
+	tokenTickerDone := token.RefreshTicker(time.Duration(jwtKeysRefresh) * time.Minute)
+	onboardingTickerDone := onboardingTicker(onboardingInterval)
+	revokedTickerDone := revokedTicker(revokedPurgeInterval)
+	var agencyTickerDone chan<- struct{}
+	if allocatorKind == user.AllocatorGRPC {
+		agencyTickerDone = user.AgencyHealthTicker(agencyHealthInterval)
+	}
 
 	serverAddress := fmt.Sprintf(":%d", port)
 	if glog.V(1) {
@@ -118,7 +232,11 @@ func main() {
 		certFile := filepath.Join(certPath, "server.crt")
 		keyFile := filepath.Join(certPath, "server.key")
 		glog.V(3).Infoln("starting TLS server with:\n", certFile, "\n", keyFile)
-		server := &http.Server{Addr: serverAddress, Handler: handler}
+		server := &http.Server{
+			Addr:      serverAddress,
+			Handler:   handler,
+			TLSConfig: try.To1(introspectTLSConfig()),
+		}
 		shutdownCh = myhttp.Run(server, certFile, keyFile)
 	} else {
 		server := &http.Server{Addr: serverAddress, Handler: handler}
@@ -134,6 +252,18 @@ func main() {
 	if backupTickerDone != nil {
 		backupTickerDone <- struct{}{}
 	}
+	if mdsTickerDone != nil {
+		mdsTickerDone <- struct{}{}
+	}
+	if tokenTickerDone != nil {
+		tokenTickerDone <- struct{}{}
+	}
+	onboardingTickerDone <- struct{}{}
+	revokedTickerDone <- struct{}{}
+	if agencyTickerDone != nil {
+		agencyTickerDone <- struct{}{}
+		user.CloseAgency()
+	}
 }
 
 func newMuxWithRoutes() *mux.Router {
@@ -151,6 +281,57 @@ func newMuxWithRoutes() *mux.Router {
 	r.HandleFunc(urlBeginRegister, BeginRegistration).Methods("POST")
 	r.HandleFunc(urlFinishRegister, FinishRegistration).Methods("POST")
 
+	// Step-up re-authentication, JWT is required
+	r.HandleFunc(urlBeginStepUp, BeginStepUp).Methods("POST")
+	r.HandleFunc(urlFinishStepUp, FinishStepUp).Methods("POST")
+
+	// Transaction confirmation, JWT is required
+	r.HandleFunc(urlBeginTransaction, BeginTransaction).Methods("POST")
+	r.HandleFunc(urlFinishTransaction, FinishTransaction).Methods("POST")
+	r.HandleFunc(urlTransaction, getTransaction).Methods("GET")
+
+	// Credential management endpoints, JWT is required, and the elevated JWT
+	// for the changes
+	r.HandleFunc(urlCredentials, listCredentials).Methods("GET")
+	r.HandleFunc(urlCredential, renameCredential).Methods("PUT")
+	r.HandleFunc(urlCredential, revokeCredential).Methods("DELETE")
+	r.HandleFunc(urlUser, deleteAccount).Methods("DELETE")
+
+	// Admin endpoints, the elevated JWT of the admin is required
+	r.HandleFunc(urlAdminUsers, adminListUsers).Methods("GET")
+	r.HandleFunc(urlAdminUser, adminGetUser).Methods("GET")
+	r.HandleFunc(urlAdminUser, adminDeleteAccount).Methods("DELETE")
+	r.HandleFunc(urlAdminUserDisable, adminDisableUser).Methods("POST")
+	r.HandleFunc(urlAdminUserEnable, adminEnableUser).Methods("POST")
+	r.HandleFunc(urlAdminUserReRegister, adminForceReRegistration).Methods("POST")
+	r.HandleFunc(urlAdminCredential, adminRemoveCredential).Methods("DELETE")
+	r.HandleFunc(urlAdminDID, adminGetUserByDID).Methods("GET")
+	r.HandleFunc(urlAdminDeletions, adminListDeletions).Methods("GET")
+	r.HandleFunc(urlAdminOffboardings, adminListOffboardings).Methods("GET")
+
+	// Status of the cloud agent allocation after the registration
+	r.HandleFunc(urlOnboarding, getOnboardingStatus).Methods("GET")
+
+	// Public keys of the JWT tokens
+	r.HandleFunc(urlJWKS, token.JWKSHandler).Methods("GET")
+
+	// Token life cycle endpoints
+	r.HandleFunc(urlRefresh, refreshTokens).Methods("POST")
+	r.HandleFunc(urlLogout, logout).Methods("POST")
+	r.HandleFunc(urlRevoked, revokedTokens).Methods("GET")
+	r.HandleFunc(urlIntrospect, introspect).Methods("POST")
+
+	// OIDC provider facade
+	if oidcProvider != nil {
+		r.HandleFunc(urlOIDCDiscovery, oidcDiscovery).Methods("GET")
+		r.HandleFunc(urlOIDCAuthorize, oidcAuthorize).Methods("GET", "POST")
+		r.HandleFunc(urlOIDCRequest, oidcRequest).Methods("GET")
+		r.HandleFunc(urlOIDCRequest, oidcComplete).Methods("POST")
+		r.HandleFunc(urlOIDCRequest, oidcDeny).Methods("DELETE")
+		r.HandleFunc(urlOIDCToken, oidcToken).Methods("POST")
+		r.HandleFunc(urlOIDCUserinfo, oidcUserInfo).Methods("GET", "POST")
+	}
+
 	if testUI {
 		glog.V(2).Info("testUI call")
 		r.PathPrefix("/").Handler(http.FileServer(http.Dir("./static")))
@@ -181,12 +362,16 @@ func BeginRegistration(w http.ResponseWriter, r *http.Request) {
 	var uInfo userInfo
 	try.To(json.NewDecoder(r.Body).Decode(&uInfo))
 	username := uInfo.Username
+	policy := try.To1(policyFor(username).tighten(uInfo))
 
 	// get user
-	userData, exists := try.To2(enclave.GetUser(username))
+	userData, exists := try.To2(registeredUser(username, uInfo.BootstrapToken))
 
 	displayName := strings.Split(username, "@")[0]
 	if !exists {
+		if username == findyAdmin {
+			try.To(verifyAdminBootstrap(uInfo.BootstrapToken))
+		}
 		glog.V(2).Infoln("adding new user:", displayName)
 		if uInfo.Seed == "" {
 			glog.V(5).Infoln("no seed supplied")
@@ -194,15 +379,16 @@ func BeginRegistration(w http.ResponseWriter, r *http.Request) {
 		userData = user.New(username, displayName, uInfo.Seed)
 		try.To(enclave.PutUser(userData))
 		userCreated = true
-	} else if !jwt.IsValidUser(userData.DID, r.Header["Authorization"]) {
+	} else if err := authorizeNewAuthenticator(w, r, userData,
+		uInfo.RegistrationCode); err != nil {
 		glog.Warningln("new ator, invalid JWT", userData.DID, displayName)
-		err2.Throwf("%w: invalid token", errBadRequest)
-		return
+		try.To(err)
 	}
 
 	registerOptions := func(credCreationOpts *protocol.PublicKeyCredentialCreationOptions) {
 		credCreationOpts.CredentialExcludeList = userData.CredentialExcludeList()
 		glog.V(1).Infoln("credexcl:", len(credCreationOpts.CredentialExcludeList))
+		policy.apply(credCreationOpts)
 	}
 
 	defer err2.Handle(&err,
@@ -227,20 +413,74 @@ func BeginRegistration(w http.ResponseWriter, r *http.Request) {
 	assert.INotNil(sessionStore)
 	// store session data as marshaled JSON
 	glog.V(1).Infoln("store session data")
-	try.To(sessionStore.SaveWebauthnSession("registration", sessionData, r, w))
+	try.To(saveCeremony("registration", sessionData, registrationState{
+		Policy:      policy,
+		UserCreated: userCreated,
+	}, r, w))
 	try.To(enclave.PutSessionUser(sessionData.UserID, userData))
 
-	jsonResponse(w, options.Response, nil)
+	jsonResponse(w, &creationOptions{
+		PublicKeyCredentialCreationOptions: options.Response,
+		Hints:                              policy.Hints,
+	}, nil)
 	glog.V(1).Infoln("BEGIN (new) registration end", username)
 }
 
+// registeredUser returns the registered user. The user left by the
+// abandoned registration ceremony is removed after the ceremony has expired,
+// and the registration begins again like the user wouldn't exist, e.g. the
+// admin still needs the bootstrap token and isn't locked out. The admin's
+// bootstrap token is checked before the removal. The registration, which is
+// still going on, isn't interrupted.
+func registeredUser(name, bootstrapToken string) (u *user.User, exists bool, err error) {
+	defer err2.Handle(&err, "registered user")
+
+	u, exists = try.To2(enclave.GetUser(name))
+	if !exists || u.IsRegistered() {
+		return u, exists, nil
+	}
+	if !u.IsAbandoned(time.Now(), time.Duration(ceremonyTimeoutSecs)*time.Second) {
+		return nil, false, fmt.Errorf("%w: %w: %s", errConflict,
+			errRegistrationPending, name)
+	}
+	if name == findyAdmin {
+		try.To(verifyAdminBootstrap(bootstrapToken))
+	}
+	glog.V(1).Infoln("abandoned registration, begin again:", name)
+	try.To(enclave.RemoveUser(name))
+	return nil, false, nil
+}
+
 type userInfo struct {
 	Username    string `json:"username"`
 	DisplayName string `json:"displayName,omitempty"`
 
 	UserVerification string `json:"userVerification,omitempty"`
+	ResidentKey      string `json:"residentKey,omitempty"`
+
+	AuthenticatorAttachment string   `json:"authenticatorAttachment,omitempty"`
+	Attestation             string   `json:"attestation,omitempty"`
+	Algorithms              []int64  `json:"algorithms,omitempty"`
+	Hints                   []string `json:"hints,omitempty"`
 
 	Seed string `json:"seed,omitempty"`
+
+	// RegistrationCode is given by the admin for the forced re-registration.
+	RegistrationCode string `json:"registrationCode,omitempty"`
+
+	// BootstrapToken is required to register the admin.
+	BootstrapToken string `json:"bootstrapToken,omitempty"`
+}
+
+// registrationState is our own state of the registration ceremony, which is
+// kept with the webauthn session data from the begin to the finish.
+type registrationState struct {
+	// Policy is the registration policy offered to the client.
+	Policy registrationPolicy
+
+	// UserCreated tells that the ceremony created the user, i.e. the user is
+	// removed if the registration fails.
+	UserCreated bool
 }
 
 func FinishRegistration(w http.ResponseWriter, r *http.Request) {
@@ -254,16 +494,22 @@ func FinishRegistration(w http.ResponseWriter, r *http.Request) {
 
 	assert.INotNil(sessionStore)
 	glog.V(1).Infoln("get session data for registration")
-	sessionData := try.To1(sessionStore.GetWebauthnSession("registration", r))
+	var state registrationState
+	sessionData := try.To1(getCeremony("registration", &state, r))
 
-	user := try.To1(enclave.GetExistingSessionUser(sessionData.UserID))
-	glog.V(1).Infoln("FINISH (new) registration", user.Name)
+	sessionUser := try.To1(enclave.GetExistingSessionUser(sessionData.UserID))
+	glog.V(1).Infoln("FINISH (new) registration", sessionUser.Name)
 
+	// the session user is a snapshot from the begin, we continue with the
+	// current user data
+	user := try.To1(enclave.GetExistingUser(sessionUser.Name))
+
+	var credID []byte
 	defer err2.Handle(&err,
 		markErrInternal,
 		func(err error) error {
-			// try to remove added user as registration failed
-			errRm := enclave.RemoveUser(user.Name)
+			errRm := rollbackRegistration(user.Name, sessionData.UserID,
+				credID, state.UserCreated)
 			if errRm != nil {
 				err = fmt.Errorf("finsish reg: %w: %w", err, errRm)
 			}
@@ -273,13 +519,19 @@ func FinishRegistration(w http.ResponseWriter, r *http.Request) {
 	)
 
 	glog.V(1).Infoln("call web authn finish registration and getting credential")
-	credential := try.To1(webAuthn.FinishRegistration(user, sessionData, r))
+	credential := try.To1(finishRegistration(user, sessionData, state.Policy, r))
+	credID = credential.ID
 
 	// Add needed data to User
 	user.AddCredential(*credential)
-	try.To(user.AllocateCloudAgent(findyAdmin, time.Duration(timeoutSecs)*time.Second)) //nolint: contextcheck
+	user.ReRegistration = nil
+	allocateCloudAgent(r.Context(), user)
 	// Persist that data
 	try.To(enclave.PutUser(user))
+	if user.Name == findyAdmin {
+		consumeAdminBootstrap()
+	}
+	setOnboardingID(w, user)
 
 	jsonResponse(w, "Registration Success", nil)
 	glog.V(1).Infoln("END (new) finish registration", user.Name)
@@ -287,10 +539,71 @@ func FinishRegistration(w http.ResponseWriter, r *http.Request) {
 	_ = enclave.RemoveSessionUser(sessionData.UserID)
 }
 
+// rollbackRegistration undoes the failed registration ceremony. If the user
+// was created by the ceremony, the user is removed. Otherwise the user is only
+// adding an authenticator, and only the new credential is removed if it's
+// stored. The ceremony's user ID tells that the user is still the one the
+// ceremony created. The user who is onboarded, is re-registering, or has other
+// credentials is never removed, and the user's last credential is kept.
+func rollbackRegistration(name string, userID, credID []byte, created bool) (err error) {
+	defer err2.Handle(&err, "rollback registration")
+
+	u, exists := try.To2(enclave.GetUser(name))
+	if !exists {
+		return nil
+	}
+	stored, others := false, false
+	for _, cred := range u.Credentials {
+		if credID != nil && bytes.Equal(cred.ID, credID) {
+			stored = true
+		} else {
+			others = true
+		}
+	}
+	if created && bytes.Equal(u.WebAuthnID(), userID) &&
+		u.DID == "" && u.ReRegistration == nil && !others {
+		glog.V(1).Infoln("rollback, remove user created by ceremony", name)
+		return enclave.RemoveUser(name)
+	}
+	if !stored || !others {
+		glog.V(1).Infoln("existing user, nothing to rollback", name)
+		return nil
+	}
+	glog.V(1).Infoln("rollback new credential of", name)
+	try.To(u.RemoveCredential(credID))
+	return enclave.PutUser(u)
+}
+
+// finishRegistration validates the registration response and verifies it
+// against the registration policy of the ceremony and our attestation policy.
+func finishRegistration(
+	u *user.User,
+	sessionData webauthn.SessionData,
+	policy registrationPolicy,
+	r *http.Request,
+) (
+	_ *webauthn.Credential,
+	err error,
+) {
+	defer err2.Handle(&err, "finish registration")
+
+	parsed := try.To1(protocol.ParseCredentialCreationResponse(r))
+	credential := try.To1(webAuthn.CreateCredential(u, sessionData, parsed))
+	try.To(policy.verify(credential))
+	try.To(mds.Verify(&parsed.Response.AttestationObject))
+	return credential, nil
+}
+
 type loginUserInfo struct {
 	Username string `json:"username"`
+
+	// Mediation is "conditional" when the browser offers passkeys in the
+	// autofill UI.
+	Mediation string `json:"mediation,omitempty"`
 }
 
+const mediationConditional = "conditional"
+
 func BeginLogin(w http.ResponseWriter, r *http.Request) {
 	var err error
 	defer err2.Handle(&err, func(err error) error {
@@ -306,11 +619,29 @@ func BeginLogin(w http.ResponseWriter, r *http.Request) {
 	try.To(json.NewDecoder(r.Body).Decode(&uInfo))
 	username := uInfo.Username
 
+	if username == "" || uInfo.Mediation == mediationConditional {
+		glog.V(1).Infoln("discoverable login, mediation:", uInfo.Mediation)
+		var opts []webauthn.LoginOption
+		conditional := uInfo.Mediation == mediationConditional
+		if conditional {
+			opts = append(opts, withLoginTimeout(conditionalTimeout()))
+		}
+		options, sessionData := try.To2(webAuthn.BeginDiscoverableLogin(opts...))
+		if conditional {
+			sessionData.Expires = time.Now().Add(conditionalTimeout())
+		}
+		try.To(saveWebauthnSession("authentication", sessionData, r, w))
+		jsonResponse(w, options.Response, nil)
+		glog.V(1).Infoln("END (new) begin discoverable login")
+		return
+	}
+
 	user := try.To1(enclave.GetExistingUser(username))
+	try.To(requireEnabled(user))
 
 	options, sessionData := try.To2(webAuthn.BeginLogin(user))
 
-	try.To(sessionStore.SaveWebauthnSession("authentication", sessionData, r, w))
+	try.To(saveWebauthnSession("authentication", sessionData, r, w))
 	try.To(enclave.PutSessionUser(sessionData.UserID, user))
 
 	jsonResponse(w, options.Response, nil)
@@ -327,27 +658,108 @@ func FinishLogin(w http.ResponseWriter, r *http.Request) {
 	defer err2.Handle(&err, markErrBadRequest)
 
 	glog.V(1).Infoln("get session data for finshing login")
-	sessionData := try.To1(sessionStore.GetWebauthnSession("authentication", r))
+	sessionData := try.To1(getWebauthnSession("authentication", r))
+	jkt := try.To1(dpopThumbprint(r))
+
+	if sessionData.UserID == nil {
+		glog.V(1).Infoln("BEGIN (new) finish discoverable login")
+		u, credential := try.To2(finishDiscoverableLogin(sessionData, r))
+		try.To(requireEnabled(u))
+
+		defer err2.Handle(&err, markErrInternal)
+
+		try.To(updateLoginCredential(u, credential))
+		try.To(requireDID(w, u))
+		jsonResponse(w, try.To1(loginTokens(u, credential, jkt)), nil)
+		glog.V(1).Infoln("END (new) finish discoverable login", u.Name)
+		return
+	}
 
 	user := try.To1(enclave.GetExistingSessionUser(sessionData.UserID))
+	try.To(requireEnabled(user))
 
 	username := user.Name
 	glog.V(1).Infoln("BEGIN (new) finish login:", username)
 
 	defer err2.Handle(&err, markErrInternal)
 
-	// in an actual implementation, we should perform additional checks on
-	// the returned 'credential', i.e. check 'credential.Authenticator.CloneWarning'
-	// and then increment the credentials counter
-	try.To1(webAuthn.FinishLogin(user, sessionData, r))
+	credential := try.To1(webAuthn.FinishLogin(user, sessionData, r))
+	try.To(updateLoginCredential(user, credential))
+	try.To(requireDID(w, user))
 
 	// TODO: reporting jsonResponse in success path is something different even
 	// that there we have error status codes, but still. it makes everything
 	// clear.
-	jsonResponse(w, &AccessToken{Token: user.JWT()}, nil)
+	jsonResponse(w, try.To1(loginTokens(user, credential, jkt)), nil)
 	glog.V(1).Infoln("END (new) finish login", username)
 }
 
+// conditionalTimeout is the lifetime of the conditional mediation challenge.
+// The autofill UI can wait a long time before the user picks a passkey.
+func conditionalTimeout() time.Duration {
+	return time.Duration(conditionalTimeoutSecs) * time.Second
+}
+
+func withLoginTimeout(d time.Duration) webauthn.LoginOption {
+	return func(opts *protocol.PublicKeyCredentialRequestOptions) {
+		opts.Timeout = int(d.Milliseconds())
+	}
+}
+
+// finishDiscoverableLogin finishes the login ceremony which was started without
+// the username. The user is resolved from the user handle of the assertion.
+func finishDiscoverableLogin(
+	sessionData webauthn.SessionData,
+	r *http.Request,
+) (
+	u *user.User,
+	cred *webauthn.Credential,
+	err error,
+) {
+	defer err2.Handle(&err, "discoverable login")
+
+	cred = try.To1(webAuthn.FinishDiscoverableLogin(
+		func(_, userHandle []byte) (webauthn.User, error) {
+			var err error
+			u, err = enclave.GetExistingUserByWebAuthnID(userHandle)
+			return u, err
+		}, sessionData, r))
+	return u, cred, nil
+}
+
+const (
+	clonePolicyLog     = "log"
+	clonePolicyReject  = "reject"
+	clonePolicyDisable = "disable"
+)
+
+// updateLoginCredential persists the credential's authenticator data, e.g.
+// the signature counter, after successful login ceremony. If the authenticator
+// is suspected cloned, the clonePolicy tells should we only log it, reject the
+// login, or disable the credential permanently.
+func updateLoginCredential(u *user.User, cred *webauthn.Credential) (err error) {
+	defer err2.Handle(&err, "update login credential")
+
+	if !u.UpdateCredential(*cred) {
+		return fmt.Errorf("credential not found (%s)", u.Name)
+	}
+	cloned := cred.Authenticator.CloneWarning
+	if cloned {
+		glog.Warningf("clone warning: user (%s), sign count: %d, policy: %s",
+			u.Name, cred.Authenticator.SignCount, clonePolicy)
+		if clonePolicy == clonePolicyDisable {
+			u.DisableCredential(cred.ID)
+			try.To(revokeCredentialTokens(u.Name, cred.ID))
+		}
+	}
+	try.To(enclave.PutUser(u))
+
+	if cloned && clonePolicy != clonePolicyLog {
+		return fmt.Errorf("%w: authenticator suspected cloned", errBadRequest)
+	}
+	return nil
+}
+
 // from: https://github.com/go-webauthn/webauthn.io/blob/3f03b482d21476f6b9fb82b2bf1458ff61a61d41/server/response.go#L15
 func jsonResponse(w http.ResponseWriter, d any, err error) {
 	defer err2.Catch()
@@ -357,8 +769,16 @@ func jsonResponse(w http.ResponseWriter, d any, err error) {
 	c := http.StatusOK
 	switch {
 	case err == nil:
+	case errors.Is(err, errOnboardingPending):
+		c = http.StatusServiceUnavailable
+	case errors.Is(err, errForbidden):
+		c = http.StatusForbidden
+	case errors.Is(err, errConflict):
+		c = http.StatusConflict
 	case errors.Is(err, errInternal):
 		c = http.StatusInternalServerError
+	case errors.Is(err, errUnauthorized):
+		c = http.StatusUnauthorized
 	case errors.Is(err, errBadRequest):
 		c = http.StatusBadRequest
 	default:
@@ -378,7 +798,18 @@ func markErrBadRequest(err error) error {
 	return err
 }
 
+func markErrUnauthorized(err error) error {
+	err = fmt.Errorf("http err: %w: %w", errUnauthorized, err)
+	glog.Errorln("mark:", err.Error())
+	return err
+}
+
+// markErrInternal marks the error internal unless it's already marked as the
+// client's fault, e.g. the rejected credential of updateLoginCredential.
 func markErrInternal(err error) error {
+	if errors.Is(err, errBadRequest) || errors.Is(err, errUnauthorized) {
+		return err
+	}
 	prefix := "http err"
 	err = fmt.Errorf("%s: %w: %w", prefix, errInternal, err)
 	glog.Errorln("mark:", err.Error())
@@ -402,14 +833,19 @@ func oldBeginRegistration(w http.ResponseWriter, r *http.Request) {
 	var (
 		userCreated bool
 	)
+	policy := policyFor(username)
 
-	userData, exists := try.To2(enclave.GetUser(username))
+	userData, exists := try.To2(registeredUser(username,
+		r.Header.Get(ceremony.BootstrapHeader)))
 
 	displayName := strings.Split(username, "@")[0]
 	if !exists {
+		urlParams := r.URL.Query()
+		if username == findyAdmin {
+			try.To(verifyAdminBootstrap(r.Header.Get(ceremony.BootstrapHeader)))
+		}
 		glog.V(2).Infoln("adding new user:", displayName)
 
-		urlParams := r.URL.Query()
 		seed := urlParams.Get("seed")
 		if seed == "" {
 			glog.V(5).Infoln("no seed supplied")
@@ -418,15 +854,16 @@ func oldBeginRegistration(w http.ResponseWriter, r *http.Request) {
 		userData = user.New(username, displayName, seed)
 		try.To(enclave.PutUser(userData))
 		userCreated = true
-	} else if !jwt.IsValidUser(userData.DID, r.Header["Authorization"]) {
+	} else if err := authorizeNewAuthenticator(w, r, userData,
+		r.URL.Query().Get("code")); err != nil {
 		glog.Warningln("new ator, invalid JWT", userData.DID, displayName)
-		err2.Throwf("%w: invalid token", errBadRequest)
-		return
+		try.To(err)
 	}
 
 	registerOptions := func(credCreationOpts *protocol.PublicKeyCredentialCreationOptions) {
 		credCreationOpts.CredentialExcludeList = userData.CredentialExcludeList()
 		glog.V(1).Infoln("credexcl:", len(credCreationOpts.CredentialExcludeList))
+		policy.apply(credCreationOpts)
 	}
 
 	defer err2.Handle(&err,
@@ -449,7 +886,10 @@ func oldBeginRegistration(w http.ResponseWriter, r *http.Request) {
 	glog.V(1).Infof("sessionData: %v", sessionData)
 
 	glog.V(1).Infoln("store session data")
-	try.To(sessionStore.SaveWebauthnSession("registration", sessionData, r, w))
+	try.To(saveCeremony("registration", sessionData, registrationState{
+		Policy:      policy,
+		UserCreated: userCreated,
+	}, r, w))
 
 	jsonResponse(w, options, nil)
 	glog.V(1).Infoln("begin registration end", username)
@@ -478,9 +918,15 @@ func oldFinishRegistration(w http.ResponseWriter, r *http.Request) {
 	assert.That(ok)
 	glog.V(1).Infoln("finish registration", username)
 
+	var (
+		credID      []byte
+		state       registrationState
+		sessionData webauthn.SessionData
+	)
 	defer err2.Handle(&err,
 		func(err error) error {
-			try.Out(enclave.RemoveUser(username)).
+			try.Out(rollbackRegistration(username, sessionData.UserID,
+				credID, state.UserCreated)).
 				Logf("cannot cleanup (%s)", username)
 			return err
 		},
@@ -492,14 +938,20 @@ func oldFinishRegistration(w http.ResponseWriter, r *http.Request) {
 	user := try.To1(enclave.GetExistingUser(username))
 
 	glog.V(1).Infoln("get session data for registration")
-	sessionData := try.To1(sessionStore.GetWebauthnSession("registration", r))
+	sessionData = try.To1(getCeremony("registration", &state, r))
 
 	glog.V(1).Infoln("call web authn finish registration and getting credential")
-	credential := try.To1(webAuthn.FinishRegistration(user, sessionData, r))
+	credential := try.To1(finishRegistration(user, sessionData, state.Policy, r))
+	credID = credential.ID
 
 	user.AddCredential(*credential)
-	try.To(user.AllocateCloudAgent(findyAdmin, time.Duration(timeoutSecs)*time.Second)) //nolint: contextcheck
+	user.ReRegistration = nil
+	allocateCloudAgent(r.Context(), user)
 	try.To(enclave.PutUser(user))
+	if user.Name == findyAdmin {
+		consumeAdminBootstrap()
+	}
+	setOnboardingID(w, user)
 
 	jsonResponse(w, "Registration Success", nil)
 	glog.V(1).Infoln("END finish registration", username)
@@ -519,8 +971,9 @@ func oldBeginLogin(w http.ResponseWriter, r *http.Request) {
 	defer err2.Handle(&err, markErrInternal)
 
 	user := try.To1(enclave.GetExistingUser(username))
+	try.To(requireEnabled(user))
 	options, sessionData := try.To2(webAuthn.BeginLogin(user))
-	err = sessionStore.SaveWebauthnSession("authentication", sessionData, r, w)
+	err = saveWebauthnSession("authentication", sessionData, r, w)
 
 	jsonResponse(w, options, nil)
 	glog.V(1).Infoln("END begin login", username)
@@ -540,15 +993,15 @@ func oldFinishLogin(w http.ResponseWriter, r *http.Request) {
 	defer err2.Handle(&err, markErrInternal)
 
 	user := try.To1(enclave.GetExistingUser(username))
+	try.To(requireEnabled(user))
 
-	sessionData := try.To1(sessionStore.GetWebauthnSession("authentication", r))
+	sessionData := try.To1(getWebauthnSession("authentication", r))
 
-	// in an actual implementation, we should perform additional checks on
-	// the returned 'credential', i.e. check 'credential.Authenticator.CloneWarning'
-	// and then increment the credentials counter
-	try.To1(webAuthn.FinishLogin(user, sessionData, r))
+	credential := try.To1(webAuthn.FinishLogin(user, sessionData, r))
+	try.To(updateLoginCredential(user, credential))
+	try.To(requireDID(w, user))
 
-	jsonResponse(w, &AccessToken{Token: user.JWT()}, nil)
+	jsonResponse(w, try.To1(loginTokens(user, credential, "")), nil)
 	glog.V(1).Infoln("END finish login", username)
 }
 
@@ -581,12 +1034,44 @@ func setupEnv() {
 		"\nRPID ==", rpID,
 	)
 
+	switch clonePolicy {
+	case clonePolicyLog, clonePolicyReject, clonePolicyDisable:
+	default:
+		err2.Throwf("unknown clone policy: %s", clonePolicy)
+	}
+
+	try.To(initRegistrationPolicies())
+	try.To(checkAttestationPolicy(mdsFile, aaguidsAllow, aaguidsDeny))
+	try.To(mds.Init(mdsFile, mdsRoot))
+	try.To(mds.SetAAGUIDLists(aaguidsAllow, aaguidsDeny))
+
 	try.To(enclave.InitSealedBox(enclaveFile, enclaveBackup, enclaveKey))
-	user.Init(certPath, agencyAddr, agencyPort, agencyInsecure)
+	try.To(setupAdminBootstrap())
+	user.SetAllocator(try.To1(user.NewAllocator(allocatorKind, localDIDMethod)))
+	if allocatorKind == user.AllocatorGRPC {
+		user.Init(certPath, agencyAddr, agencyPort, agencyInsecure)
+	} else {
+		glog.V(1).Infoln("cloud agent allocator:", allocatorKind)
+	}
 
 	if jwtSecret != "" {
 		jwt.SetJWTSecret(jwtSecret)
+		token.SetSecret(jwtSecret)
 	}
+	try.To(token.Init(jwtKeys))
+	try.To(token.CheckSigning())
+	token.SetRevocationCheck(isRevoked)
+	try.To(setupIntrospection())
+	try.To(setupOIDC())
+	if introspectClientCA != "" && !isHTTPS {
+		glog.Warningln("introspection client certificates need -local-tls")
+	}
+	try.To(token.Configure(token.Config{
+		Lifetime: accessLifetime(),
+		Issuer:   jwtIssuer,
+		Audience: splitList(jwtAudience),
+		Claims:   splitList(jwtClaims),
+	}))
 
 	webAuthn = try.To1(webauthn.New(&webauthn.Config{
 		RPDisplayName: "Findy Agency", // Display Name for your site
@@ -594,8 +1079,121 @@ func setupEnv() {
 		// The origins for WebAuthn requests
 		// e.g. http://localhost:8888 or android:apk-key-hash:xxx
 		RPOrigins: origins,
+
+		AttestationPreference: protocol.ConveyancePreference(attestation),
 	}))
-	sessionStore = try.To1(session.NewStore())
+	sessionStore = try.To1(session.NewStore(try.To1(sessionKeyPairs())...))
+	sessionStore.Ceremonies = session.NewCeremonyStore(
+		time.Duration(ceremonyTimeoutSecs)*time.Second, enclaveCeremonies{})
+}
+
+// enclaveCeremonies persists the ceremonies to the enclave, which is why they
+// survive the restarts.
+type enclaveCeremonies struct{}
+
+func (enclaveCeremonies) PutCeremony(key string, data []byte) error {
+	return enclave.PutCeremony(key, data)
+}
+
+func (enclaveCeremonies) GetCeremony(key string) ([]byte, bool, error) {
+	return enclave.GetCeremony(key)
+}
+
+func (enclaveCeremonies) RemoveCeremony(key string) error {
+	return enclave.RemoveCeremony(key)
+}
+
+func (enclaveCeremonies) GetCeremonies() ([][]byte, error) {
+	return enclave.GetCeremonies()
+}
+
+// envSessionKeys is the environment variable for the session cookie keys,
+// which is used when the keys aren't given with the flags.
+const envSessionKeys = "FAA_SESSION_KEYS"
+
+// sessionKeyPairs returns the session cookie keys from the file, the flag or
+// the environment in this order.
+func sessionKeyPairs() (keyPairs [][]byte, err error) {
+	defer err2.Handle(&err)
+
+	switch {
+	case sessionKeysFile != "":
+		keyPairs = try.To1(session.LoadKeyPairs(sessionKeysFile))
+	case sessionKeys != "":
+		keyPairs = try.To1(session.ParseKeyPairs(sessionKeys))
+	default:
+		keyPairs = try.To1(session.ParseKeyPairs(os.Getenv(envSessionKeys)))
+	}
+	if len(keyPairs) == 0 {
+		glog.Warningln("session cookie keys are ephemeral, cookies are " +
+			"invalid after restart, use -session-keys")
+	} else {
+		glog.V(1).Infof("%d session cookie key(s) in use", len(keyPairs)/2)
+	}
+	return keyPairs, nil
+}
+
+// saveWebauthnSession saves the ceremony and returns its ID in the
+// ceremony.Header. The ID is stored to the session cookie as well,
+// unless the client uses the cookie-less token mode.
+func saveWebauthnSession(
+	key string,
+	sessionData *webauthn.SessionData,
+	r *http.Request,
+	w http.ResponseWriter,
+) (err error) {
+	return saveCeremony(key, sessionData, nil, r, w)
+}
+
+// saveCeremony saves the ceremony with our own state of it, see
+// saveWebauthnSession. The state is stored as JSON, and it can be nil.
+func saveCeremony(
+	key string,
+	sessionData *webauthn.SessionData,
+	state any,
+	r *http.Request,
+	w http.ResponseWriter,
+) (err error) {
+	defer err2.Handle(&err)
+
+	var stateData []byte
+	if state != nil {
+		stateData = try.To1(json.Marshal(state))
+	}
+	var id string
+	if r.Header.Get(ceremony.ModeHeader) == ceremony.ModeToken {
+		id = try.To1(sessionStore.Ceremonies.Put(key, sessionData, stateData))
+	} else {
+		id = try.To1(sessionStore.SaveWebauthnSession(key, sessionData,
+			stateData, r, w))
+	}
+	w.Header().Set(ceremony.Header, id)
+	return nil
+}
+
+// getWebauthnSession takes the ceremony. If the client doesn't send the
+// ceremony ID, the latest ceremony ID is taken from the session cookie.
+func getWebauthnSession(key string, r *http.Request) (webauthn.SessionData, error) {
+	return getCeremony(key, nil, r)
+}
+
+// getCeremony takes the ceremony like getWebauthnSession, and reads our own
+// state of it to the state if it isn't nil. The state is required then.
+func getCeremony(key string, state any, r *http.Request) (
+	_ webauthn.SessionData,
+	err error,
+) {
+	defer err2.Handle(&err)
+
+	c := try.To1(sessionStore.GetWebauthnSession(key,
+		r.Header.Get(ceremony.Header), r))
+	if state != nil {
+		if len(c.State) == 0 {
+			return c.SessionData, fmt.Errorf("%s ceremony state missing", key)
+		}
+		try.To(json.Unmarshal(c.State, state))
+	}
+	return c.SessionData, nil
 }
 
 const (
@@ -604,6 +1202,41 @@ const (
 	urlBeginRegister  = "/attestation/options"
 	urlFinishRegister = "/attestation/result"
 
+	urlBeginStepUp  = "/stepup/options"
+	urlFinishStepUp = "/stepup/result"
+
+	urlBeginTransaction  = "/transaction/options"
+	urlFinishTransaction = "/transaction/result"
+	urlTransaction       = "/transaction/receipts/{receiptID}"
+
+	urlCredentials = "/credentials/{username}"
+	urlCredential  = "/credentials/{username}/{credID}"
+	urlUser        = "/users/{username}"
+	urlOnboarding  = "/onboarding/{onboardingID}"
+
+	urlAdminUsers          = "/admin/users"
+	urlAdminUser           = "/admin/users/{username}"
+	urlAdminUserDisable    = "/admin/users/{username}/disable"
+	urlAdminUserEnable     = "/admin/users/{username}/enable"
+	urlAdminUserReRegister = "/admin/users/{username}/reregister"
+	urlAdminCredential     = "/admin/users/{username}/credentials/{credID}"
+	urlAdminDID            = "/admin/dids/{did}"
+	urlAdminDeletions      = "/admin/deletions"
+	urlAdminOffboardings   = "/admin/offboardings"
+
+	urlJWKS    = "/.well-known/jwks.json"
+	urlRefresh = "/token/refresh"
+	urlLogout  = "/logout"
+	urlRevoked = "/token/revoked"
+
+	urlIntrospect = "/token/introspect"
+
+	urlOIDCDiscovery = "/.well-known/openid-configuration"
+	urlOIDCAuthorize = "/oidc/authorize"
+	urlOIDCRequest   = "/oidc/request/{requestID}"
+	urlOIDCToken     = "/oidc/token"
+	urlOIDCUserinfo  = "/oidc/userinfo"
+
 	urlOldBeginRegister  = "/register/begin/{username}"
 	urlOldFinishRegister = "/register/finish/{username}"
 	urlOldBeginLogin     = "/login/begin/{username}"
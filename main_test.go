@@ -13,11 +13,17 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/findy-network/findy-agent-auth/acator"
+	"github.com/findy-network/findy-agent-auth/acator/authn"
+	"github.com/findy-network/findy-agent-auth/ceremony"
+	"github.com/findy-network/findy-agent-auth/enclave"
+	"github.com/findy-network/findy-agent-auth/token"
 	"github.com/findy-network/findy-agent-auth/user"
 	ops "github.com/findy-network/findy-common-go/grpc/ops/v1"
 	"github.com/findy-network/findy-common-go/rpc"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/golang/glog"
 	"github.com/lainio/err2"
 	"github.com/lainio/err2/assert"
@@ -87,6 +93,59 @@ func TestEndpoints(t *testing.T) {
 		}
 		doTest(t, ti)
 	})
+	t.Run("discoverable-register", func(t *testing.T) {
+		defer assert.PushTester(t)()
+		ti := &testInfo{
+			sendPL: try.To1(json.Marshal(userInfo{
+				Username:    "discoverable-user",
+				ResidentKey: "required",
+			})),
+			methods:   []string{"POST", "POST"},
+			endpoints: []string{urlBeginRegister, urlFinishRegister},
+			envelope:  []string{`{"publicKey": %s}`, `{"publicKey": %s}`},
+			calls: []func(w http.ResponseWriter, r *http.Request){
+				BeginRegistration, FinishRegistration,
+			},
+			buildCalls: []func(i *acator.Instance, jsonStream io.Reader) (io.Reader, error){
+				acator.Register,
+			},
+		}
+		doTest(t, ti)
+	})
+	t.Run("discoverable-login", func(t *testing.T) {
+		defer assert.PushTester(t)()
+		ti := &testInfo{
+			sendPL:    try.To1(json.Marshal(loginUserInfo{})),
+			methods:   []string{"POST", "POST"},
+			endpoints: []string{urlBeginLogin, urlFinishLogin},
+			envelope:  []string{`{"publicKey": %s}`, `{"publicKey": %s}`},
+			calls: []func(w http.ResponseWriter, r *http.Request){
+				BeginLogin, FinishLogin,
+			},
+			buildCalls: []func(i *acator.Instance, jsonStream io.Reader) (io.Reader, error){
+				acator.Login,
+			},
+		}
+		doTest(t, ti)
+	})
+	t.Run("conditional-login", func(t *testing.T) {
+		defer assert.PushTester(t)()
+		ti := &testInfo{
+			sendPL: try.To1(json.Marshal(loginUserInfo{
+				Mediation: mediationConditional,
+			})),
+			methods:   []string{"POST", "POST"},
+			endpoints: []string{urlBeginLogin, urlFinishLogin},
+			envelope:  []string{`{"publicKey": %s}`, `{"publicKey": %s}`},
+			calls: []func(w http.ResponseWriter, r *http.Request){
+				BeginLogin, FinishLogin,
+			},
+			buildCalls: []func(i *acator.Instance, jsonStream io.Reader) (io.Reader, error){
+				acator.Login,
+			},
+		}
+		doTest(t, ti)
+	})
 
 	t.Run("old-register", func(t *testing.T) {
 		defer assert.PushTester(t)()
@@ -124,6 +183,53 @@ func TestEndpoints(t *testing.T) {
 	})
 }
 
+func TestUpdateLoginCredential(t *testing.T) {
+	defer func(p string) { clonePolicy = p }(clonePolicy)
+
+	tests := []struct {
+		name     string
+		policy   string
+		clone    bool
+		wantErr  bool
+		disabled bool
+	}{
+		{"no clone", clonePolicyReject, false, false, false},
+		{"log", clonePolicyLog, true, false, false},
+		{"reject", clonePolicyReject, true, true, false},
+		{"disable", clonePolicyDisable, true, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer assert.PushTester(t)()
+
+			name := "clone-" + strings.ReplaceAll(tt.name, " ", "-")
+			u := user.New(name, name, "")
+			u.AddCredential(webauthn.Credential{ID: []byte(name)})
+			try.To(enclave.PutUser(u))
+
+			clonePolicy = tt.policy
+			cred := webauthn.Credential{ID: []byte(name)}
+			cred.Authenticator.SignCount = 5
+			cred.Authenticator.CloneWarning = tt.clone
+			err := updateLoginCredential(u, &cred)
+			if tt.wantErr {
+				assert.Error(err)
+				w := httptest.NewRecorder()
+				jsonResponse(w, err.Error(), markErrInternal(err))
+				assert.Equal(w.Code, http.StatusBadRequest)
+			} else {
+				assert.NoError(err)
+			}
+
+			stored := try.To1(enclave.GetExistingUser(name))
+			assert.SLen(stored.Credentials, 1)
+			assert.Equal(stored.Credentials[0].Authenticator.SignCount, uint32(5))
+			assert.Equal(stored.Credentials[0].Authenticator.CloneWarning, tt.clone)
+			assert.Equal(stored.IsDisabledCredential(cred.ID), tt.disabled)
+		})
+	}
+}
+
 type testInfo struct {
 	sendPL     []byte
 	methods    []string
@@ -183,6 +289,7 @@ func setUp() {
 	enclaveFile = "MEMORY_enc.bolt"
 	enclaveBackup = ""
 	enclaveKey = ""
+	jwtSecret = "test-jwt-secret"
 
 	rpOrigin = defaultOrigin
 	acator.SetDefInstanceOrigin(defaultOrigin)
@@ -209,11 +316,12 @@ func (d agencyServer) PSMHook(*ops.DataHook, ops.AgencyService_PSMHookServer) er
 	return status.Errorf(codes.Unimplemented, "method PSMHook not implemented")
 }
 
-func (d agencyServer) Onboard(context.Context, *ops.Onboarding) (*ops.OnboardResult, error) {
+// Onboard returns the unique DID for every user like the real agency.
+func (d agencyServer) Onboard(_ context.Context, o *ops.Onboarding) (*ops.OnboardResult, error) {
 	return &ops.OnboardResult{
 		Ok: true,
 		Result: &ops.OnboardResult_OKResult{
-			CADID: "CADID",
+			CADID: "CADID-" + o.GetEmail(),
 		},
 	}, nil
 }
@@ -248,3 +356,345 @@ func dialer() func(context.Context, string) (net.Conn, error) {
 		return listener.Dial()
 	}
 }
+
+func TestRollbackRegistration(t *testing.T) {
+	tests := []struct {
+		name      string
+		created   bool
+		did       bool
+		reReg     bool
+		otherID   bool
+		creds     []string
+		credID    string
+		wantExist bool
+		wantCreds int
+	}{
+		{"created user without credential", true, false, false, false, nil, "", false, 0},
+		{"created user with stored credential", true, false, false, false, []string{"new"}, "new", false, 0},
+		{"created user onboarded", true, true, false, false, []string{"old"}, "new", true, 1},
+		{"created user re-registering", true, false, true, false, nil, "", true, 0},
+		{"created user replaced", true, false, false, true, nil, "", true, 0},
+		{"created user with other credential", true, false, false, false, []string{"old", "new"}, "new", true, 1},
+		{"existing user before stored", false, true, false, false, []string{"old"}, "new", true, 1},
+		{"existing user without new credential", false, true, false, false, []string{"old"}, "", true, 1},
+		{"existing user with stored credential", false, true, false, false, []string{"old", "new"}, "new", true, 1},
+		{"existing user without credentials", false, true, false, false, nil, "", true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer assert.PushTester(t)()
+
+			name := "rollback-" + strings.ReplaceAll(tt.name, " ", "-")
+			u := user.New(name, name, "")
+			if tt.did {
+				u.DID = "did-" + name
+			}
+			if tt.reReg {
+				_ = try.To1(u.ForceReRegistration(time.Hour))
+			}
+			for _, id := range tt.creds {
+				u.AddCredential(webauthn.Credential{ID: []byte(id)})
+			}
+			try.To(enclave.PutUser(u))
+			defer func() { _ = enclave.RemoveUser(name) }()
+
+			userID := u.WebAuthnID()
+			if tt.otherID {
+				userID = user.New(name, name, "").WebAuthnID()
+			}
+			var credID []byte
+			if tt.credID != "" {
+				credID = []byte(tt.credID)
+			}
+			assert.NoError(rollbackRegistration(name, userID, credID, tt.created))
+
+			stored, exists := try.To2(enclave.GetUser(name))
+			assert.Equal(exists, tt.wantExist)
+			if tt.wantExist {
+				assert.SLen(stored.Credentials, tt.wantCreds)
+				if tt.wantCreds > 0 {
+					assert.Equal(string(stored.Credentials[0].ID), "old")
+				}
+				assert.Equal(stored.DID, u.DID)
+			}
+		})
+	}
+}
+
+func TestAddAuthenticator(t *testing.T) {
+	const name = "add-ator-user"
+
+	register := func(t *testing.T, token string, finish func(io.Reader) io.Reader) int {
+		t.Helper()
+
+		req := httptest.NewRequest("POST", urlBeginRegister, bytes.NewReader(
+			try.To1(json.Marshal(userInfo{Username: name}))))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		BeginRegistration(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		data := try.To1(io.ReadAll(res.Body))
+		assert.Equal(res.StatusCode, http.StatusOK)
+
+		repl := finish(bytes.NewBufferString(fmt.Sprintf(`{"publicKey": %s}`, data)))
+		req2 := httptest.NewRequest("POST", urlFinishRegister, repl)
+		req2.Header = http.Header{"Cookie": res.Header["Set-Cookie"]}
+		w = httptest.NewRecorder()
+		FinishRegistration(w, req2)
+		res2 := w.Result()
+		defer res2.Body.Close()
+		return res2.StatusCode
+	}
+	validFinish := func(r io.Reader) io.Reader {
+		return try.To1(acator.Register(nil, r))
+	}
+	brokenFinish := func(io.Reader) io.Reader {
+		return strings.NewReader(`{"id":"broken"}`)
+	}
+
+	t.Run("new user failure removes user", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		assert.NotEqual(register(t, "", brokenFinish), http.StatusOK)
+		_, exists := try.To2(enclave.GetUser(name))
+		assert.That(!exists)
+	})
+	t.Run("new user", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		assert.Equal(register(t, "", validFinish), http.StatusOK)
+	})
+
+	u := try.To1(enclave.GetExistingUser(name))
+	ts, _ := try.To2(token.IssueElevated(u.DID, u.DisplayName,
+		&token.Auth{Time: time.Now()}, time.Minute))
+
+	t.Run("existing user needs step-up", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		req := httptest.NewRequest("POST", urlBeginRegister, bytes.NewReader(
+			try.To1(json.Marshal(userInfo{Username: name}))))
+		req.Header.Set("Authorization", "Bearer "+
+			try.To1(token.Build(u.DID, u.DisplayName, nil)))
+		w := httptest.NewRecorder()
+		BeginRegistration(w, req)
+		assert.Equal(w.Code, http.StatusUnauthorized)
+		assert.That(strings.Contains(w.Header().Get("WWW-Authenticate"),
+			"insufficient_user_authentication"))
+	})
+	t.Run("existing user failure keeps user", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		assert.NotEqual(register(t, ts, brokenFinish), http.StatusOK)
+		stored := try.To1(enclave.GetExistingUser(name))
+		assert.SLen(stored.Credentials, 1)
+		assert.That(bytes.Equal(stored.Credentials[0].ID, u.Credentials[0].ID))
+		assert.Equal(stored.DID, u.DID)
+	})
+	t.Run("existing user adds authenticator", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		assert.Equal(register(t, ts, validFinish), http.StatusOK)
+		stored := try.To1(enclave.GetExistingUser(name))
+		assert.SLen(stored.Credentials, 2)
+		assert.Equal(stored.DID, u.DID)
+	})
+}
+
+func TestConcurrentRegistration(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	const name = "concurrent-registration-user"
+	defer func() { _ = enclave.RemoveUser(name) }()
+
+	begin := func() *http.Response {
+		req := httptest.NewRequest("POST", urlBeginRegister, bytes.NewReader(
+			try.To1(json.Marshal(userInfo{Username: name}))))
+		w := httptest.NewRecorder()
+		BeginRegistration(w, req)
+		return w.Result()
+	}
+	res := begin()
+	defer res.Body.Close()
+	assert.Equal(res.StatusCode, http.StatusOK)
+	data := try.To1(io.ReadAll(res.Body))
+
+	// the second begin doesn't replace the user of the first ceremony
+	res2 := begin()
+	defer res2.Body.Close()
+	assert.Equal(res2.StatusCode, http.StatusConflict)
+
+	repl := try.To1(acator.Register(nil,
+		bytes.NewBufferString(fmt.Sprintf(`{"publicKey": %s}`, data))))
+	req := httptest.NewRequest("POST", urlFinishRegister, repl)
+	req.Header = http.Header{"Cookie": res.Header["Set-Cookie"]}
+	w := httptest.NewRecorder()
+	FinishRegistration(w, req)
+	assert.Equal(w.Result().StatusCode, http.StatusOK)
+	assert.That(try.To1(enclave.GetExistingUser(name)).IsRegistered())
+}
+
+func TestParallelCeremonies(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	type regCeremony struct {
+		id      string
+		options string
+	}
+	var cookies []string
+	begin := func(name string) regCeremony {
+		req := httptest.NewRequest("POST", urlBeginRegister, bytes.NewReader(
+			try.To1(json.Marshal(userInfo{Username: name}))))
+		req.Header = http.Header{"Cookie": cookies}
+		w := httptest.NewRecorder()
+		BeginRegistration(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		assert.Equal(res.StatusCode, http.StatusOK)
+		cookies = res.Header["Set-Cookie"]
+		return regCeremony{
+			id:      res.Header.Get(ceremony.Header),
+			options: string(try.To1(io.ReadAll(res.Body))),
+		}
+	}
+	finish := func(c regCeremony, id string) int {
+		repl := try.To1(acator.Register(nil, bytes.NewBufferString(
+			fmt.Sprintf(`{"publicKey": %s}`, c.options))))
+		req := httptest.NewRequest("POST", urlFinishRegister, repl)
+		req.Header = http.Header{"Cookie": cookies}
+		if id != "" {
+			req.Header.Set(ceremony.Header, id)
+		}
+		w := httptest.NewRecorder()
+		FinishRegistration(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		return res.StatusCode
+	}
+
+	first := begin("parallel-user-1")
+	second := begin("parallel-user-2")
+	assert.NotEqual(first.id, "")
+	assert.NotEqual(first.id, second.id)
+
+	// the cookie points to the latest ceremony, the header selects the other
+	assert.Equal(finish(first, first.id), http.StatusOK)
+	assert.Equal(finish(second, ""), http.StatusOK)
+
+	// challenges are single use
+	assert.NotEqual(finish(first, first.id), http.StatusOK)
+	assert.NotEqual(finish(second, ""), http.StatusOK)
+}
+
+func TestAuthnCmdWithoutCookies(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	var cookies, ceremonies int
+	mux := newMuxWithRoutes()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(ceremony.Header) != "" {
+			ceremonies++
+		}
+		mux.ServeHTTP(w, r)
+		cookies += len(w.Header()["Set-Cookie"])
+	}))
+	defer server.Close()
+
+	cmd := authn.Cmd{
+		SubCmd:   "register",
+		UserName: "authn-cmd-user",
+		URL:      server.URL,
+		AAGUID:   "12c85a48-4baf-47bd-b51f-f192871a1511",
+		Key:      "15308490f1e4026284594dd08d31291bc8ef2aeac730d0daf6ff87bb92d4336c",
+		Origin:   defaultOrigin,
+	}
+	_ = try.To1(cmd.Exec(nil))
+
+	cmd.SubCmd = "login"
+	r := try.To1(cmd.Exec(nil))
+	assert.NotEmpty(r.Token)
+
+	assert.Equal(cookies, 0)
+	assert.Equal(ceremonies, 2)
+}
+
+func TestStepUp(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	server := httptest.NewServer(newMuxWithRoutes())
+	defer server.Close()
+
+	cmd := authn.Cmd{
+		SubCmd:   "register",
+		UserName: "stepup-user",
+		URL:      server.URL,
+		AAGUID:   "12c85a48-4baf-47bd-b51f-f192871a1511",
+		Key:      "15308490f1e4026284594dd08d31291bc8ef2aeac730d0daf6ff87bb92d4336c",
+		Origin:   defaultOrigin,
+	}
+	_ = try.To1(cmd.Exec(nil))
+
+	tokenOf := func(r authn.Result) string {
+		var at AccessToken
+		try.To(json.Unmarshal([]byte(r.Token), &at))
+		return at.Token
+	}
+
+	cmd.SubCmd = "login"
+	loginToken := tokenOf(try.To1(cmd.Exec(nil)))
+	assert.ThatNot(try.To1(token.Parse(loginToken)).Elevated())
+
+	// the new authenticator needs the elevated token
+	device := cmd
+	device.SubCmd = "register"
+	device.Key = "4db9d1e5f05ad5a9c1c1ba1ce5ab7bf5a2abb8f0c3b5cd8f6d3a1e5c4b2a1908"
+	device.Token = loginToken
+	_, err := device.Exec(nil)
+	assert.Error(err)
+
+	cmd.SubCmd = "stepup"
+	cmd.Token = loginToken
+	elevated := tokenOf(try.To1(cmd.Exec(nil)))
+	claims := try.To1(token.Parse(elevated))
+	assert.That(claims.Elevated())
+	assert.That(time.Until(claims.ExpiresAt.Time) <= stepUpLifetime())
+
+	device.Token = elevated
+	_ = try.To1(device.Exec(nil))
+	u := try.To1(enclave.GetExistingUser("stepup-user"))
+	assert.SLen(u.Credentials, 2)
+
+	res := try.To1(http.Post(server.URL+urlBeginStepUp, "application/json",
+		strings.NewReader("{}")))
+	defer res.Body.Close()
+	assert.Equal(res.StatusCode, http.StatusBadRequest)
+}
+
+func TestLocalAllocator(t *testing.T) {
+	defer assert.PushTester(t)()
+	defer user.SetAllocator(user.GRPCAllocator{})
+
+	user.SetAllocator(try.To1(user.NewAllocator(user.AllocatorLocal, user.DIDMethodPeer)))
+	server := httptest.NewServer(newMuxWithRoutes())
+	defer server.Close()
+
+	cmd := authn.Cmd{
+		SubCmd:   "register",
+		UserName: "local-allocator-user",
+		URL:      server.URL,
+		AAGUID:   "12c85a48-4baf-47bd-b51f-f192871a1511",
+		Key:      "15308490f1e4026284594dd08d31291bc8ef2aeac730d0daf6ff87bb92d4336c",
+		Origin:   defaultOrigin,
+	}
+	_ = try.To1(cmd.Exec(nil))
+	cmd.SubCmd = "login"
+	var at AccessToken
+	try.To(json.Unmarshal([]byte(try.To1(cmd.Exec(nil)).Token), &at))
+
+	u := try.To1(enclave.GetExistingUser("local-allocator-user"))
+	assert.That(strings.HasPrefix(u.DID, "did:peer:0z"), u.DID)
+	assert.Equal(try.To1(token.Parse(at.Token)).Username, u.DID)
+}
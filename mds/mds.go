@@ -0,0 +1,323 @@
+/*
+Package mds implements the authenticator attestation policy of the server. The
+policy is based on the FIDO Metadata Service (MDS3) BLOB and AAGUID allow and
+deny lists.
+
+The BLOB is read from the local file, which means that the server doesn't need
+access to the FIDO Alliance's MDS endpoint. The file is refreshed from the disk
+when it changes. Its signature is verified against the MDS root certificate.
+*/
+package mds
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+var (
+	// ErrNotAllowed is returned when the authenticator isn't allowed by the
+	// AAGUID lists or the metadata.
+	ErrNotAllowed = errors.New("authenticator not allowed")
+
+	// ErrNoAttestation is returned when the metadata is in use but the
+	// attestation statement doesn't carry the attestation certificate.
+	ErrNoAttestation = errors.New("attestation certificate required")
+
+	// ErrStale is returned when the BLOB's nextUpdate date has passed, i.e.
+	// the metadata is outdated and it's not updated.
+	ErrStale = errors.New("metadata BLOB is stale")
+)
+
+type store struct {
+	sync.RWMutex
+
+	filename string
+	rootFile string
+	modTime  time.Time
+
+	nextUpdate time.Time
+
+	entries map[uuid.UUID]metadata.MetadataBLOBPayloadEntry
+	allow   map[uuid.UUID]struct{}
+	deny    map[uuid.UUID]struct{}
+}
+
+var theStore = &store{}
+
+// Init loads the MDS3 BLOB from the file. The rootFile is the PEM or DER file
+// of the MDS root certificate. If it's empty the FIDO Alliance's production
+// root is used. If the filename is empty, the metadata isn't used.
+func Init(filename, rootFile string) (err error) {
+	defer err2.Handle(&err, "mds init")
+
+	theStore.Lock()
+	defer theStore.Unlock()
+
+	theStore.filename = filename
+	theStore.rootFile = rootFile
+	theStore.entries = nil
+	theStore.modTime = time.Time{}
+	theStore.nextUpdate = time.Time{}
+	if filename == "" {
+		return nil
+	}
+	try.To(theStore.load())
+	return nil
+}
+
+// SetAAGUIDLists sets the allow and deny lists. The lists are comma separated
+// AAGUIDs. An empty allow list allows all the authenticators which aren't
+// denied.
+func SetAAGUIDLists(allow, deny string) (err error) {
+	defer err2.Handle(&err, "aaguid lists")
+
+	allowSet := try.To1(parseAAGUIDs(allow))
+	denySet := try.To1(parseAAGUIDs(deny))
+
+	theStore.Lock()
+	defer theStore.Unlock()
+	theStore.allow, theStore.deny = allowSet, denySet
+	return nil
+}
+
+// RefreshTicker checks with the interval if the BLOB file is changed and
+// reloads it. If the reload fails, we keep using the previous version.
+func RefreshTicker(interval time.Duration) (done chan<- struct{}) {
+	if theStore.filename == "" {
+		return nil
+	}
+	ticker := time.NewTicker(interval)
+	doneCh := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-doneCh:
+				return
+			case <-ticker.C:
+				if err := refresh(); err != nil {
+					glog.Errorln("mds refresh:", err)
+				}
+			}
+		}
+	}()
+	return doneCh
+}
+
+func refresh() (err error) {
+	defer err2.Handle(&err)
+
+	theStore.Lock()
+	defer theStore.Unlock()
+
+	info := try.To1(os.Stat(theStore.filename))
+	if !info.ModTime().After(theStore.modTime) {
+		return nil
+	}
+	glog.V(1).Infoln("mds file changed, reloading", theStore.filename)
+	return theStore.load()
+}
+
+// Verify checks the attestation object of the registration against the policy.
+func Verify(obj *protocol.AttestationObject) (err error) {
+	defer err2.Handle(&err, "mds verify")
+
+	aaguid := try.To1(uuid.FromBytes(obj.AuthData.AttData.AAGUID))
+
+	theStore.RLock()
+	defer theStore.RUnlock()
+
+	if _, denied := theStore.deny[aaguid]; denied {
+		return fmt.Errorf("%w: %s is denied", ErrNotAllowed, aaguid)
+	}
+	if _, allowed := theStore.allow[aaguid]; len(theStore.allow) > 0 && !allowed {
+		return fmt.Errorf("%w: %s isn't allowed", ErrNotAllowed, aaguid)
+	}
+	if theStore.entries == nil {
+		return nil
+	}
+	if time.Now().After(theStore.nextUpdate) {
+		return fmt.Errorf("%w: next update %s", ErrStale,
+			theStore.nextUpdate.Format(time.DateOnly))
+	}
+
+	entry, found := theStore.entries[aaguid]
+	if !found {
+		return fmt.Errorf("%w: %s not in metadata", ErrNotAllowed, aaguid)
+	}
+	for _, report := range entry.StatusReports {
+		if metadata.IsUndesiredAuthenticatorStatus(report.Status) {
+			return fmt.Errorf("%w: %s status %s", ErrNotAllowed, aaguid, report.Status)
+		}
+	}
+	return verifyAttestationCert(obj, entry)
+}
+
+// verifyAttestationCert verifies that the attestation certificate chains to
+// one of the attestation roots of the metadata entry.
+func verifyAttestationCert(
+	obj *protocol.AttestationObject,
+	entry metadata.MetadataBLOBPayloadEntry,
+) (err error) {
+	defer err2.Handle(&err)
+
+	x5c, ok := obj.AttStatement["x5c"].([]any)
+	if !ok || len(x5c) == 0 {
+		return ErrNoAttestation
+	}
+	certs := make([]*x509.Certificate, 0, len(x5c))
+	for _, c := range x5c {
+		der, ok := c.([]byte)
+		if !ok {
+			return ErrNoAttestation
+		}
+		certs = append(certs, try.To1(x509.ParseCertificate(der)))
+	}
+
+	roots := x509.NewCertPool()
+	for _, root := range entry.MetadataStatement.AttestationRootCertificates {
+		roots.AddCert(try.To1(parseCert(root)))
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	_ = try.To1(certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}))
+	return nil
+}
+
+// load reads and verifies the BLOB file. Caller must hold the lock.
+func (s *store) load() (err error) {
+	defer err2.Handle(&err, "load %s", s.filename)
+
+	info := try.To1(os.Stat(s.filename))
+	data := try.To1(os.ReadFile(s.filename))
+	root := try.To1(s.rootCert())
+
+	payload := try.To1(parseBLOB(strings.TrimSpace(string(data)), root))
+	nextUpdate := try.To1(parseNextUpdate(payload.NextUpdate))
+	if time.Now().After(nextUpdate) {
+		return fmt.Errorf("%w: next update %s", ErrStale, payload.NextUpdate)
+	}
+
+	entries := make(map[uuid.UUID]metadata.MetadataBLOBPayloadEntry, len(payload.Entries))
+	for _, entry := range payload.Entries {
+		if aaguid, err := uuid.Parse(entry.AaGUID); err == nil {
+			entries[aaguid] = entry
+		}
+	}
+	s.entries = entries
+	s.modTime = info.ModTime()
+	s.nextUpdate = nextUpdate
+	glog.V(1).Infof("mds BLOB no %d loaded, %d entries, next update: %s",
+		payload.Number, len(entries), payload.NextUpdate)
+	return nil
+}
+
+func (s *store) rootCert() (_ *x509.Certificate, err error) {
+	defer err2.Handle(&err)
+
+	if s.rootFile == "" {
+		return parseCert(metadata.ProductionMDSRoot)
+	}
+	data := try.To1(os.ReadFile(s.rootFile))
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	return x509.ParseCertificate(data)
+}
+
+// parseBLOB verifies the BLOB JWT's certificate chain and signature, and
+// returns the payload.
+func parseBLOB(blob string, root *x509.Certificate) (
+	payload metadata.MetadataBLOBPayload,
+	err error,
+) {
+	defer err2.Handle(&err)
+
+	token := try.To1(jwt.Parse(blob, func(token *jwt.Token) (any, error) {
+		x5c, ok := token.Header["x5c"].([]any)
+		if !ok || len(x5c) == 0 {
+			return nil, errors.New("x5c missing from BLOB header")
+		}
+		certs := make([]*x509.Certificate, 0, len(x5c))
+		for _, c := range x5c {
+			s, ok := c.(string)
+			if !ok {
+				return nil, errors.New("illegal x5c in BLOB header")
+			}
+			cert, err := parseCert(s)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(root)
+		intermediates := x509.NewCertPool()
+		for _, c := range certs[1:] {
+			intermediates.AddCert(c)
+		}
+		if _, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+		}); err != nil {
+			return nil, err
+		}
+		return certs[0].PublicKey, nil
+	}, jwt.WithValidMethods([]string{"RS256", "ES256", "ES384", "PS256"})))
+
+	claims := try.To1(json.Marshal(token.Claims))
+	try.To(json.Unmarshal(claims, &payload))
+	return payload, nil
+}
+
+// parseNextUpdate parses the nextUpdate date of the BLOB. The BLOB is valid
+// until the end of the day.
+func parseNextUpdate(s string) (_ time.Time, err error) {
+	defer err2.Handle(&err, "next update")
+
+	day := try.To1(time.Parse(time.DateOnly, s))
+	return day.AddDate(0, 0, 1), nil
+}
+
+// parseCert parses base64 (standard encoding) DER encoded certificate.
+func parseCert(s string) (_ *x509.Certificate, err error) {
+	defer err2.Handle(&err)
+
+	der := try.To1(base64.StdEncoding.DecodeString(s))
+	return x509.ParseCertificate(der)
+}
+
+func parseAAGUIDs(list string) (_ map[uuid.UUID]struct{}, err error) {
+	defer err2.Handle(&err)
+
+	set := make(map[uuid.UUID]struct{})
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		set[try.To1(uuid.Parse(s))] = struct{}{}
+	}
+	return set, nil
+}
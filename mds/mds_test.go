@@ -0,0 +1,159 @@
+package mds
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+var (
+	goodAAGUID    = uuid.MustParse("12c85a48-4baf-47bd-b51f-f192871a1511")
+	revokedAAGUID = uuid.MustParse("0bb43545-fd2c-4185-87dd-feb0b2916ace")
+	otherAAGUID   = uuid.MustParse("ee882879-721c-4913-9775-3dfcce97072a")
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newCert(name string, parent *testCA, isCA bool) *testCA {
+	key := try.To1(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	parentCert, parentKey := tmpl, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der := try.To1(x509.CreateCertificate(rand.Reader, tmpl, parentCert,
+		&key.PublicKey, parentKey))
+	return &testCA{cert: try.To1(x509.ParseCertificate(der)), key: key}
+}
+
+func b64(c *testCA) string {
+	return base64.StdEncoding.EncodeToString(c.cert.Raw)
+}
+
+func writeBLOB(t *testing.T, root, signer, attRoot *testCA, nextUpdate string) (blobFile, rootFile string) {
+	t.Helper()
+	dir := t.TempDir()
+
+	entries := []metadata.MetadataBLOBPayloadEntry{
+		{
+			AaGUID: goodAAGUID.String(),
+			MetadataStatement: metadata.MetadataStatement{
+				AttestationRootCertificates: []string{b64(attRoot)},
+			},
+			StatusReports: []metadata.StatusReport{{Status: metadata.FidoCertifiedL1}},
+		},
+		{
+			AaGUID:        revokedAAGUID.String(),
+			StatusReports: []metadata.StatusReport{{Status: metadata.Revoked}},
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"no":         1,
+		"nextUpdate": nextUpdate,
+		"entries":    entries,
+	})
+	token.Header["x5c"] = []string{b64(signer)}
+	blob := try.To1(token.SignedString(signer.key))
+
+	blobFile = filepath.Join(dir, "blob.jwt")
+	try.To(os.WriteFile(blobFile, []byte(blob), 0600))
+	rootFile = filepath.Join(dir, "root.pem")
+	try.To(os.WriteFile(rootFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: root.cert.Raw}), 0600))
+	return blobFile, rootFile
+}
+
+func attObject(aaguid uuid.UUID, certs ...*testCA) *protocol.AttestationObject {
+	obj := &protocol.AttestationObject{
+		Format:       "packed",
+		AttStatement: map[string]any{},
+	}
+	obj.AuthData.AttData.AAGUID = try.To1(aaguid.MarshalBinary())
+	if len(certs) > 0 {
+		x5c := make([]any, 0, len(certs))
+		for _, c := range certs {
+			x5c = append(x5c, c.cert.Raw)
+		}
+		obj.AttStatement["x5c"] = x5c
+	}
+	return obj
+}
+
+func TestVerify(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	root := newCert("MDS root", nil, true)
+	signer := newCert("MDS signer", root, false)
+	attRoot := newCert("attestation root", nil, true)
+	attCert := newCert("attestation", attRoot, false)
+	rogueCert := newCert("rogue", newCert("rogue root", nil, true), false)
+
+	blobFile, rootFile := writeBLOB(t, root, signer, attRoot, "2030-01-01")
+	try.To(Init(blobFile, rootFile))
+	defer func() { _ = Init("", "") }()
+
+	assert.NoError(Verify(attObject(goodAAGUID, attCert)))
+	assert.Error(Verify(attObject(goodAAGUID)))
+	assert.Error(Verify(attObject(goodAAGUID, rogueCert)))
+	assert.Error(Verify(attObject(revokedAAGUID, attCert)))
+	assert.Error(Verify(attObject(otherAAGUID, attCert)))
+
+	// BLOB signed by someone else than MDS root is rejected
+	wrongRoot := newCert("wrong root", nil, true)
+	_, wrongRootFile := writeBLOB(t, wrongRoot, signer, attRoot, "2030-01-01")
+	assert.Error(Init(blobFile, wrongRootFile))
+
+	// BLOB past its next update is rejected
+	staleFile, _ := writeBLOB(t, root, signer, attRoot, "2020-01-01")
+	assert.Error(Init(staleFile, rootFile))
+
+	// BLOB going stale after the load stops the verification
+	try.To(Init(blobFile, rootFile))
+	theStore.nextUpdate = time.Now().Add(-time.Minute)
+	assert.Error(Verify(attObject(goodAAGUID, attCert)))
+}
+
+func TestAAGUIDLists(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	try.To(Init("", ""))
+	defer func() { _ = SetAAGUIDLists("", "") }()
+
+	try.To(SetAAGUIDLists("", revokedAAGUID.String()))
+	assert.NoError(Verify(attObject(goodAAGUID)))
+	assert.Error(Verify(attObject(revokedAAGUID)))
+
+	try.To(SetAAGUIDLists(goodAAGUID.String()+", "+otherAAGUID.String(), ""))
+	assert.NoError(Verify(attObject(goodAAGUID)))
+	assert.NoError(Verify(attObject(otherAAGUID)))
+	assert.Error(Verify(attObject(revokedAAGUID)))
+
+	assert.Error(SetAAGUIDLists("not-uuid", ""))
+}
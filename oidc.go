@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/enclave"
+	"github.com/findy-network/findy-agent-auth/oidc"
+	"github.com/findy-network/findy-agent-auth/token"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// oidcProvider is the OIDC provider facade, nil if it's not in use.
+var oidcProvider *oidc.Provider
+
+type oidcRedirect struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+type oidcRequestInfo struct {
+	ClientID   string   `json:"client_id"`
+	ClientName string   `json:"client_name,omitempty"`
+	Scope      []string `json:"scope"`
+}
+
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+type oidcUserinfo struct {
+	Subject           string `json:"sub"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Name              string `json:"name,omitempty"`
+}
+
+// setupOIDC starts the OIDC provider if the clients are given. The ID tokens
+// must be verifiable with the JWKS, i.e. the signing keys are needed.
+func setupOIDC() (err error) {
+	defer err2.Handle(&err, "oidc")
+
+	if oidcClients == "" {
+		return nil
+	}
+	if oidcIssuer == "" || oidcLoginURL == "" {
+		return errors.New("-oidc-issuer and -oidc-login-url are required")
+	}
+	if token.SigningAlgorithm() == "" {
+		return errors.New("-jwt-keys are required for ID tokens")
+	}
+	clients := try.To1(oidc.LoadClients(oidcClients))
+	oidcProvider = oidc.New(oidcIssuer, oidcLoginURL, clients)
+	glog.V(1).Infof("OIDC provider %s with %d client(s)", oidcIssuer, len(clients))
+	return nil
+}
+
+// oidcDiscovery serves the OpenID Provider Metadata.
+func oidcDiscovery(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	jsonResponse(w, oidcProvider.Discovery(urlOIDCAuthorize, urlOIDCToken,
+		urlOIDCUserinfo, urlJWKS, token.SigningAlgorithm()), nil)
+}
+
+// oidcAuthorize is the authorization endpoint. It stores the request and
+// redirects the browser to the login page with the request ID.
+func oidcAuthorize(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		oauthResponse(w, nil, err)
+		return nil
+	})
+
+	try.To(r.ParseForm())
+	req, err := oidcProvider.NewAuthRequest(r.Form)
+	var e *oidc.Error
+	if errors.As(err, &e) && req != nil {
+		glog.Warningln("oidc authorize:", e)
+		http.Redirect(w, r, req.ErrorURL(e), http.StatusFound)
+		return
+	}
+	try.To(err)
+
+	http.Redirect(w, r, oidcProvider.LoginRedirect(req), http.StatusFound)
+	glog.V(1).Infoln("oidc authorize, client:", req.ClientID)
+}
+
+// oidcRequest returns the info of the pending authorization request for the
+// login page.
+func oidcRequest(w http.ResponseWriter, r *http.Request) {
+	req, found := oidcProvider.AuthRequest(mux.Vars(r)["requestID"])
+	if !found {
+		oauthResponse(w, nil, &oidc.Error{Code: oidc.ErrInvalidRequest,
+			Description: "authorization request not found"})
+		return
+	}
+	info := oidcRequestInfo{ClientID: req.ClientID, Scope: req.Scope}
+	if c := oidcProvider.Client(req.ClientID); c != nil {
+		info.ClientName = c.Name
+	}
+	jsonResponse(w, info, nil)
+}
+
+// oidcComplete completes the authorization request after the login. The
+// login page calls it with the access token of the login, and redirects the
+// browser to the returned URL, which has the code.
+func oidcComplete(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		oauthResponse(w, nil, err)
+		return nil
+	})
+
+	// the access tokens of the OIDC clients aren't logins to us
+	claims, err := token.FromLoginRequest(r)
+	if err != nil {
+		try.To(&oidc.Error{Code: oidc.ErrLoginRequired, Description: err.Error()})
+	}
+	u, exists := try.To2(enclave.GetUserByDID(claims.Username))
+	if !exists {
+		try.To(&oidc.Error{Code: oidc.ErrLoginRequired, Description: "unknown user"})
+	}
+	redirectTo := try.To1(oidcProvider.Complete(mux.Vars(r)["requestID"], claims))
+
+	jsonResponse(w, oidcRedirect{RedirectTo: redirectTo}, nil)
+	glog.V(1).Infoln("oidc login completed", u.Name)
+}
+
+// oidcDeny cancels the authorization request, e.g. when the user doesn't
+// want to log in to the client. The login page redirects the browser to the
+// returned URL.
+func oidcDeny(w http.ResponseWriter, r *http.Request) {
+	redirectTo, found := oidcProvider.Deny(mux.Vars(r)["requestID"],
+		&oidc.Error{Code: oidc.ErrAccessDenied, Description: "login canceled"})
+	if !found {
+		oauthResponse(w, nil, &oidc.Error{Code: oidc.ErrInvalidRequest,
+			Description: "authorization request not found"})
+		return
+	}
+	jsonResponse(w, oidcRedirect{RedirectTo: redirectTo}, nil)
+}
+
+// oidcToken is the token endpoint. It exchanges the code to the access token
+// and the ID token.
+func oidcToken(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		oauthResponse(w, nil, err)
+		return nil
+	})
+
+	try.To(r.ParseForm())
+	clientID := try.To1(oidcClient(r))
+	if grantType := r.PostForm.Get("grant_type"); grantType != oidc.GrantTypeAuthorizationCode {
+		try.To(&oidc.Error{Code: oidc.ErrUnsupportedGrantType, Description: grantType})
+	}
+	code := try.To1(oidcProvider.Exchange(clientID, r.PostForm.Get("code"),
+		r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier")))
+
+	u, exists := try.To2(enclave.GetUserByDID(code.DID))
+	if !exists || u.Disabled {
+		try.To(&oidc.Error{Code: oidc.ErrInvalidGrant, Description: "unknown user"})
+	}
+	ts, claims := try.To2(token.IssueForClient(u.DID, u.DisplayName, clientID,
+		code.Auth))
+	try.To(recordAccess(u.Name, code.Auth.CredentialBytes(), claims))
+	idToken := try.To1(oidcProvider.IDToken(code, u.Name, u.DisplayName))
+
+	oauthResponse(w, oidcTokenResponse{
+		AccessToken: ts,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(time.Until(claims.ExpiresAt.Time) / time.Second),
+		IDToken:     idToken,
+		Scope:       strings.Join(code.Request.Scope, " "),
+	}, nil)
+	glog.V(1).Infoln("oidc token for", u.Name, "client:", clientID)
+}
+
+// oidcUserInfo is the UserInfo endpoint.
+func oidcUserInfo(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	claims, err := token.FromRequest(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		try.To(markErrUnauthorized(err))
+	}
+
+	defer err2.Handle(&err, markErrInternal)
+
+	u, exists := try.To2(enclave.GetUserByDID(claims.Username))
+	if !exists {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		try.To(markErrUnauthorized(errors.New("unknown user")))
+	}
+	jsonResponse(w, oidcUserinfo{
+		Subject:           u.DID,
+		PreferredUsername: u.Name,
+		Name:              u.DisplayName,
+	}, nil)
+}
+
+// oidcClient authenticates the client of the token request with the basic
+// authentication header or the form. The public clients send only the
+// client_id.
+func oidcClient(r *http.Request) (string, error) {
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		// RFC 6749 2.3.1: the credentials are form encoded first
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	c := oidcProvider.Client(clientID)
+	if c == nil || !c.Authenticate(secret) {
+		return clientID, &oidc.Error{Code: oidc.ErrInvalidClient,
+			Description: fmt.Sprintf("client authentication failed: %s", clientID)}
+	}
+	return clientID, nil
+}
+
+// oauthResponse writes the OAuth 2.0 response. The errors which aren't
+// oidc.Error are server errors.
+func oauthResponse(w http.ResponseWriter, d any, err error) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	if err == nil {
+		jsonResponse(w, d, nil)
+		return
+	}
+	var e *oidc.Error
+	if !errors.As(err, &e) {
+		glog.Errorln("oidc:", err)
+		e = &oidc.Error{Code: oidc.ErrServerError}
+	}
+	switch e.Code {
+	case oidc.ErrInvalidClient:
+		w.Header().Set("WWW-Authenticate", `Basic realm="oidc"`)
+		err = markErrUnauthorized(e)
+	case oidc.ErrLoginRequired:
+		err = markErrUnauthorized(e)
+	case oidc.ErrServerError:
+		err = markErrInternal(e)
+	default:
+		err = markErrBadRequest(e)
+	}
+	jsonResponse(w, e, err)
+}
@@ -0,0 +1,88 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// Client is the registered OIDC client aka relying party. The client without
+// the secret is a public client, e.g. a single page app, which can use only
+// PKCE to protect its codes.
+type Client struct {
+	ID           string   `json:"client_id"`
+	Secret       string   `json:"client_secret,omitempty"`
+	Name         string   `json:"client_name,omitempty"`
+	RedirectURIs []string `json:"redirect_uris"`
+
+	secretHash []byte
+}
+
+// LoadClients reads the clients from the JSON file, which has an array of
+// the clients.
+func LoadClients(filename string) (_ map[string]*Client, err error) {
+	defer err2.Handle(&err, "oidc clients")
+
+	return ParseClients(try.To1(os.ReadFile(filename)))
+}
+
+// ParseClients parses the JSON array of the clients and returns them by the
+// client ID. Only the hashes of the client secrets are kept.
+func ParseClients(data []byte) (_ map[string]*Client, err error) {
+	defer err2.Handle(&err)
+
+	var list []*Client
+	try.To(json.Unmarshal(data, &list))
+	clients := make(map[string]*Client, len(list))
+	for _, c := range list {
+		if c.ID == "" {
+			return nil, fmt.Errorf("client_id missing")
+		}
+		if _, exists := clients[c.ID]; exists {
+			return nil, fmt.Errorf("duplicate client: %s", c.ID)
+		}
+		if len(c.RedirectURIs) == 0 {
+			return nil, fmt.Errorf("client %s: redirect_uris missing", c.ID)
+		}
+		for _, uri := range c.RedirectURIs {
+			u, err := url.Parse(uri)
+			if err != nil || !u.IsAbs() || u.Fragment != "" {
+				return nil, fmt.Errorf("client %s: illegal redirect_uri: %s",
+					c.ID, uri)
+			}
+		}
+		if c.Secret != "" {
+			sum := sha256.Sum256([]byte(c.Secret))
+			c.secretHash, c.Secret = sum[:], ""
+		}
+		clients[c.ID] = c
+	}
+	return clients, nil
+}
+
+// Public tells if the client is a public client without the secret.
+func (c *Client) Public() bool {
+	return c.secretHash == nil
+}
+
+// Authenticate tells if the secret is the client's secret.
+func (c *Client) Authenticate(secret string) bool {
+	if c.Public() {
+		return secret == ""
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(sum[:], c.secretHash) == 1
+}
+
+// ValidRedirectURI tells if the URI is one of the registered redirect URIs.
+// Only the exact match is accepted.
+func (c *Client) ValidRedirectURI(uri string) bool {
+	return slices.Contains(c.RedirectURIs, uri)
+}
@@ -0,0 +1,448 @@
+/*
+Package oidc implements the OpenID Connect provider facade over the passkey
+login. Only the authorization code flow with PKCE (S256) is supported.
+
+The authorization request is stored, and the browser is redirected to the
+login page with the request ID. The login page runs the normal WebAuthn login
+ceremony and completes the request with the access token it got, after which
+the browser is redirected back to the client with the code. The client
+exchanges the code for the access token and the ID token, whose sub claim is
+the DID of the user.
+*/
+package oidc
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/session"
+	"github.com/findy-network/findy-agent-auth/token"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+const (
+	// DefaultRequestTimeout is the time the user has to log in.
+	DefaultRequestTimeout = 10 * time.Minute
+
+	// DefaultCodeTimeout is the lifetime of the authorization code.
+	DefaultCodeTimeout = time.Minute
+
+	// DefaultIDTokenLifetime is the lifetime of the ID tokens.
+	DefaultIDTokenLifetime = time.Hour
+)
+
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+
+	ResponseTypeCode            = "code"
+	GrantTypeAuthorizationCode  = "authorization_code"
+	CodeChallengeMethodS256     = "S256"
+	RequestParam                = "oidc_request"
+	PromptNone                  = "none"
+	PromptLogin                 = "login"
+	AuthMethodClientSecretBasic = "client_secret_basic"
+	AuthMethodClientSecretPost  = "client_secret_post"
+	AuthMethodNone              = "none"
+)
+
+// idLength is the length of the random request IDs and codes in bytes.
+const idLength = 24
+
+// The OAuth 2.0 error codes (RFC 6749 4.1.2.1 and 5.2, OIDC Core 3.1.2.6).
+const (
+	ErrInvalidRequest          = "invalid_request"
+	ErrInvalidClient           = "invalid_client"
+	ErrInvalidGrant            = "invalid_grant"
+	ErrInvalidScope            = "invalid_scope"
+	ErrUnauthorizedClient      = "unauthorized_client"
+	ErrUnsupportedResponseType = "unsupported_response_type"
+	ErrUnsupportedGrantType    = "unsupported_grant_type"
+	ErrLoginRequired           = "login_required"
+	ErrAccessDenied            = "access_denied"
+	ErrServerError             = "server_error"
+)
+
+// Error is the OAuth 2.0 error response.
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func newError(code, description string) *Error {
+	return &Error{Code: code, Description: description}
+}
+
+// AuthRequest is the pending authorization request.
+type AuthRequest struct {
+	ID            string
+	ClientID      string
+	RedirectURI   string
+	Scope         []string
+	State         string
+	Nonce         string
+	CodeChallenge string
+	Prompt        string
+
+	// MaxAge is the allowed time since the login, or -1 if not given.
+	MaxAge  time.Duration
+	Created time.Time
+}
+
+// Code is the authorization code of the completed request.
+type Code struct {
+	Request *AuthRequest
+	DID     string
+	Auth    *token.Auth
+}
+
+// IDTokenClaims are the claims of the ID token.
+type IDTokenClaims struct {
+	Nonce             string           `json:"nonce,omitempty"`
+	AuthTime          *jwt.NumericDate `json:"auth_time,omitempty"`
+	AMR               []string         `json:"amr,omitempty"`
+	AuthorizedParty   string           `json:"azp,omitempty"`
+	PreferredUsername string           `json:"preferred_username,omitempty"`
+	Name              string           `json:"name,omitempty"`
+
+	jwt.RegisteredClaims
+}
+
+// Discovery is the OpenID Provider Metadata.
+type Discovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// Provider is the OIDC provider.
+type Provider struct {
+	Issuer   string
+	LoginURL string
+
+	clients  map[string]*Client
+	requests *store[*AuthRequest]
+	codes    *store[*Code]
+}
+
+// New returns a new provider. The issuer is the public base URL of the
+// server, and the login URL is the page where the user logs in.
+func New(issuer, loginURL string, clients map[string]*Client) *Provider {
+	return &Provider{
+		Issuer:   strings.TrimSuffix(issuer, "/"),
+		LoginURL: loginURL,
+		clients:  clients,
+		requests: newStore[*AuthRequest](DefaultRequestTimeout),
+		codes:    newStore[*Code](DefaultCodeTimeout),
+	}
+}
+
+// Client returns the registered client or nil.
+func (p *Provider) Client(id string) *Client {
+	return p.clients[id]
+}
+
+// NewAuthRequest validates and stores the authorization request of the query.
+// If the returned request isn't nil with the error, the error must be sent to
+// the client's redirect URI. Otherwise the redirect URI cannot be trusted and
+// the error is shown to the user.
+func (p *Provider) NewAuthRequest(q url.Values) (_ *AuthRequest, err error) {
+	c := p.Client(q.Get("client_id"))
+	if c == nil {
+		return nil, newError(ErrInvalidRequest, "unknown client_id")
+	}
+	redirectURI := q.Get("redirect_uri")
+	if !c.ValidRedirectURI(redirectURI) {
+		return nil, newError(ErrInvalidRequest, "unregistered redirect_uri")
+	}
+	req := &AuthRequest{
+		ClientID:      c.ID,
+		RedirectURI:   redirectURI,
+		Scope:         strings.Fields(q.Get("scope")),
+		State:         q.Get("state"),
+		Nonce:         q.Get("nonce"),
+		CodeChallenge: q.Get("code_challenge"),
+		Prompt:        q.Get("prompt"),
+		MaxAge:        -1,
+		Created:       time.Now(),
+	}
+	switch {
+	case q.Get("response_type") != ResponseTypeCode:
+		return req, newError(ErrUnsupportedResponseType, "only code is supported")
+	case !slices.Contains(req.Scope, ScopeOpenID):
+		return req, newError(ErrInvalidScope, "openid scope missing")
+	case req.CodeChallenge == "" ||
+		q.Get("code_challenge_method") != CodeChallengeMethodS256:
+		return req, newError(ErrInvalidRequest, "S256 code_challenge required")
+	case req.Prompt == PromptNone:
+		return req, newError(ErrLoginRequired, "login required")
+	}
+	if maxAge := q.Get("max_age"); maxAge != "" {
+		secs, err := strconv.Atoi(maxAge)
+		if err != nil || secs < 0 {
+			return req, newError(ErrInvalidRequest, "illegal max_age")
+		}
+		req.MaxAge = time.Duration(secs) * time.Second
+	}
+	req.ID, err = p.requests.put(req)
+	if err != nil {
+		return req, newError(ErrServerError, err.Error())
+	}
+	return req, nil
+}
+
+// AuthRequest returns the pending authorization request.
+func (p *Provider) AuthRequest(id string) (*AuthRequest, bool) {
+	return p.requests.get(id)
+}
+
+// Complete completes the authorization request for the user (DID), who has
+// logged in with the access token of the claims. It returns the redirect URL
+// with the authorization code. If the login isn't fresh enough for the
+// request, ErrLoginRequired is returned, and the request is kept.
+func (p *Provider) Complete(id string, claims *token.Claims) (_ string, err error) {
+	req, found := p.requests.get(id)
+	if !found {
+		return "", newError(ErrInvalidRequest, "authorization request not found")
+	}
+	if claims.AuthTime == nil {
+		return "", newError(ErrLoginRequired, "login time missing")
+	}
+	auth := authOf(claims)
+	if req.Prompt == PromptLogin &&
+		auth.Time.Before(req.Created.Truncate(time.Second)) {
+		return "", newError(ErrLoginRequired, "new login required")
+	}
+	if req.MaxAge >= 0 && time.Since(auth.Time) > req.MaxAge+time.Second {
+		return "", newError(ErrLoginRequired, "login too old")
+	}
+	if _, found = p.requests.take(id); !found {
+		return "", newError(ErrInvalidRequest, "authorization request not found")
+	}
+
+	code, err := p.codes.put(&Code{Request: req, DID: claims.Username, Auth: auth})
+	if err != nil {
+		return "", newError(ErrServerError, err.Error())
+	}
+	return req.RedirectURL(url.Values{"code": {code}}), nil
+}
+
+// Deny removes the authorization request and returns the redirect URL with
+// the error.
+func (p *Provider) Deny(id string, e *Error) (string, bool) {
+	req, found := p.requests.take(id)
+	if !found {
+		return "", false
+	}
+	return req.ErrorURL(e), true
+}
+
+// Exchange takes the code and verifies that it's issued to the client with
+// the redirect URI, and that the verifier is the PKCE verifier of the code.
+// The client must be authenticated by the caller.
+func (p *Provider) Exchange(clientID, code, redirectURI, verifier string) (*Code, error) {
+	c, found := p.codes.take(code)
+	switch {
+	case !found:
+		return nil, newError(ErrInvalidGrant, "invalid or expired code")
+	case c.Request.ClientID != clientID:
+		return nil, newError(ErrInvalidGrant, "code issued to another client")
+	case c.Request.RedirectURI != redirectURI:
+		return nil, newError(ErrInvalidGrant, "redirect_uri mismatch")
+	case !VerifyPKCE(c.Request.CodeChallenge, verifier):
+		return nil, newError(ErrInvalidGrant, "code_verifier mismatch")
+	}
+	return c, nil
+}
+
+// IDToken builds and signs the ID token of the code.
+func (p *Provider) IDToken(c *Code, name, displayName string) (_ string, err error) {
+	defer err2.Handle(&err, "id token")
+
+	now := time.Now()
+	claims := IDTokenClaims{
+		Nonce:           c.Request.Nonce,
+		AuthTime:        jwt.NewNumericDate(c.Auth.Time),
+		AMR:             c.Auth.AMR,
+		AuthorizedParty: c.Request.ClientID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    p.Issuer,
+			Subject:   c.DID,
+			Audience:  jwt.ClaimStrings{c.Request.ClientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(DefaultIDTokenLifetime)),
+		},
+	}
+	if slices.Contains(c.Request.Scope, ScopeProfile) {
+		claims.PreferredUsername = name
+		claims.Name = displayName
+	}
+	return try.To1(token.Sign(claims)), nil
+}
+
+// Discovery returns the provider metadata. The endpoints are relative to the
+// issuer.
+func (p *Provider) Discovery(authorize, tokenURL, userinfo, jwks, alg string) Discovery {
+	return Discovery{
+		Issuer:                            p.Issuer,
+		AuthorizationEndpoint:             p.Issuer + authorize,
+		TokenEndpoint:                     p.Issuer + tokenURL,
+		UserinfoEndpoint:                  p.Issuer + userinfo,
+		JWKSURI:                           p.Issuer + jwks,
+		ResponseTypesSupported:            []string{ResponseTypeCode},
+		GrantTypesSupported:               []string{GrantTypeAuthorizationCode},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{alg},
+		ScopesSupported:                   []string{ScopeOpenID, ScopeProfile},
+		TokenEndpointAuthMethodsSupported: []string{AuthMethodClientSecretBasic, AuthMethodClientSecretPost, AuthMethodNone},
+		CodeChallengeMethodsSupported:     []string{CodeChallengeMethodS256},
+		ClaimsSupported: []string{"iss", "sub", "aud", "exp", "iat", "nonce",
+			"auth_time", "amr", "azp", "preferred_username", "name"},
+	}
+}
+
+// LoginRedirect returns the URL of the login page for the request.
+func (p *Provider) LoginRedirect(req *AuthRequest) string {
+	u, err := url.Parse(p.LoginURL)
+	if err != nil {
+		return p.LoginURL
+	}
+	q := u.Query()
+	q.Set(RequestParam, req.ID)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// RedirectURL returns the client's redirect URI with the params and the state.
+func (r *AuthRequest) RedirectURL(params url.Values) string {
+	u, err := url.Parse(r.RedirectURI)
+	if err != nil {
+		return r.RedirectURI
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	if r.State != "" {
+		q.Set("state", r.State)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// ErrorURL returns the client's redirect URI with the error.
+func (r *AuthRequest) ErrorURL(e *Error) string {
+	params := url.Values{"error": {e.Code}}
+	if e.Description != "" {
+		params.Set("error_description", e.Description)
+	}
+	return r.RedirectURL(params)
+}
+
+// VerifyPKCE tells if the verifier matches the S256 code challenge.
+func VerifyPKCE(challenge, verifier string) bool {
+	if verifier == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// authOf returns the authentication of the access token claims. The login
+// time is the auth_time claim, which must be set. The issue time isn't used,
+// because the refreshed tokens are issued without the new login.
+func authOf(claims *token.Claims) *token.Auth {
+	return &token.Auth{
+		Time:         claims.AuthTime.Time,
+		AMR:          claims.AMR,
+		AAGUID:       claims.AAGUID,
+		CredentialID: claims.CredentialID,
+		UV:           claims.UV != nil && *claims.UV,
+	}
+}
+
+// store keeps the single use items until they expire.
+type store[T any] struct {
+	sync.Mutex
+
+	timeout time.Duration
+	items   map[string]item[T]
+}
+
+type item[T any] struct {
+	value   T
+	expires time.Time
+}
+
+func newStore[T any](timeout time.Duration) *store[T] {
+	return &store[T]{timeout: timeout, items: make(map[string]item[T])}
+}
+
+func (s *store[T]) put(value T) (id string, err error) {
+	defer err2.Handle(&err)
+
+	id = base64.RawURLEncoding.EncodeToString(
+		try.To1(session.GenerateSecureKey(idLength)))
+	now := time.Now()
+
+	s.Lock()
+	defer s.Unlock()
+
+	for k, it := range s.items {
+		if it.expires.Before(now) {
+			delete(s.items, k)
+		}
+	}
+	s.items[id] = item[T]{value: value, expires: now.Add(s.timeout)}
+	return id, nil
+}
+
+func (s *store[T]) get(id string) (value T, found bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	it, found := s.items[id]
+	if !found || it.expires.Before(time.Now()) {
+		return value, false
+	}
+	return it.value, true
+}
+
+func (s *store[T]) take(id string) (value T, found bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	it, found := s.items[id]
+	if !found {
+		return value, false
+	}
+	delete(s.items, id)
+	if it.expires.Before(time.Now()) {
+		return value, false
+	}
+	return it.value, true
+}
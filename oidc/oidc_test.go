@@ -0,0 +1,229 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/token"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+const testClients = `[
+	{"client_id": "dashboard", "client_secret": "s3cret",
+	 "redirect_uris": ["https://dash.example.com/cb"]},
+	{"client_id": "spa", "redirect_uris": ["https://spa.example.com/cb"]}
+]`
+
+const verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+func challenge(v string) string {
+	sum := sha256.Sum256([]byte(v))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func authQuery() url.Values {
+	return url.Values{
+		"response_type":         {ResponseTypeCode},
+		"client_id":             {"dashboard"},
+		"redirect_uri":          {"https://dash.example.com/cb"},
+		"scope":                 {"openid profile"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6_WzA2Mj"},
+		"code_challenge":        {challenge(verifier)},
+		"code_challenge_method": {CodeChallengeMethodS256},
+	}
+}
+
+func newProvider() *Provider {
+	return New("https://auth.example.com/", "https://wallet.example.com/login",
+		try.To1(ParseClients([]byte(testClients))))
+}
+
+func loginClaims(authTime time.Time) *token.Claims {
+	return &token.Claims{
+		Username: "did:example:123",
+		AuthTime: jwt.NewNumericDate(authTime),
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+		},
+	}
+}
+
+func TestParseClients(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	clients := try.To1(ParseClients([]byte(testClients)))
+	assert.MLen(clients, 2)
+	assert.ThatNot(clients["dashboard"].Public())
+	assert.Empty(clients["dashboard"].Secret)
+	assert.That(clients["dashboard"].Authenticate("s3cret"))
+	assert.ThatNot(clients["dashboard"].Authenticate("wrong"))
+	assert.ThatNot(clients["dashboard"].Authenticate(""))
+	assert.That(clients["spa"].Public())
+	assert.That(clients["spa"].Authenticate(""))
+	assert.ThatNot(clients["spa"].ValidRedirectURI("https://spa.example.com/cb/x"))
+
+	for _, bad := range []string{
+		`[{"redirect_uris": ["https://a.example.com"]}]`,
+		`[{"client_id": "a"}]`,
+		`[{"client_id": "a", "redirect_uris": ["/relative"]}]`,
+		`[{"client_id": "a", "redirect_uris": ["https://a.example.com"]},
+		  {"client_id": "a", "redirect_uris": ["https://a.example.com"]}]`,
+	} {
+		_, err := ParseClients([]byte(bad))
+		assert.Error(err)
+	}
+}
+
+func TestPKCE(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	// RFC 7636 appendix B
+	assert.That(VerifyPKCE("E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", verifier))
+	assert.ThatNot(VerifyPKCE(challenge(verifier), verifier+"x"))
+	assert.ThatNot(VerifyPKCE(challenge(""), ""))
+}
+
+func TestNewAuthRequest(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	p := newProvider()
+	req := try.To1(p.NewAuthRequest(authQuery()))
+	assert.NotEmpty(req.ID)
+	_, found := p.AuthRequest(req.ID)
+	assert.That(found)
+	login := try.To1(url.Parse(p.LoginRedirect(req)))
+	assert.Equal(login.Query().Get(RequestParam), req.ID)
+
+	tests := []struct {
+		name       string
+		key, value string
+		code       string
+		redirect   bool
+	}{
+		{"unknown client", "client_id", "other", ErrInvalidRequest, false},
+		{"unknown redirect", "redirect_uri", "https://evil.example.com", ErrInvalidRequest, false},
+		{"implicit flow", "response_type", "token", ErrUnsupportedResponseType, true},
+		{"no openid scope", "scope", "profile", ErrInvalidScope, true},
+		{"no PKCE", "code_challenge", "", ErrInvalidRequest, true},
+		{"plain PKCE", "code_challenge_method", "plain", ErrInvalidRequest, true},
+		{"prompt none", "prompt", PromptNone, ErrLoginRequired, true},
+		{"bad max_age", "max_age", "-1", ErrInvalidRequest, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer assert.PushTester(t)()
+
+			q := authQuery()
+			q.Set(tt.key, tt.value)
+			req, err := p.NewAuthRequest(q)
+			assert.Error(err)
+			assert.Equal(err.(*Error).Code, tt.code)
+			assert.Equal(req != nil, tt.redirect)
+			if tt.redirect {
+				u := try.To1(url.Parse(req.ErrorURL(err.(*Error))))
+				assert.Equal(u.Query().Get("error"), tt.code)
+				assert.Equal(u.Query().Get("state"), "xyz")
+			}
+		})
+	}
+}
+
+func TestCodeFlow(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	p := newProvider()
+	complete := func(q url.Values, claims *token.Claims) (*AuthRequest, string, error) {
+		req := try.To1(p.NewAuthRequest(q))
+		redirectTo, err := p.Complete(req.ID, claims)
+		return req, redirectTo, err
+	}
+	codeOf := func(redirectTo string) string {
+		u := try.To1(url.Parse(redirectTo))
+		assert.Equal(u.Query().Get("state"), "xyz")
+		return u.Query().Get("code")
+	}
+
+	t.Run("exchange", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		req, redirectTo, err := complete(authQuery(), loginClaims(time.Now()))
+		assert.NoError(err)
+		_, found := p.AuthRequest(req.ID)
+		assert.ThatNot(found)
+		_, err = p.Complete(req.ID, loginClaims(time.Now()))
+		assert.Error(err)
+
+		code := codeOf(redirectTo)
+		_, err = p.Exchange("spa", code, req.RedirectURI, verifier)
+		assert.Error(err)
+
+		// the code is single use even if the exchange fails
+		_, redirectTo, _ = complete(authQuery(), loginClaims(time.Now()))
+		code = codeOf(redirectTo)
+		_, err = p.Exchange("dashboard", code, req.RedirectURI, "wrong")
+		assert.Error(err)
+		_, err = p.Exchange("dashboard", code, req.RedirectURI, verifier)
+		assert.Error(err)
+
+		_, redirectTo, _ = complete(authQuery(), loginClaims(time.Now()))
+		c := try.To1(p.Exchange("dashboard", codeOf(redirectTo), req.RedirectURI, verifier))
+		assert.Equal(c.DID, "did:example:123")
+		assert.Equal(c.Request.Nonce, "n-0S6_WzA2Mj")
+	})
+	t.Run("prompt login", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		q := authQuery()
+		q.Set("prompt", PromptLogin)
+		req, _, err := complete(q, loginClaims(time.Now().Add(-time.Hour)))
+		assert.Equal(err.(*Error).Code, ErrLoginRequired)
+		_, found := p.AuthRequest(req.ID)
+		assert.That(found)
+
+		// the refreshed token is issued now, but the login is old
+		_, err = p.Complete(req.ID, &token.Claims{
+			Username:         "did:example:123",
+			RegisteredClaims: jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(time.Now())},
+		})
+		assert.Equal(err.(*Error).Code, ErrLoginRequired)
+
+		_, err = p.Complete(req.ID, loginClaims(time.Now()))
+		assert.NoError(err)
+	})
+	t.Run("max age", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		q := authQuery()
+		q.Set("max_age", "60")
+		_, _, err := complete(q, loginClaims(time.Now().Add(-2*time.Minute)))
+		assert.Equal(err.(*Error).Code, ErrLoginRequired)
+		_, _, err = complete(q, loginClaims(time.Now().Add(-30*time.Second)))
+		assert.NoError(err)
+	})
+	t.Run("deny", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		req := try.To1(p.NewAuthRequest(authQuery()))
+		redirectTo, found := p.Deny(req.ID, &Error{Code: ErrAccessDenied})
+		assert.That(found)
+		u := try.To1(url.Parse(redirectTo))
+		assert.Equal(u.Query().Get("error"), ErrAccessDenied)
+		_, found = p.Deny(req.ID, &Error{Code: ErrAccessDenied})
+		assert.ThatNot(found)
+	})
+}
+
+func TestDiscovery(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	d := newProvider().Discovery("/authorize", "/token", "/userinfo", "/jwks", "ES256")
+	assert.Equal(d.Issuer, "https://auth.example.com")
+	assert.Equal(d.TokenEndpoint, "https://auth.example.com/token")
+	assert.SLen(d.IDTokenSigningAlgValuesSupported, 1)
+}
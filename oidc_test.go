@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/findy-network/findy-agent-auth/enclave"
+	"github.com/findy-network/findy-agent-auth/oidc"
+	"github.com/findy-network/findy-agent-auth/token"
+	"github.com/findy-network/findy-agent-auth/user"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestOIDC(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	ecKey := try.To1(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+	keyFile := filepath.Join(t.TempDir(), "jwt.pem")
+	try.To(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY",
+		Bytes: try.To1(x509.MarshalPKCS8PrivateKey(ecKey))}), 0o600))
+	try.To(token.Init(keyFile))
+	defer func() { try.To(token.Init(jwtKeys)) }()
+
+	clients := try.To1(oidc.ParseClients([]byte(`[{"client_id": "dashboard",
+		"client_name": "Dashboard", "client_secret": "s3cret",
+		"redirect_uris": ["https://dash.example.com/cb"]}]`)))
+	oidcProvider = oidc.New("https://auth.example.com", "https://wallet.example.com/login", clients)
+	defer func() { oidcProvider = nil }()
+
+	const name = "oidc-user"
+	u := user.New(name, "OIDC User", "")
+	u.DID = "did:example:oidc"
+	cred := &webauthn.Credential{ID: []byte("oidc-passkey")}
+	u.AddCredential(*cred)
+	try.To(enclave.PutUser(u))
+
+	r := newMuxWithRoutes()
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(httptest.NewRequest("GET", urlOIDCDiscovery, nil))
+	assert.Equal(w.Code, http.StatusOK)
+	var discovery oidc.Discovery
+	try.To(json.Unmarshal(w.Body.Bytes(), &discovery))
+	assert.Equal(discovery.TokenEndpoint, "https://auth.example.com"+urlOIDCToken)
+	assert.Equal(discovery.IDTokenSigningAlgValuesSupported[0], "ES256")
+
+	const verifier = "a-long-enough-pkce-code-verifier-for-the-oidc-test"
+	sum := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"dashboard"},
+		"redirect_uri":          {"https://dash.example.com/cb"},
+		"scope":                 {"openid profile"},
+		"state":                 {"st4te"},
+		"nonce":                 {"n0nce"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+	w = serve(httptest.NewRequest("GET", urlOIDCAuthorize+"?"+q.Encode(), nil))
+	assert.Equal(w.Code, http.StatusFound)
+	login := try.To1(url.Parse(w.Header().Get("Location")))
+	assert.Equal(login.Host, "wallet.example.com")
+	requestURL := strings.Replace(urlOIDCRequest, "{requestID}",
+		login.Query().Get(oidc.RequestParam), 1)
+
+	w = serve(httptest.NewRequest("GET", requestURL, nil))
+	assert.Equal(w.Code, http.StatusOK)
+	assert.That(strings.Contains(w.Body.String(), `"client_name":"Dashboard"`))
+
+	// the login page runs the passkey login and completes the request
+	w = serve(httptest.NewRequest("POST", requestURL, nil))
+	assert.Equal(w.Code, http.StatusUnauthorized)
+	at := try.To1(loginTokens(u, cred, ""))
+	req := httptest.NewRequest("POST", requestURL, nil)
+	req.Header.Set("Authorization", "Bearer "+at.Token)
+	w = serve(req)
+	assert.Equal(w.Code, http.StatusOK)
+	var redirect oidcRedirect
+	try.To(json.Unmarshal(w.Body.Bytes(), &redirect))
+	callback := try.To1(url.Parse(redirect.RedirectTo))
+	assert.Equal(callback.Query().Get("state"), "st4te")
+	code := callback.Query().Get("code")
+
+	exchange := func(secret string) *httptest.ResponseRecorder {
+		form := url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {"https://dash.example.com/cb"},
+			"code_verifier": {verifier},
+		}
+		req := httptest.NewRequest("POST", urlOIDCToken, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("dashboard", secret)
+		return serve(req)
+	}
+	w = exchange("wrong")
+	assert.Equal(w.Code, http.StatusUnauthorized)
+	assert.That(strings.Contains(w.Body.String(), oidc.ErrInvalidClient))
+
+	w = exchange("s3cret")
+	assert.Equal(w.Code, http.StatusOK)
+	assert.Equal(w.Header().Get("Cache-Control"), "no-store")
+	var res oidcTokenResponse
+	try.To(json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(res.TokenType, "Bearer")
+	assert.That(res.ExpiresIn > 0)
+	assert.That(token.IsValidUser(u.DID, []string{"Bearer " + res.AccessToken}))
+
+	// the client's access token isn't a login to complete the requests
+	w = serve(httptest.NewRequest("GET", urlOIDCAuthorize+"?"+q.Encode(), nil))
+	login = try.To1(url.Parse(w.Header().Get("Location")))
+	req = httptest.NewRequest("POST", strings.Replace(urlOIDCRequest, "{requestID}",
+		login.Query().Get(oidc.RequestParam), 1), nil)
+	req.Header.Set("Authorization", "Bearer "+res.AccessToken)
+	w = serve(req)
+	assert.Equal(w.Code, http.StatusUnauthorized)
+	assert.That(strings.Contains(w.Body.String(), oidc.ErrLoginRequired))
+
+	// nor to our own endpoints, and the client is its audience
+	clientClaims := try.To1(token.Parse(res.AccessToken))
+	assert.DeepEqual([]string(clientClaims.Audience), []string{"dashboard"})
+	assert.ThatNot(clientClaims.FirstParty())
+	for _, ep := range []struct{ method, path string }{
+		{"POST", urlLogout},
+		{"POST", urlBeginStepUp},
+		{"POST", urlBeginTransaction},
+		{"GET", "/transaction/receipts/any"},
+		{"GET", "/credentials/" + name},
+		{"GET", urlAdminUsers},
+	} {
+		req = httptest.NewRequest(ep.method, ep.path, strings.NewReader("{}"))
+		req.Header.Set("Authorization", "Bearer "+res.AccessToken)
+		w = serve(req)
+		assert.Equal(w.Code, http.StatusUnauthorized, ep.path)
+	}
+
+	var idClaims oidc.IDTokenClaims
+	_ = try.To1(jwt.ParseWithClaims(res.IDToken, &idClaims,
+		func(*jwt.Token) (any, error) { return &ecKey.PublicKey, nil },
+		jwt.WithIssuer("https://auth.example.com"), jwt.WithAudience("dashboard")))
+	assert.Equal(idClaims.Subject, u.DID)
+	assert.Equal(idClaims.Nonce, "n0nce")
+	assert.Equal(idClaims.PreferredUsername, name)
+	assert.NotNil(idClaims.AuthTime)
+
+	// the code is single use
+	w = exchange("s3cret")
+	assert.Equal(w.Code, http.StatusBadRequest)
+	assert.That(strings.Contains(w.Body.String(), oidc.ErrInvalidGrant))
+
+	req = httptest.NewRequest("GET", urlOIDCUserinfo, nil)
+	req.Header.Set("Authorization", "Bearer "+res.AccessToken)
+	w = serve(req)
+	assert.Equal(w.Code, http.StatusOK)
+	assert.That(strings.Contains(w.Body.String(), `"sub":"did:example:oidc"`))
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/ceremony"
+	"github.com/findy-network/findy-agent-auth/enclave"
+	"github.com/findy-network/findy-agent-auth/user"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// onboardingInterval is how often the pending onboardings are checked.
+const onboardingInterval = 5 * time.Second
+
+// agencyHealthInterval is how often the shared agency connection is checked.
+const agencyHealthInterval = 30 * time.Second
+
+type onboardingStatus struct {
+	Status      string     `json:"status"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+}
+
+func onboardingBackoff() time.Duration {
+	return time.Duration(onboardingBackoffSecs) * time.Second
+}
+
+// allocateCloudAgent allocates the cloud agent of the registered user. If the
+// allocation fails, e.g. the agency is down, the registration still succeeds
+// and the allocation is retried in the background. The DID of the other user
+// is refused, e.g. the agency gives the same DID for the same seed. The caller
+// persists the user.
+func allocateCloudAgent(ctx context.Context, u *user.User) {
+	err := u.AllocateCloudAgent(ctx, findyAdmin, time.Duration(timeoutSecs)*time.Second)
+	if err == nil {
+		err = requireUniqueDID(u)
+	}
+	if err == nil {
+		return
+	}
+	u.OnboardingFailed(err, time.Now(), onboardingBackoff())
+	if u.IsOnboardingRejected() {
+		glog.Warningf("cloud agent allocation of %s rejected: %v", u.Name, err)
+		return
+	}
+	glog.Warningf("cloud agent allocation of %s failed, retry at %v: %v",
+		u.Name, u.Onboarding.NextAttempt, err)
+}
+
+// requireUniqueDID checks that the allocated DID isn't the other user's. If
+// it is, the DID is cleared.
+func requireUniqueDID(u *user.User) (err error) {
+	defer err2.Handle(&err, "unique DID")
+
+	other, exists := try.To2(enclave.GetUserByDID(u.DID))
+	if exists && other.Name != u.Name {
+		glog.Warningf("DID of %s allocated to %s", other.Name, u.Name)
+		u.DID = ""
+		return fmt.Errorf("%w: %w", user.ErrOnboardingRejected, errDIDInUse)
+	}
+	return nil
+}
+
+// setOnboardingID gives the client the ID of the onboarding status if the
+// user's cloud agent allocation is pending.
+func setOnboardingID(w http.ResponseWriter, u *user.User) {
+	if u.IsOnboardingPending() {
+		w.Header().Set(ceremony.OnboardingHeader, enclave.OnboardingID(u))
+	}
+}
+
+// requireDID checks that the user's cloud agent is allocated before the tokens
+// are issued. The client is told when to try again, unless the allocation is
+// rejected.
+func requireDID(w http.ResponseWriter, u *user.User) error {
+	if u.DID != "" {
+		return nil
+	}
+	if u.IsOnboardingRejected() {
+		return fmt.Errorf("%w: %w: %s", errForbidden, user.ErrOnboardingRejected, u.Name)
+	}
+	retryAfter := onboardingBackoff()
+	if u.Onboarding != nil {
+		retryAfter = time.Until(u.Onboarding.NextAttempt)
+	}
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Max(1, math.Ceil(retryAfter.Seconds())))))
+	return fmt.Errorf("%w: %s", errOnboardingPending, u.Name)
+}
+
+// getOnboardingStatus returns the status of the user's cloud agent
+// allocation. The clients poll it with the onboarding ID of the registration
+// until the status is ready, and then they can log in. The rejected status is
+// final.
+func getOnboardingStatus(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	defer err2.Handle(&err, markErrBadRequest)
+
+	u, exists := try.To2(enclave.GetOnboardingUser(mux.Vars(r)["onboardingID"]))
+	if !exists {
+		err2.Throwf("onboarding not found")
+	}
+	status := onboardingStatus{Status: u.OnboardingStatus()}
+	if u.IsOnboardingPending() {
+		status.NextAttempt = &u.Onboarding.NextAttempt
+	}
+	jsonResponse(w, status, nil)
+}
+
+// onboardingTicker retries the pending onboardings with the interval.
+func onboardingTicker(interval time.Duration) (done chan<- struct{}) {
+	ticker := time.NewTicker(interval)
+	doneCh := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-doneCh:
+				return
+			case now := <-ticker.C:
+				if err := retryOnboardings(now); err != nil {
+					glog.Errorln("retry onboardings:", err)
+				}
+			}
+		}
+	}()
+	return doneCh
+}
+
+// retryOnboardings retries the cloud agent allocations which are due.
+func retryOnboardings(now time.Time) (err error) {
+	defer err2.Handle(&err)
+
+	for _, name := range try.To1(enclave.GetPendingOnboardings()) {
+		u, exists := try.To2(enclave.GetUser(name))
+		if !exists || !u.IsOnboardingPending() {
+			try.To(enclave.RemovePendingOnboarding(name))
+			continue
+		}
+		if !u.IsOnboardingDue(now) {
+			continue
+		}
+		if err := retryOnboarding(u); err != nil {
+			glog.Errorln("retry onboarding:", name, err)
+		}
+	}
+	return nil
+}
+
+func retryOnboarding(u *user.User) (err error) {
+	defer err2.Handle(&err)
+
+	glog.V(1).Infof("retry cloud agent allocation of %s, attempt %d",
+		u.Name, u.Onboarding.Attempts+1)
+	allocateCloudAgent(context.Background(), u)
+
+	// the user can be changed during the allocation, e.g. by the login, or
+	// it can be deleted and created again with the same name
+	current, exists := try.To2(enclave.GetUser(u.Name))
+	if !exists || !bytes.Equal(current.WebAuthnID(), u.WebAuthnID()) {
+		return offboardOrphan(u)
+	}
+	current.DID, current.Onboarding = u.DID, u.Onboarding
+	try.To(enclave.PutUser(current))
+	switch {
+	case current.DID != "":
+		try.To(enclave.RemovePendingOnboarding(current.Name))
+		glog.V(1).Infoln("cloud agent allocated for", current.Name)
+	case current.IsOnboardingRejected():
+		try.To(enclave.RemovePendingOnboarding(current.Name))
+		glog.Warningln("cloud agent allocation rejected for", current.Name)
+	}
+	return nil
+}
+
+// offboardOrphan offboards the cloud agent allocated for the user, who was
+// deleted during the allocation. The deletion is recorded, that the retained
+// agent isn't lost.
+func offboardOrphan(u *user.User) (err error) {
+	defer err2.Handle(&err, "offboard orphan")
+
+	if u.DID == "" {
+		return nil
+	}
+	glog.Warningf("user %s deleted during the cloud agent allocation", u.Name)
+	deletion := try.To1(u.OffboardCloudAgent(context.Background(), findyAdmin,
+		time.Duration(timeoutSecs)*time.Second))
+	return enclave.PutDeletion(deletion)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/acator/authn"
+	"github.com/findy-network/findy-agent-auth/enclave"
+	"github.com/findy-network/findy-agent-auth/token"
+	"github.com/findy-network/findy-agent-auth/user"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+// flakyAllocator fails the given number of times like the agency which is
+// down.
+type flakyAllocator struct {
+	failures int
+	calls    int
+}
+
+func (a *flakyAllocator) Allocate(_ context.Context, _ string, u *user.User) (string, error) {
+	a.calls++
+	if a.calls <= a.failures {
+		return "", errors.New("agency unavailable")
+	}
+	return "did:flaky:" + u.Name, nil
+}
+
+func TestPendingOnboarding(t *testing.T) {
+	defer assert.PushTester(t)()
+	defer user.SetAllocator(user.GRPCAllocator{})
+
+	allocator := &flakyAllocator{failures: 2}
+	user.SetAllocator(allocator)
+	server := httptest.NewServer(newMuxWithRoutes())
+	defer server.Close()
+
+	const name = "pending-onboarding-user"
+	cmd := authn.Cmd{
+		SubCmd:   "register",
+		UserName: name,
+		URL:      server.URL,
+		AAGUID:   "12c85a48-4baf-47bd-b51f-f192871a1511",
+		Key:      "15308490f1e4026284594dd08d31291bc8ef2aeac730d0daf6ff87bb92d4336c",
+		Origin:   defaultOrigin,
+	}
+	reg := try.To1(cmd.Exec(nil))
+	assert.NotEmpty(reg.OnboardingID)
+
+	status := func() onboardingStatus {
+		res := try.To1(http.Get(server.URL + "/onboarding/" + reg.OnboardingID))
+		defer res.Body.Close()
+		assert.Equal(res.StatusCode, http.StatusOK)
+		var s onboardingStatus
+		try.To(json.NewDecoder(res.Body).Decode(&s))
+		return s
+	}
+	s := status()
+	assert.Equal(s.Status, user.OnboardingPending)
+	assert.That(s.NextAttempt != nil)
+	assert.SLen(try.To1(enclave.GetPendingOnboardings()), 1)
+
+	// no tokens without the DID
+	cmd.SubCmd = "login"
+	_, err := cmd.Exec(nil)
+	assert.Error(err)
+
+	try.To(retryOnboardings(time.Now()))
+	assert.Equal(allocator.calls, 1) // not due yet
+
+	try.To(retryOnboardings(time.Now().Add(time.Hour)))
+	assert.Equal(allocator.calls, 2)
+	assert.Equal(status().Status, user.OnboardingPending)
+
+	try.To(retryOnboardings(time.Now().Add(2 * time.Hour)))
+	assert.Equal(status().Status, user.OnboardingReady)
+	assert.SLen(try.To1(enclave.GetPendingOnboardings()), 0)
+
+	var at AccessToken
+	try.To(json.Unmarshal([]byte(try.To1(cmd.Exec(nil)).Token), &at))
+	assert.Equal(try.To1(token.Parse(at.Token)).Username, "did:flaky:"+name)
+
+	// the status isn't told by the user name
+	res := try.To1(http.Get(server.URL + "/onboarding/" + name))
+	defer res.Body.Close()
+	assert.Equal(res.StatusCode, http.StatusBadRequest)
+}
+
+func TestRejectedOnboarding(t *testing.T) {
+	defer assert.PushTester(t)()
+	defer user.SetAllocator(user.GRPCAllocator{})
+
+	user.SetAllocator(rejectingAllocator{})
+	server := httptest.NewServer(newMuxWithRoutes())
+	defer server.Close()
+
+	const name = "rejected-onboarding-user"
+	cmd := authn.Cmd{
+		SubCmd:   "register",
+		UserName: name,
+		URL:      server.URL,
+		AAGUID:   "12c85a48-4baf-47bd-b51f-f192871a1511",
+		Key:      "15308490f1e4026284594dd08d31291bc8ef2aeac730d0daf6ff87bb92d4336c",
+		Origin:   defaultOrigin,
+	}
+	// the registration succeeds, but the status is final
+	reg := try.To1(cmd.Exec(nil))
+	assert.Empty(reg.OnboardingID)
+	u := try.To1(enclave.GetExistingUser(name))
+	assert.Equal(u.OnboardingStatus(), user.OnboardingRejected)
+	assert.ThatNot(u.IsOnboardingDue(time.Now().Add(time.Hour)))
+
+	res := try.To1(http.Get(server.URL + "/onboarding/" + enclave.OnboardingID(u)))
+	defer res.Body.Close()
+	var s onboardingStatus
+	try.To(json.NewDecoder(res.Body).Decode(&s))
+	assert.Equal(s.Status, user.OnboardingRejected)
+	assert.That(s.NextAttempt == nil)
+
+	cmd.SubCmd = "login"
+	_, err := cmd.Exec(nil)
+	assert.Error(err)
+}
+
+func TestRetryOnboardingRecreated(t *testing.T) {
+	defer assert.PushTester(t)()
+	defer user.SetAllocator(user.GRPCAllocator{})
+
+	user.SetAllocator(&flakyAllocator{failures: 1})
+	const name = "recreated-onboarding-user"
+	u := user.New(name, name, "")
+	allocateCloudAgent(context.Background(), u)
+	assert.That(u.IsOnboardingPending())
+	try.To(enclave.PutUser(u))
+
+	// the user is deleted and created again during the allocation
+	try.To(enclave.RemoveUser(name))
+	recreated := user.New(name, name, "")
+	try.To(enclave.PutUser(recreated))
+	defer func() { try.To(enclave.RemoveUser(name)) }()
+
+	try.To(retryOnboarding(u))
+	current := try.To1(enclave.GetExistingUser(name))
+	assert.Empty(current.DID)
+	assert.That(current.Onboarding == nil)
+
+	// the agent of the deleted user is recorded
+	found := false
+	for _, d := range try.To1(enclave.GetDeletions()) {
+		if d.DID == "did:flaky:"+name {
+			found = true
+			assert.Equal(d.Offboard, user.OffboardRetained)
+		}
+	}
+	assert.That(found)
+}
+
+// rejectingAllocator is the agency which refuses the onboarding.
+type rejectingAllocator struct{}
+
+func (rejectingAllocator) Allocate(_ context.Context, _ string, u *user.User) (string, error) {
+	return "", fmt.Errorf("%w: %s", user.ErrOnboardingRejected, u.Name)
+}
+
+// fixedAllocator gives the same DID to everybody like the agency which derives
+// the DID from the seed.
+type fixedAllocator struct{}
+
+func (fixedAllocator) Allocate(context.Context, string, *user.User) (string, error) {
+	return "did:fixed:seed", nil
+}
+
+func TestUniqueDID(t *testing.T) {
+	defer assert.PushTester(t)()
+	defer user.SetAllocator(user.GRPCAllocator{})
+
+	user.SetAllocator(fixedAllocator{})
+	victim := user.New("unique-did-victim", "victim", "seed")
+	allocateCloudAgent(context.Background(), victim)
+	assert.Equal(victim.DID, "did:fixed:seed")
+	try.To(enclave.PutUser(victim))
+	defer func() { try.To(enclave.RemoveUser(victim.Name)) }()
+
+	attacker := user.New("unique-did-attacker", "attacker", "seed")
+	allocateCloudAgent(context.Background(), attacker)
+	assert.Empty(attacker.DID)
+	assert.NotNil(attacker.Onboarding)
+
+	// the same user gets its own DID again
+	victim.DID = ""
+	allocateCloudAgent(context.Background(), victim)
+	assert.Equal(victim.DID, "did:fixed:seed")
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// registrationPolicy is the server side policy for the registration options.
+// Clients can tighten it per request but they cannot loosen it.
+type registrationPolicy struct {
+	Algorithms       []webauthncose.COSEAlgorithmIdentifier
+	ResidentKey      protocol.ResidentKeyRequirement
+	Attachment       protocol.AuthenticatorAttachment
+	UserVerification protocol.UserVerificationRequirement
+	Attestation      protocol.ConveyancePreference
+	Hints            []string
+}
+
+var (
+	regPolicy      registrationPolicy
+	adminRegPolicy registrationPolicy
+
+	// the levels tell the order of the requirement values, bigger is tighter.
+	// Empty value is what the spec defines as the default.
+	uvLevels = map[protocol.UserVerificationRequirement]int{
+		"":                               1,
+		protocol.VerificationDiscouraged: 0,
+		protocol.VerificationPreferred:   1,
+		protocol.VerificationRequired:    2,
+	}
+	rkLevels = map[protocol.ResidentKeyRequirement]int{
+		"": 0,
+		protocol.ResidentKeyRequirementDiscouraged: 0,
+		protocol.ResidentKeyRequirementPreferred:   1,
+		protocol.ResidentKeyRequirementRequired:    2,
+	}
+	attestationLevels = map[protocol.ConveyancePreference]int{
+		"":                                   0,
+		protocol.PreferNoAttestation:         0,
+		protocol.PreferIndirectAttestation:   1,
+		protocol.PreferDirectAttestation:     2,
+		protocol.PreferEnterpriseAttestation: 3,
+	}
+	attachments = map[protocol.AuthenticatorAttachment]bool{
+		"":                     true,
+		protocol.Platform:      true,
+		protocol.CrossPlatform: true,
+	}
+	knownAlgorithms = map[webauthncose.COSEAlgorithmIdentifier]bool{
+		webauthncose.AlgES256: true,
+		webauthncose.AlgES384: true,
+		webauthncose.AlgES512: true,
+		webauthncose.AlgRS256: true,
+		webauthncose.AlgRS384: true,
+		webauthncose.AlgRS512: true,
+		webauthncose.AlgPS256: true,
+		webauthncose.AlgPS384: true,
+		webauthncose.AlgPS512: true,
+		webauthncose.AlgEdDSA: true,
+	}
+	// WebAuthn L3 hints
+	hints = map[string]bool{
+		"security-key":  true,
+		"client-device": true,
+		"hybrid":        true,
+	}
+)
+
+// initRegistrationPolicies builds the registration policies from the flags.
+// The admin policy is the default policy with admin specific overrides.
+func initRegistrationPolicies() (err error) {
+	defer err2.Handle(&err, "registration policy")
+
+	p := registrationPolicy{
+		ResidentKey:      protocol.ResidentKeyRequirement(residentKey),
+		Attachment:       protocol.AuthenticatorAttachment(attachment),
+		UserVerification: protocol.UserVerificationRequirement(userVerification),
+		Attestation:      protocol.ConveyancePreference(attestation),
+		Algorithms:       try.To1(parseAlgorithms(algorithms)),
+		Hints:            splitList(registrationHints),
+	}
+	try.To(p.validate())
+	regPolicy = p
+
+	if adminUserVerification != "" {
+		p.UserVerification = protocol.UserVerificationRequirement(adminUserVerification)
+	}
+	if adminAttachment != "" {
+		p.Attachment = protocol.AuthenticatorAttachment(adminAttachment)
+	}
+	try.To(p.validate())
+	adminRegPolicy = p
+	return nil
+}
+
+// checkAttestationPolicy refuses the metadata and the AAGUID lists without
+// the attestation. Authenticators don't send their AAGUID or the attestation
+// certificate with the none conveyance, and the lists would be empty promises.
+func checkAttestationPolicy(mdsFile, allow, deny string) error {
+	if attestationLevels[regPolicy.Attestation] > 0 {
+		return nil
+	}
+	switch {
+	case mdsFile != "":
+		return fmt.Errorf("-mds-file requires attestation, not %q", regPolicy.Attestation)
+	case allow != "" || deny != "":
+		return fmt.Errorf("AAGUID lists require attestation, not %q", regPolicy.Attestation)
+	}
+	return nil
+}
+
+// policyFor returns the registration policy of the user.
+func policyFor(username string) registrationPolicy {
+	if username == findyAdmin {
+		return adminRegPolicy
+	}
+	return regPolicy
+}
+
+func (p registrationPolicy) validate() error {
+	if _, ok := uvLevels[p.UserVerification]; !ok {
+		return fmt.Errorf("unknown user verification: %s", p.UserVerification)
+	}
+	if _, ok := rkLevels[p.ResidentKey]; !ok {
+		return fmt.Errorf("unknown resident key requirement: %s", p.ResidentKey)
+	}
+	if _, ok := attestationLevels[p.Attestation]; !ok {
+		return fmt.Errorf("unknown attestation preference: %s", p.Attestation)
+	}
+	if !attachments[p.Attachment] {
+		return fmt.Errorf("unknown authenticator attachment: %s", p.Attachment)
+	}
+	for _, hint := range p.Hints {
+		if !hints[hint] {
+			return fmt.Errorf("unknown hint: %s", hint)
+		}
+	}
+	return nil
+}
+
+// tighten returns the policy with client's per request requirements. The
+// request cannot loosen the server policy.
+func (p registrationPolicy) tighten(uInfo userInfo) (_ registrationPolicy, err error) {
+	defer err2.Handle(&err, "tighten policy")
+
+	p.UserVerification = try.To1(tightenLevel(uvLevels, p.UserVerification,
+		protocol.UserVerificationRequirement(uInfo.UserVerification)))
+	p.ResidentKey = try.To1(tightenLevel(rkLevels, p.ResidentKey,
+		protocol.ResidentKeyRequirement(uInfo.ResidentKey)))
+	p.Attestation = try.To1(tightenLevel(attestationLevels, p.Attestation,
+		protocol.ConveyancePreference(uInfo.Attestation)))
+
+	if a := protocol.AuthenticatorAttachment(uInfo.AuthenticatorAttachment); a != "" {
+		if !attachments[a] || (p.Attachment != "" && p.Attachment != a) {
+			return p, fmt.Errorf("authenticator attachment not allowed: %s", a)
+		}
+		p.Attachment = a
+	}
+	if len(uInfo.Algorithms) > 0 {
+		algs := make([]webauthncose.COSEAlgorithmIdentifier, 0, len(uInfo.Algorithms))
+		for _, a := range uInfo.Algorithms {
+			alg := webauthncose.COSEAlgorithmIdentifier(a)
+			if !p.isAllowedAlgorithm(alg) {
+				return p, fmt.Errorf("algorithm not allowed: %d", a)
+			}
+			algs = append(algs, alg)
+		}
+		p.Algorithms = algs
+	}
+	if len(uInfo.Hints) > 0 {
+		for _, hint := range uInfo.Hints {
+			if !hints[hint] || (len(p.Hints) > 0 && !contains(p.Hints, hint)) {
+				return p, fmt.Errorf("hint not allowed: %s", hint)
+			}
+		}
+		p.Hints = uInfo.Hints
+	}
+	return p, nil
+}
+
+// apply sets the policy to the credential creation options.
+func (p registrationPolicy) apply(opts *protocol.PublicKeyCredentialCreationOptions) {
+	if len(p.Algorithms) > 0 {
+		params := make([]protocol.CredentialParameter, 0, len(p.Algorithms))
+		for _, alg := range p.Algorithms {
+			params = append(params, protocol.CredentialParameter{
+				Type:      protocol.PublicKeyCredentialType,
+				Algorithm: alg,
+			})
+		}
+		opts.Parameters = params
+	}
+	sel := &opts.AuthenticatorSelection
+	sel.AuthenticatorAttachment = p.Attachment
+	sel.UserVerification = p.UserVerification
+	if p.ResidentKey != "" {
+		sel.ResidentKey = p.ResidentKey
+		required := p.ResidentKey == protocol.ResidentKeyRequirementRequired
+		sel.RequireResidentKey = &required
+	}
+	if p.Attestation != "" {
+		opts.Attestation = p.Attestation
+	}
+}
+
+// verify checks that the new credential fulfills the policy. User
+// verification is checked by the webauthn library already.
+func (p registrationPolicy) verify(cred *webauthn.Credential) (err error) {
+	defer err2.Handle(&err, "registration policy")
+
+	if len(p.Algorithms) > 0 {
+		var key webauthncose.PublicKeyData
+		try.To(webauthncbor.Unmarshal(cred.PublicKey, &key))
+		alg := webauthncose.COSEAlgorithmIdentifier(key.Algorithm)
+		if !p.isAllowedAlgorithm(alg) {
+			return fmt.Errorf("%w: algorithm not allowed: %d", errBadRequest, alg)
+		}
+	}
+	// the client must report the attachment if the policy requires one
+	a := cred.Authenticator.Attachment
+	if p.Attachment != "" && a != p.Attachment {
+		return fmt.Errorf("%w: authenticator attachment not allowed: %q",
+			errBadRequest, a)
+	}
+	return nil
+}
+
+// isAllowedAlgorithm tells if alg is in the policy. If the policy doesn't
+// have algorithms, all the known algorithms are allowed.
+func (p registrationPolicy) isAllowedAlgorithm(alg webauthncose.COSEAlgorithmIdentifier) bool {
+	if len(p.Algorithms) == 0 {
+		return knownAlgorithms[alg]
+	}
+	for _, a := range p.Algorithms {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// creationOptions adds the WebAuthn L3 hints to the creation options, because
+// the webauthn library doesn't support them yet.
+type creationOptions struct {
+	protocol.PublicKeyCredentialCreationOptions
+	Hints []string `json:"hints,omitempty"`
+}
+
+func tightenLevel[T comparable](levels map[T]int, current, requested T) (T, error) {
+	var empty T
+	if requested == empty {
+		return current, nil
+	}
+	level, ok := levels[requested]
+	if !ok {
+		return current, fmt.Errorf("unknown requirement: %v", requested)
+	}
+	if level < levels[current] {
+		return current, fmt.Errorf("cannot loosen requirement %v to %v",
+			current, requested)
+	}
+	return requested, nil
+}
+
+func parseAlgorithms(s string) (_ []webauthncose.COSEAlgorithmIdentifier, err error) {
+	defer err2.Handle(&err)
+
+	var algs []webauthncose.COSEAlgorithmIdentifier
+	for _, a := range splitList(s) {
+		alg := webauthncose.COSEAlgorithmIdentifier(try.To1(strconv.Atoi(a)))
+		if !knownAlgorithms[alg] {
+			return nil, fmt.Errorf("unknown algorithm: %d", alg)
+		}
+		algs = append(algs, alg)
+	}
+	return algs, nil
+}
+
+func splitList(s string) (list []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestPolicyTighten(t *testing.T) {
+	server := registrationPolicy{
+		Algorithms:       []webauthncose.COSEAlgorithmIdentifier{webauthncose.AlgES256, webauthncose.AlgEdDSA},
+		ResidentKey:      protocol.ResidentKeyRequirementPreferred,
+		UserVerification: protocol.VerificationPreferred,
+		Attachment:       protocol.Platform,
+		Hints:            []string{"client-device", "hybrid"},
+	}
+	tests := []struct {
+		name    string
+		req     userInfo
+		wantErr bool
+	}{
+		{"empty", userInfo{}, false},
+		{"uv required", userInfo{UserVerification: "required"}, false},
+		{"uv discouraged", userInfo{UserVerification: "discouraged"}, true},
+		{"uv unknown", userInfo{UserVerification: "always"}, true},
+		{"rk required", userInfo{ResidentKey: "required"}, false},
+		{"rk discouraged", userInfo{ResidentKey: "discouraged"}, true},
+		{"attestation direct", userInfo{Attestation: "direct"}, false},
+		{"platform", userInfo{AuthenticatorAttachment: "platform"}, false},
+		{"cross-platform", userInfo{AuthenticatorAttachment: "cross-platform"}, true},
+		{"algorithm subset", userInfo{Algorithms: []int64{-8}}, false},
+		{"algorithm outside", userInfo{Algorithms: []int64{-257}}, true},
+		{"hint subset", userInfo{Hints: []string{"hybrid"}}, false},
+		{"hint outside", userInfo{Hints: []string{"security-key"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer assert.PushTester(t)()
+
+			p, err := server.tighten(tt.req)
+			if tt.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+
+			var opts protocol.PublicKeyCredentialCreationOptions
+			p.apply(&opts)
+			assert.Equal(opts.AuthenticatorSelection.AuthenticatorAttachment, protocol.Platform)
+			if tt.req.UserVerification != "" {
+				assert.Equal(string(opts.AuthenticatorSelection.UserVerification),
+					tt.req.UserVerification)
+			}
+			if len(tt.req.Algorithms) > 0 {
+				assert.SLen(opts.Parameters, len(tt.req.Algorithms))
+			} else {
+				assert.SLen(opts.Parameters, len(server.Algorithms))
+			}
+		})
+	}
+}
+
+func TestPolicyVerify(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	key := try.To1(webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+	}))
+	cred := &webauthn.Credential{PublicKey: key}
+	cred.Authenticator.Attachment = protocol.CrossPlatform
+
+	p := registrationPolicy{}
+	assert.NoError(p.verify(cred))
+
+	p.Algorithms = []webauthncose.COSEAlgorithmIdentifier{webauthncose.AlgEdDSA}
+	assert.Error(p.verify(cred))
+
+	p.Algorithms = []webauthncose.COSEAlgorithmIdentifier{webauthncose.AlgES256}
+	assert.NoError(p.verify(cred))
+
+	p.Attachment = protocol.Platform
+	assert.Error(p.verify(cred))
+
+	// the attachment is required when the policy has one
+	cred.Authenticator.Attachment = ""
+	assert.Error(p.verify(cred))
+	cred.Authenticator.Attachment = protocol.Platform
+	assert.NoError(p.verify(cred))
+}
+
+func TestCheckAttestationPolicy(t *testing.T) {
+	defer assert.PushTester(t)()
+	defer func(p registrationPolicy) { regPolicy = p }(regPolicy)
+
+	regPolicy.Attestation = protocol.PreferNoAttestation
+	assert.NoError(checkAttestationPolicy("", "", ""))
+	assert.Error(checkAttestationPolicy("blob.jwt", "", ""))
+	assert.Error(checkAttestationPolicy("", "12c85a48-4baf-47bd-b51f-f192871a1511", ""))
+	assert.Error(checkAttestationPolicy("", "", "12c85a48-4baf-47bd-b51f-f192871a1511"))
+
+	regPolicy.Attestation = protocol.PreferDirectAttestation
+	assert.NoError(checkAttestationPolicy("blob.jwt", "12c85a48-4baf-47bd-b51f-f192871a1511", ""))
+}
@@ -0,0 +1,217 @@
+package session
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// DefaultCeremonyTimeout is the lifetime of the ceremony if the webauthn
+// session data doesn't have its own expiration time.
+const DefaultCeremonyTimeout = 5 * time.Minute
+
+// ceremonyIDLength is the length of the random ceremony ID in bytes.
+const ceremonyIDLength = 24
+
+var (
+	// ErrCeremonyNotFound is returned when the ceremony doesn't exist or it's
+	// already used.
+	ErrCeremonyNotFound = errors.New("ceremony not found")
+
+	// ErrCeremonyExpired is returned when the ceremony's challenge has
+	// expired.
+	ErrCeremonyExpired = errors.New("ceremony expired")
+)
+
+// CeremonyStore keeps the webauthn session data of the ongoing ceremonies on
+// the server side. Every ceremony has its own random ID, which means that the
+// same client can run several ceremonies at the same time. The challenge of the
+// ceremony can be used only once, because Take removes the ceremony.
+type CeremonyStore struct {
+	sync.Mutex
+
+	timeout time.Duration
+	backend CeremonyBackend
+	purged  time.Time
+}
+
+// CeremonyBackend stores the encoded ceremonies by their keys. With the
+// persistent backend, e.g. the enclave, the ceremonies survive the restarts.
+type CeremonyBackend interface {
+	PutCeremony(key string, data []byte) error
+	GetCeremony(key string) (data []byte, exist bool, err error)
+	RemoveCeremony(key string) error
+	GetCeremonies() ([][]byte, error)
+}
+
+// Ceremony is the server side data of the ongoing ceremony.
+type Ceremony struct {
+	webauthn.SessionData
+
+	// State is the application's own data of the ceremony, e.g. the
+	// registration policy offered to the client. The store doesn't interpret
+	// it.
+	State []byte
+}
+
+// ceremony is the stored record of the ceremony.
+type ceremony struct {
+	Key     string
+	Data    Ceremony
+	Expires time.Time
+}
+
+// purgeInterval is how often the expired ceremonies are removed at most.
+const purgeInterval = time.Minute
+
+// NewCeremonyStore returns a new ceremony store. The timeout is used for the
+// ceremonies which don't have their own expiration time. If the backend is
+// nil, the ceremonies are kept in memory.
+func NewCeremonyStore(timeout time.Duration, backend CeremonyBackend) *CeremonyStore {
+	if timeout <= 0 {
+		timeout = DefaultCeremonyTimeout
+	}
+	if backend == nil {
+		backend = &memCeremonies{ceremonies: make(map[string][]byte)}
+	}
+	return &CeremonyStore{
+		timeout: timeout,
+		backend: backend,
+	}
+}
+
+// Put stores the session data and the state of the new ceremony of the kind,
+// e.g. "registration", and returns the ceremony ID. The state can be nil.
+func (s *CeremonyStore) Put(
+	kind string,
+	data *webauthn.SessionData,
+	state []byte,
+) (id string, err error) {
+	defer err2.Handle(&err, "put ceremony")
+
+	id = base64.RawURLEncoding.EncodeToString(
+		try.To1(GenerateSecureKey(ceremonyIDLength)))
+
+	now := time.Now()
+	expires := data.Expires
+	if expires.IsZero() {
+		expires = now.Add(s.timeout)
+	}
+	key := ceremonyKey(kind, id)
+	record := try.To1(json.Marshal(ceremony{
+		Key:     key,
+		Data:    Ceremony{SessionData: *data, State: state},
+		Expires: expires,
+	}))
+
+	s.Lock()
+	defer s.Unlock()
+
+	if now.Sub(s.purged) >= purgeInterval {
+		try.To(s.purge(now))
+	}
+	try.To(s.backend.PutCeremony(key, record))
+	return id, nil
+}
+
+// Take returns the ceremony and removes it from the store. The same ceremony
+// cannot be taken twice.
+func (s *CeremonyStore) Take(kind, id string) (_ Ceremony, err error) {
+	defer err2.Handle(&err, "take ceremony")
+
+	if id == "" {
+		return Ceremony{}, ErrCeremonyNotFound
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	key := ceremonyKey(kind, id)
+	data, found := try.To2(s.backend.GetCeremony(key))
+	if !found {
+		return Ceremony{}, ErrCeremonyNotFound
+	}
+	try.To(s.backend.RemoveCeremony(key))
+
+	var c ceremony
+	try.To(json.Unmarshal(data, &c))
+	if c.Expires.Before(time.Now()) {
+		return Ceremony{}, ErrCeremonyExpired
+	}
+	return c.Data, nil
+}
+
+// Len returns the number of the ongoing ceremonies.
+func (s *CeremonyStore) Len() int {
+	s.Lock()
+	defer s.Unlock()
+
+	records, err := s.backend.GetCeremonies()
+	if err != nil {
+		return 0
+	}
+	return len(records)
+}
+
+// purge removes the expired ceremonies. Caller must hold the lock.
+func (s *CeremonyStore) purge(now time.Time) (err error) {
+	defer err2.Handle(&err, "purge")
+
+	for _, data := range try.To1(s.backend.GetCeremonies()) {
+		var c ceremony
+		if json.Unmarshal(data, &c) != nil || c.Expires.Before(now) {
+			try.To(s.backend.RemoveCeremony(c.Key))
+		}
+	}
+	s.purged = now
+	return nil
+}
+
+// CeremonyKey returns the backend key of the encoded ceremony, e.g. for
+// re-keying the backend.
+func CeremonyKey(data []byte) (string, error) {
+	var c ceremony
+	if err := json.Unmarshal(data, &c); err != nil {
+		return "", err
+	}
+	return c.Key, nil
+}
+
+func ceremonyKey(kind, id string) string {
+	return kind + "/" + id
+}
+
+// memCeremonies is the in-memory CeremonyBackend. The store's lock protects
+// it.
+type memCeremonies struct {
+	ceremonies map[string][]byte
+}
+
+func (m *memCeremonies) PutCeremony(key string, data []byte) error {
+	m.ceremonies[key] = data
+	return nil
+}
+
+func (m *memCeremonies) GetCeremony(key string) ([]byte, bool, error) {
+	data, found := m.ceremonies[key]
+	return data, found, nil
+}
+
+func (m *memCeremonies) RemoveCeremony(key string) error {
+	delete(m.ceremonies, key)
+	return nil
+}
+
+func (m *memCeremonies) GetCeremonies() ([][]byte, error) {
+	records := make([][]byte, 0, len(m.ceremonies))
+	for _, data := range m.ceremonies {
+		records = append(records, data)
+	}
+	return records, nil
+}
@@ -0,0 +1,78 @@
+package session
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestCeremonyStore(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	s := NewCeremonyStore(time.Minute, nil)
+
+	id1 := try.To1(s.Put("registration", &webauthn.SessionData{Challenge: "1"}, nil))
+	id2 := try.To1(s.Put("registration", &webauthn.SessionData{Challenge: "2"}, nil))
+	assert.NotEqual(id1, id2)
+	id3 := try.To1(s.Put("registration", &webauthn.SessionData{Challenge: "3"},
+		[]byte("state")))
+	data := try.To1(s.Take("registration", id3))
+	assert.Equal(string(data.State), "state")
+	assert.Equal(s.Len(), 2)
+
+	_, err := s.Take("authentication", id1)
+	assert.Error(err)
+
+	data = try.To1(s.Take("registration", id2))
+	assert.Equal(data.Challenge, "2")
+	assert.SLen(data.State, 0)
+	data = try.To1(s.Take("registration", id1))
+	assert.Equal(data.Challenge, "1")
+
+	// single use
+	_, err = s.Take("registration", id1)
+	assert.Error(err)
+	assert.Equal(s.Len(), 0)
+
+	_, err = s.Take("registration", "")
+	assert.Error(err)
+}
+
+func TestCeremonyExpiry(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	s := NewCeremonyStore(time.Minute, nil)
+
+	expired := try.To1(s.Put("authentication", &webauthn.SessionData{
+		Expires: time.Now().Add(-time.Second),
+	}, nil))
+	_, err := s.Take("authentication", expired)
+	assert.That(errors.Is(err, ErrCeremonyExpired))
+
+	_ = try.To1(s.Put("authentication", &webauthn.SessionData{
+		Expires: time.Now().Add(-time.Second),
+	}, nil))
+	// expired ceremonies are purged when new ones are added
+	s.purged = time.Time{}
+	_ = try.To1(s.Put("authentication", &webauthn.SessionData{}, nil))
+	assert.Equal(s.Len(), 1)
+}
+
+func TestCeremonyBackend(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	backend := &memCeremonies{ceremonies: make(map[string][]byte)}
+	id := try.To1(NewCeremonyStore(time.Minute, backend).Put("registration",
+		&webauthn.SessionData{Challenge: "1"}, []byte("state")))
+
+	// e.g. after the restart
+	s := NewCeremonyStore(time.Minute, backend)
+	c := try.To1(s.Take("registration", id))
+	assert.Equal(c.Challenge, "1")
+	assert.Equal(string(c.State), "state")
+	assert.Equal(s.Len(), 0)
+}
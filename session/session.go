@@ -2,9 +2,12 @@ package session
 
 import (
 	"crypto/rand"
-	"encoding/json"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"net/http"
+	"os"
+	"strings"
 
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/golang/glog"
@@ -43,12 +46,18 @@ func GenerateSecureKey(n int) ([]byte, error) {
 }
 
 // Store is a wrapper around sessions.CookieStore which provides some helper
-// methods related to webauthn operations.
+// methods related to webauthn operations. The webauthn session data is kept in
+// the server side ceremony store, and the cookie holds only the ID of the
+// latest ceremony.
 type Store struct {
 	*sessions.CookieStore
+
+	Ceremonies *CeremonyStore
 }
 
-// NewStore returns a new session store.
+// NewStore returns a new session store. The keyPairs are the hash and
+// encryption key pairs of the session cookies, see ParseKeyPairs. If they are
+// missing, a random key is generated and the cookies don't survive restarts.
 func NewStore(keyPairs ...[]byte) (*Store, error) {
 	// Generate a default encryption key if one isn't provided
 	if len(keyPairs) == 0 {
@@ -59,40 +68,48 @@ func NewStore(keyPairs ...[]byte) (*Store, error) {
 		keyPairs = append(keyPairs, key)
 	}
 	store := &Store{
-		sessions.NewCookieStore(keyPairs...),
+		CookieStore: sessions.NewCookieStore(keyPairs...),
+		Ceremonies:  NewCeremonyStore(DefaultCeremonyTimeout, nil),
 	}
 	return store, nil
 }
 
-// SaveWebauthnSession marhsals and saves the webauthn data to the provided
-// key given the request and responsewriter
-func (store *Store) SaveWebauthnSession(key string, data *webauthn.SessionData, r *http.Request, w http.ResponseWriter) error {
-	marshaledData, err := json.Marshal(data)
-	if err != nil {
-		return err
-	}
-	return store.Set(key, marshaledData, r, w)
+// SaveWebauthnSession saves the webauthn data and the state to the ceremony
+// store and the ceremony ID to the session cookie with the provided key. The
+// ceremony ID is returned that the client can run several ceremonies in
+// parallel.
+func (store *Store) SaveWebauthnSession(
+	key string,
+	data *webauthn.SessionData,
+	state []byte,
+	r *http.Request,
+	w http.ResponseWriter,
+) (id string, err error) {
+	defer err2.Handle(&err)
+
+	id = try.To1(store.Ceremonies.Put(key, data, state))
+	try.To(store.Set(key, id, r, w))
+	return id, nil
 }
 
-// GetWebauthnSession unmarshals and returns the webauthn session information
-// from the session cookie.
-func (store *Store) GetWebauthnSession(key string, r *http.Request) (webauthn.SessionData, error) {
-	sessionData := webauthn.SessionData{}
-	session, err := store.Get(r, WebauthnSession)
-	if err != nil {
-		return sessionData, err
-	}
-	assertion, ok := session.Values[key].([]byte)
-	if !ok {
-		return sessionData, ErrMarshal
-	}
-	err = json.Unmarshal(assertion, &sessionData)
-	if err != nil {
-		return sessionData, err
+// GetWebauthnSession returns the webauthn session information of the ceremony
+// and removes it from the store, i.e. the challenge can be used only once. If
+// the id is empty, the ceremony ID is read from the session cookie.
+func (store *Store) GetWebauthnSession(key, id string, r *http.Request) (
+	c Ceremony,
+	err error,
+) {
+	defer err2.Handle(&err)
+
+	if id == "" {
+		session := try.To1(store.Get(r, WebauthnSession))
+		var ok bool
+		id, ok = session.Values[key].(string)
+		if !ok {
+			return c, ErrMarshal
+		}
 	}
-	// Delete the value from the session now that it's been read
-	delete(session.Values, key)
-	return sessionData, nil
+	return store.Ceremonies.Take(key, id)
 }
 
 // Set stores a value to the session with the provided key.
@@ -107,3 +124,47 @@ func (store *Store) Set(key string, value interface{}, r *http.Request, w http.R
 	try.To(session.Save(r, w))
 	return nil
 }
+
+// ParseKeyPairs parses the session cookie keys. The keys are separated with
+// comma or new line. Every key is a hex coded hash key, and optionally a colon
+// and a hex coded encryption key, e.g. "hashkey:blockkey". The first key is
+// used to sign and encrypt the cookies, the rest are only accepted, which
+// allows the key rotation.
+func ParseKeyPairs(keys string) (keyPairs [][]byte, err error) {
+	defer err2.Handle(&err, "parse session keys")
+
+	for _, key := range strings.FieldsFunc(keys, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	}) {
+		key = strings.TrimSpace(key)
+		if key == "" || strings.HasPrefix(key, "#") {
+			continue
+		}
+		hashHex, blockHex, _ := strings.Cut(key, ":")
+		hashKey := try.To1(hex.DecodeString(hashHex))
+		if len(hashKey) < DefaultEncryptionKeyLength {
+			return nil, fmt.Errorf("hash key too short: %d bytes", len(hashKey))
+		}
+		var blockKey []byte
+		if blockHex != "" {
+			blockKey = try.To1(hex.DecodeString(blockHex))
+			switch len(blockKey) {
+			case 16, 24, 32:
+			default:
+				return nil, fmt.Errorf("illegal encryption key length: %d bytes",
+					len(blockKey))
+			}
+		}
+		keyPairs = append(keyPairs, hashKey, blockKey)
+	}
+	return keyPairs, nil
+}
+
+// LoadKeyPairs reads the session cookie keys from the file. See ParseKeyPairs
+// for the format.
+func LoadKeyPairs(filename string) (_ [][]byte, err error) {
+	defer err2.Handle(&err, "load session keys")
+
+	data := try.To1(os.ReadFile(filename))
+	return ParseKeyPairs(string(data))
+}
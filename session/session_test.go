@@ -0,0 +1,82 @@
+package session
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+var (
+	oldKey = hex.EncodeToString([]byte(strings.Repeat("o", 32))) + ":" +
+		hex.EncodeToString([]byte(strings.Repeat("O", 32)))
+	newKey = hex.EncodeToString([]byte(strings.Repeat("n", 64))) + ":" +
+		hex.EncodeToString([]byte(strings.Repeat("N", 16)))
+	hashOnlyKey = hex.EncodeToString([]byte(strings.Repeat("h", 32)))
+)
+
+func TestParseKeyPairs(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	pairs := try.To1(ParseKeyPairs(newKey + ", " + oldKey + "\n" + hashOnlyKey))
+	assert.SLen(pairs, 6)
+	assert.SLen(pairs[0], 64)
+	assert.SLen(pairs[1], 16)
+	assert.SLen(pairs[5], 0)
+
+	pairs = try.To1(ParseKeyPairs(""))
+	assert.SLen(pairs, 0)
+
+	_, err := ParseKeyPairs("not-hex")
+	assert.Error(err)
+	_, err = ParseKeyPairs("abcd")
+	assert.Error(err)
+	_, err = ParseKeyPairs(hashOnlyKey + ":abcd")
+	assert.Error(err)
+
+	filename := filepath.Join(t.TempDir(), "keys")
+	try.To(os.WriteFile(filename, []byte("# current\n"+newKey+"\n"+oldKey+"\n"), 0600))
+	pairs = try.To1(LoadKeyPairs(filename))
+	assert.SLen(pairs, 4)
+}
+
+func TestKeyRotation(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	store := func(keys string) *Store {
+		return try.To1(NewStore(try.To1(ParseKeyPairs(keys))...))
+	}
+	save := func(s *Store) []string {
+		w := httptest.NewRecorder()
+		try.To(s.Set("key", "value", httptest.NewRequest("GET", "/", nil), w))
+		return w.Result().Header["Set-Cookie"]
+	}
+	load := func(s *Store, cookies []string) (string, error) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header = http.Header{"Cookie": cookies}
+		session, err := s.Get(r, WebauthnSession)
+		v, _ := session.Values["key"].(string)
+		return v, err
+	}
+
+	oldCookie := save(store(oldKey))
+
+	// rotated store accepts cookies signed with the old key
+	rotated := store(newKey + "," + oldKey)
+	v := try.To1(load(rotated, oldCookie))
+	assert.Equal(v, "value")
+
+	// and signs with the new one
+	newCookie := save(rotated)
+	v = try.To1(load(store(newKey), newCookie))
+	assert.Equal(v, "value")
+
+	_, err := load(store(newKey), oldCookie)
+	assert.Error(err)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/enclave"
+	"github.com/findy-network/findy-agent-auth/token"
+	"github.com/findy-network/findy-agent-auth/user"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang/glog"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// stepUpLifetime is the lifetime of the elevated tokens.
+func stepUpLifetime() time.Duration {
+	return time.Duration(stepUpLifetimeMins) * time.Minute
+}
+
+// BeginStepUp starts the step-up re-authentication of the logged in user. It's
+// a login ceremony which requires the user verification. Valid JWT of the user
+// is required.
+func BeginStepUp(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	defer err2.Handle(&err, markErrBadRequest)
+
+	claims := try.To1(loginClaims(r))
+	u, exists := try.To2(enclave.GetUserByDID(claims.Username))
+	if !exists {
+		err2.Throwf("user not exist")
+	}
+	try.To(requireEnabled(u))
+
+	defer err2.Handle(&err, markErrInternal)
+
+	options, sessionData := try.To2(webAuthn.BeginLogin(u,
+		webauthn.WithUserVerification(protocol.VerificationRequired)))
+	try.To(saveWebauthnSession("stepup", sessionData, r, w))
+
+	jsonResponse(w, options.Response, nil)
+	glog.V(1).Infoln("begin step-up", u.Name)
+}
+
+// FinishStepUp finishes the step-up re-authentication and returns the short
+// lived elevated token, which is required for the sensitive operations.
+func FinishStepUp(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	defer err2.Handle(&err, markErrBadRequest)
+
+	sessionData := try.To1(getWebauthnSession("stepup", r))
+	u := try.To1(enclave.GetExistingUserByWebAuthnID(sessionData.UserID))
+	try.To(requireEnabled(u))
+	credential := try.To1(webAuthn.FinishLogin(u, sessionData, r))
+	if !credential.Flags.UserVerified {
+		err2.Throwf("user verification required")
+	}
+	try.To(updateLoginCredential(u, credential))
+
+	defer err2.Handle(&err, markErrInternal)
+
+	ts, claims := try.To2(token.IssueElevated(u.DID, u.DisplayName,
+		user.AuthOf(credential), stepUpLifetime()))
+	try.To(recordAccess(u.Name, credential.ID, claims))
+
+	jsonResponse(w, AccessToken{Token: ts}, nil)
+	glog.V(1).Infoln("finish step-up", u.Name)
+}
+
+// requireElevated checks that the claims of the request are of the elevated
+// token of the user. If the token is valid but not elevated, the client is
+// asked to run the step-up ceremony (RFC 9470).
+func requireElevated(w http.ResponseWriter, claims *token.Claims, u *user.User) error {
+	if u.DID == "" || claims.Username != u.DID {
+		return fmt.Errorf("%w: invalid token", errBadRequest)
+	}
+	if !claims.Elevated() {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+			`Bearer error="insufficient_user_authentication", acr_values="%s"`,
+			token.ACRStepUp))
+		return fmt.Errorf("%w: %w", errUnauthorized, errStepUpRequired)
+	}
+	return nil
+}
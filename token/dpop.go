@@ -0,0 +1,223 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/ceremony"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// DPoPWindow is the maximum age of the DPoP proof. The same time is allowed
+// for the clock skew to the future.
+const DPoPWindow = time.Minute
+
+var (
+	// ErrDPoP is returned when the DPoP proof or the key binding cannot be
+	// verified.
+	ErrDPoP = errors.New("invalid DPoP proof")
+
+	dpopReplays = &replayCache{seen: make(map[string]time.Time)}
+)
+
+// Confirmation is the cnf claim (RFC 7800) of the tokens bound to the client's
+// key.
+type Confirmation struct {
+	JKT string `json:"jkt"`
+}
+
+// VerifyDPoPProof verifies the DPoP proof of the HTTP request, and returns the
+// JWK thumbprint of the proof's key. The access token is empty when the proof
+// is sent to get a new token, otherwise the proof must have its hash. The same
+// proof can be used only once.
+func VerifyDPoPProof(proof, method, url, accessToken string) (jkt string, err error) {
+	defer err2.Handle(&err, func(err error) error {
+		return fmt.Errorf("%w: %w", ErrDPoP, err)
+	})
+
+	claims := new(ceremony.DPoPClaims)
+	_ = try.To1(jwt.ParseWithClaims(proof, claims, func(t *jwt.Token) (any, error) {
+		if typ, _ := t.Header["typ"].(string); typ != ceremony.DPoPType {
+			return nil, fmt.Errorf("wrong typ: %s", typ)
+		}
+		k, err := proofKey(t.Header["jwk"])
+		if err != nil {
+			return nil, err
+		}
+		if k.method.Alg() != t.Method.Alg() {
+			return nil, fmt.Errorf("wrong algorithm for the key: %s", t.Method.Alg())
+		}
+		jkt = k.kid
+		return k.public, nil
+	}, jwt.WithValidMethods([]string{"ES256", "EdDSA"})))
+
+	if claims.ID == "" || claims.IssuedAt == nil {
+		return "", errors.New("jti and iat are required")
+	}
+	if age := time.Since(claims.IssuedAt.Time); age > DPoPWindow || age < -DPoPWindow {
+		return "", errors.New("proof expired")
+	}
+	if claims.Method != method || trimURL(claims.URL) != trimURL(url) {
+		return "", fmt.Errorf("proof for other request: %s %s", claims.Method, claims.URL)
+	}
+	if accessToken != "" && claims.AccessTokenHash != ceremony.AccessTokenHash(accessToken) {
+		return "", errors.New("proof for other access token")
+	}
+	if !dpopReplays.add(jkt+"/"+claims.ID, claims.IssuedAt.Time) {
+		return "", errors.New("proof already used")
+	}
+	return jkt, nil
+}
+
+// FromDPoP verifies the DPoP bound access token of the request and its
+// proof, and returns the token's claims. The resource servers can use it
+// instead of the bearer tokens. The proof is single use, i.e. the request is
+// verified only once.
+func FromDPoP(r *http.Request) (claims *Claims, err error) {
+	defer err2.Handle(&err)
+
+	const prefix = ceremony.DPoPHeader + " "
+
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, prefix) {
+		return nil, fmt.Errorf("%w: DPoP token missing", ErrDPoP)
+	}
+	proofs := r.Header.Values(ceremony.DPoPHeader)
+	if len(proofs) != 1 {
+		return nil, fmt.Errorf("%w: one DPoP proof required", ErrDPoP)
+	}
+	ts := strings.TrimPrefix(authorization, prefix)
+	claims = try.To1(Parse(ts))
+	if claims.Confirmation == nil {
+		return nil, fmt.Errorf("%w: token isn't DPoP bound", ErrDPoP)
+	}
+	jkt := try.To1(VerifyDPoPProof(proofs[0], r.Method, RequestURL(r), ts))
+	if jkt != claims.Confirmation.JKT {
+		return nil, fmt.Errorf("%w: wrong key", ErrDPoP)
+	}
+	return claims, nil
+}
+
+// FromRequest returns the claims of the access token of the request. The
+// token of the DPoP authorization scheme is verified with FromDPoP, and the
+// others with FromBearer.
+func FromRequest(r *http.Request) (*Claims, error) {
+	if strings.HasPrefix(r.Header.Get("Authorization"), ceremony.DPoPHeader+" ") {
+		return FromDPoP(r)
+	}
+	return FromBearer(r.Header["Authorization"])
+}
+
+// FromLoginRequest returns the claims of our own login token of the request
+// like FromRequest. The access tokens of the OIDC clients are refused with
+// ErrClientToken.
+func FromLoginRequest(r *http.Request) (*Claims, error) {
+	claims, err := FromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if !claims.FirstParty() {
+		return nil, fmt.Errorf("%w: %w", ErrInvalid, ErrClientToken)
+	}
+	return claims, nil
+}
+
+// RequestURL returns the URL of the request without the query, i.e. the htu
+// claim the client should use. The X-Forwarded-Proto header is used behind the
+// TLS terminating proxy.
+func RequestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.Path
+}
+
+// trimURL removes the query and the fragment, which aren't compared.
+func trimURL(url string) string {
+	if i := strings.IndexAny(url, "?#"); i >= 0 {
+		return url[:i]
+	}
+	return url
+}
+
+// proofKey returns the public key of the jwk header.
+func proofKey(header any) (_ *key, err error) {
+	defer err2.Handle(&err, "jwk")
+
+	var jwk struct {
+		JWK
+		D string `json:"d"`
+	}
+	try.To(json.Unmarshal(try.To1(json.Marshal(header)), &jwk))
+	if jwk.D != "" {
+		return nil, errors.New("private key not allowed")
+	}
+	return newKey(try.To1(jwk.publicKey()))
+}
+
+// publicKey returns the public key of the JWK.
+func (j JWK) publicKey() (_ crypto.PublicKey, err error) {
+	defer err2.Handle(&err)
+
+	x := try.To1(base64.RawURLEncoding.DecodeString(j.X))
+	switch {
+	case j.Kty == "EC" && j.Crv == "P-256":
+		y := try.To1(base64.RawURLEncoding.DecodeString(j.Y))
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("wrong key size")
+		}
+		// validates that the point is on the curve
+		_ = try.To1(ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)))
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	case j.Kty == "OKP" && j.Crv == "Ed25519":
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("wrong key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key: %s %s", j.Kty, j.Crv)
+}
+
+// replayCache remembers the used proofs until they are expired anyway.
+type replayCache struct {
+	sync.Mutex
+	seen map[string]time.Time
+}
+
+// add adds the proof and tells if it wasn't used before.
+func (c *replayCache) add(id string, iat time.Time) bool {
+	now := time.Now()
+
+	c.Lock()
+	defer c.Unlock()
+
+	for k, t := range c.seen {
+		if now.Sub(t) > 2*DPoPWindow {
+			delete(c.seen, k)
+		}
+	}
+	if _, found := c.seen[id]; found {
+		return false
+	}
+	c.seen[id] = iat
+	return true
+}
@@ -0,0 +1,127 @@
+package token
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/ceremony"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+const resourceURL = "https://api.example.com/resource"
+
+func newProof(t *testing.T, k *ecdsa.PrivateKey, claims ceremony.DPoPClaims) string {
+	t.Helper()
+	pk, _ := try.To2(newKeyAndJWK(k))
+	tok := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	tok.Header["typ"] = ceremony.DPoPType
+	tok.Header["jwk"] = pk
+	return try.To1(tok.SignedString(k))
+}
+
+func newKeyAndJWK(k *ecdsa.PrivateKey) (JWK, string, error) {
+	pub, err := newKey(&k.PublicKey)
+	if err != nil {
+		return JWK{}, "", err
+	}
+	jwk := pub.jwk()
+	jwk.Kid, jwk.Alg, jwk.Use = "", "", ""
+	return jwk, pub.kid, nil
+}
+
+func proofClaims(method, url, ath string) ceremony.DPoPClaims {
+	return ceremony.DPoPClaims{
+		Method:          method,
+		URL:             url,
+		AccessTokenHash: ath,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       try.To1(randomString(8)),
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+		},
+	}
+}
+
+func TestVerifyDPoPProof(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	k := try.To1(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+	_, thumbprint := try.To2(newKeyAndJWK(k))
+
+	proof := newProof(t, k, proofClaims("POST", resourceURL+"?q=1", ""))
+	jkt := try.To1(VerifyDPoPProof(proof, "POST", resourceURL, ""))
+	assert.Equal(jkt, thumbprint)
+	_, err := VerifyDPoPProof(proof, "POST", resourceURL, "")
+	assert.Error(err) // replay
+
+	_, err = VerifyDPoPProof(newProof(t, k, proofClaims("GET", resourceURL, "")),
+		"POST", resourceURL, "")
+	assert.Error(err)
+	_, err = VerifyDPoPProof(newProof(t, k, proofClaims("POST", resourceURL+"/x", "")),
+		"POST", resourceURL, "")
+	assert.Error(err)
+	_, err = VerifyDPoPProof(newProof(t, k, proofClaims("POST", resourceURL, "")),
+		"POST", resourceURL, "access-token")
+	assert.Error(err)
+
+	old := proofClaims("POST", resourceURL, "")
+	old.IssuedAt = jwt.NewNumericDate(time.Now().Add(-2 * DPoPWindow))
+	_, err = VerifyDPoPProof(newProof(t, k, old), "POST", resourceURL, "")
+	assert.Error(err)
+
+	noJTI := proofClaims("POST", resourceURL, "")
+	noJTI.ID = ""
+	_, err = VerifyDPoPProof(newProof(t, k, noJTI), "POST", resourceURL, "")
+	assert.Error(err)
+
+	tok := jwt.NewWithClaims(jwt.SigningMethodES256, proofClaims("POST", resourceURL, ""))
+	tok.Header["typ"] = ceremony.DPoPType
+	tok.Header["jwk"] = map[string]string{"kty": "EC", "crv": "P-256",
+		"x": "AAAA", "y": "AAAA"}
+	_, err = VerifyDPoPProof(try.To1(tok.SignedString(k)), "POST", resourceURL, "")
+	assert.Error(err)
+}
+
+func TestFromDPoP(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	k := try.To1(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+	_, jkt := try.To2(newKeyAndJWK(k))
+	bound := try.To1(Build("did:test", "", &Auth{Time: time.Now(), JKT: jkt}))
+	plain := try.To1(Build("did:test", "", &Auth{Time: time.Now()}))
+
+	request := func(scheme, ts, proof string) error {
+		r := httptest.NewRequest("GET", resourceURL, nil)
+		r.Header.Set("Authorization", scheme+" "+ts)
+		if proof != "" {
+			r.Header.Set(ceremony.DPoPHeader, proof)
+		}
+		r.Header.Set("X-Forwarded-Proto", "https")
+		_, err := FromRequest(r)
+		return err
+	}
+	proof := func(ts string) string {
+		return newProof(t, k, proofClaims("GET", resourceURL, ceremony.AccessTokenHash(ts)))
+	}
+
+	assert.NoError(request(ceremony.DPoPHeader, bound, proof(bound)))
+	assert.Error(request("Bearer", bound, proof(bound)))
+	assert.Error(request("Bearer", bound, ""))
+	assert.Error(request(ceremony.DPoPHeader, bound, ""))
+	assert.Error(request(ceremony.DPoPHeader, plain, proof(plain)))
+	assert.NoError(request("Bearer", plain, ""))
+
+	// the proof is single use
+	p := proof(bound)
+	assert.NoError(request(ceremony.DPoPHeader, bound, p))
+	assert.Error(request(ceremony.DPoPHeader, bound, p))
+
+	other := try.To1(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+	assert.Error(request(ceremony.DPoPHeader, bound, newProof(t, other,
+		proofClaims("GET", resourceURL, ceremony.AccessTokenHash(bound)))))
+}
@@ -0,0 +1,301 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/golang/glog"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// key is the signing or verification key of the tokens.
+type key struct {
+	kid    string
+	method jwt.SigningMethod
+	public crypto.PublicKey
+
+	// private is nil for the verification only keys.
+	private crypto.Signer
+}
+
+// JWK is the JSON Web Key (RFC 7517) of the public key.
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+// JWKS is the JSON Web Key Set of our token verification keys.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+type keyStore struct {
+	sync.RWMutex
+
+	files   []string
+	modTime time.Time
+
+	signing *key
+	keys    map[string]*key
+}
+
+var theKeys = &keyStore{}
+
+// Init loads the signing keys from the PEM files. The first file is the
+// current signing key and must hold the private key. The rest are previous
+// keys, which are kept for verification and published in the JWKS until the
+// tokens signed with them have expired. Only ES256 (P-256) and EdDSA (Ed25519)
+// keys are supported. If the files are empty, the tokens are signed with the
+// shared HMAC secret.
+func Init(files string) (err error) {
+	defer err2.Handle(&err, "token keys")
+
+	theKeys.Lock()
+	defer theKeys.Unlock()
+
+	theKeys.files = nil
+	for _, f := range strings.Split(files, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			theKeys.files = append(theKeys.files, f)
+		}
+	}
+	theKeys.signing, theKeys.keys = nil, nil
+	theKeys.modTime = time.Time{}
+	if len(theKeys.files) == 0 {
+		return nil
+	}
+	try.To(theKeys.load())
+	return nil
+}
+
+// RefreshTicker checks with the interval if the key files are changed and
+// reloads them. If the reload fails, we keep using the previous keys.
+func RefreshTicker(interval time.Duration) (done chan<- struct{}) {
+	if len(theKeys.files) == 0 {
+		return nil
+	}
+	ticker := time.NewTicker(interval)
+	doneCh := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-doneCh:
+				return
+			case <-ticker.C:
+				if err := refresh(); err != nil {
+					glog.Errorln("token keys refresh:", err)
+				}
+			}
+		}
+	}()
+	return doneCh
+}
+
+func refresh() (err error) {
+	defer err2.Handle(&err)
+
+	theKeys.Lock()
+	defer theKeys.Unlock()
+
+	if !try.To1(latestModTime(theKeys.files)).After(theKeys.modTime) {
+		return nil
+	}
+	glog.V(1).Infoln("token key files changed, reloading")
+	return theKeys.load()
+}
+
+// SigningKeyID returns the kid of the current signing key, or empty string if
+// the HMAC secret is used.
+func SigningKeyID() string {
+	theKeys.RLock()
+	defer theKeys.RUnlock()
+
+	if theKeys.signing == nil {
+		return ""
+	}
+	return theKeys.signing.kid
+}
+
+// PublicKeys returns the JWKS of the token verification keys.
+func PublicKeys() JWKS {
+	theKeys.RLock()
+	defer theKeys.RUnlock()
+
+	jwks := JWKS{Keys: make([]JWK, 0, len(theKeys.keys))}
+	// the signing key first, that's how the clients usually pick the key
+	if theKeys.signing != nil {
+		jwks.Keys = append(jwks.Keys, theKeys.signing.jwk())
+	}
+	for _, k := range theKeys.keys {
+		if k != theKeys.signing {
+			jwks.Keys = append(jwks.Keys, k.jwk())
+		}
+	}
+	return jwks
+}
+
+// JWKSHandler serves the JWKS, e.g. in /.well-known/jwks.json.
+func JWKSHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if err := json.NewEncoder(w).Encode(PublicKeys()); err != nil {
+		glog.Errorln("jwks:", err)
+	}
+}
+
+// load reads the key files. Caller must hold the lock.
+func (s *keyStore) load() (err error) {
+	defer err2.Handle(&err)
+
+	modTime := try.To1(latestModTime(s.files))
+	keys := make(map[string]*key, len(s.files))
+	var signing *key
+	for i, f := range s.files {
+		k := try.To1(loadKey(f))
+		if i == 0 {
+			if k.private == nil {
+				return fmt.Errorf("%s: signing key must be a private key", f)
+			}
+			signing = k
+		}
+		keys[k.kid] = k
+	}
+	s.signing, s.keys, s.modTime = signing, keys, modTime
+	glog.V(1).Infof("token signing key %s (%s), %d key(s) in use",
+		signing.kid, signing.method.Alg(), len(keys))
+	return nil
+}
+
+func (s *keyStore) lookup(kid string) *key {
+	s.RLock()
+	defer s.RUnlock()
+	return s.keys[kid]
+}
+
+func (s *keyStore) signer() *key {
+	s.RLock()
+	defer s.RUnlock()
+	return s.signing
+}
+
+func latestModTime(files []string) (latest time.Time, err error) {
+	defer err2.Handle(&err)
+
+	for _, f := range files {
+		if t := try.To1(os.Stat(f)).ModTime(); t.After(latest) {
+			latest = t
+		}
+	}
+	return latest, nil
+}
+
+// loadKey reads the PEM file, which can have PKCS #8 or SEC 1 private key or
+// PKIX public key.
+func loadKey(filename string) (_ *key, err error) {
+	defer err2.Handle(&err, "load %s", filename)
+
+	data := try.To1(os.ReadFile(filename))
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed = try.To1(x509.ParsePKCS8PrivateKey(block.Bytes))
+	case "EC PRIVATE KEY":
+		parsed = try.To1(x509.ParseECPrivateKey(block.Bytes))
+	case "PUBLIC KEY":
+		parsed = try.To1(x509.ParsePKIXPublicKey(block.Bytes))
+	default:
+		return nil, fmt.Errorf("unsupported PEM type: %s", block.Type)
+	}
+	return newKey(parsed)
+}
+
+func newKey(parsed any) (_ *key, err error) {
+	defer err2.Handle(&err)
+
+	k := new(key)
+	if signer, ok := parsed.(crypto.Signer); ok {
+		k.private = signer
+		parsed = signer.Public()
+	}
+	switch pub := parsed.(type) {
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 EC keys are supported")
+		}
+		k.method = jwt.SigningMethodES256
+	case ed25519.PublicKey:
+		k.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type: %T", parsed)
+	}
+	k.public = parsed
+	k.kid = k.thumbprint()
+	return k, nil
+}
+
+func (k *key) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.method, claims)
+	token.Header["kid"] = k.kid
+	return token.SignedString(k.private)
+}
+
+func (k *key) jwk() JWK {
+	jwk := JWK{Kid: k.kid, Alg: k.method.Alg(), Use: "sig"}
+	switch pub := k.public.(type) {
+	case *ecdsa.PublicKey:
+		jwk.Kty, jwk.Crv = "EC", "P-256"
+		jwk.X = b64(pub.X.FillBytes(make([]byte, 32)))
+		jwk.Y = b64(pub.Y.FillBytes(make([]byte, 32)))
+	case ed25519.PublicKey:
+		jwk.Kty, jwk.Crv = "OKP", "Ed25519"
+		jwk.X = b64(pub)
+	}
+	return jwk
+}
+
+// thumbprint returns the RFC 7638 JWK thumbprint of the key, which is used as
+// the kid.
+func (k *key) thumbprint() string {
+	jwk := k.jwk()
+	var s string
+	if jwk.Kty == "EC" {
+		s = fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`,
+			jwk.Crv, jwk.Kty, jwk.X, jwk.Y)
+	} else {
+		s = fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s"}`,
+			jwk.Crv, jwk.Kty, jwk.X)
+	}
+	sum := sha256.Sum256([]byte(s))
+	return b64(sum[:])
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,152 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/findy-network/findy-common-go/dto"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// DefaultRefreshLifetime is the default lifetime of the refresh tokens.
+const DefaultRefreshLifetime = 30 * 24 * time.Hour
+
+// ErrMalformedRefresh is returned when the refresh token isn't ours.
+var ErrMalformedRefresh = errors.New("malformed refresh token")
+
+// RefreshToken is the stored refresh token. The client gets the ID and the
+// secret, and we store only the hash of the secret. The refresh tokens are
+// rotated, i.e. every refresh token can be used once, and the tokens rotated
+// from the same login belong to the same family. If an already used token is
+// presented, it's stolen, and the whole family is revoked.
+type RefreshToken struct {
+	ID         string
+	SecretHash []byte
+	Family     string
+
+	Username     string
+	CredentialID []byte
+	Auth         *Auth
+
+	// AccessJTI and AccessExpires tell the access token issued with this
+	// refresh token, which is revoked with it.
+	AccessJTI     string
+	AccessExpires time.Time
+
+	Expires time.Time
+	Used    bool
+}
+
+// Revoked is the entry of the revocation list.
+type Revoked struct {
+	JTI     string `json:"jti"`
+	Expires int64  `json:"exp"`
+}
+
+// Issued is the record of the issued access token. All of the access tokens
+// are recorded, not only the ones issued with the refresh tokens, that the
+// tokens of the user or the credential can be revoked.
+type Issued struct {
+	JTI          string
+	Username     string
+	CredentialID []byte
+	Expires      time.Time
+}
+
+// NewRefreshToken returns a new refresh token and its value given to the
+// client. If the family is empty, the new family is started.
+func NewRefreshToken(
+	username string,
+	credID []byte,
+	auth *Auth,
+	family string,
+	lifetime time.Duration,
+) (rt *RefreshToken, value string, err error) {
+	defer err2.Handle(&err, "new refresh token")
+
+	id := try.To1(randomString(16))
+	secret := try.To1(randomString(32))
+	if family == "" {
+		family = try.To1(randomString(16))
+	}
+	sum := sha256.Sum256([]byte(secret))
+	rt = &RefreshToken{
+		ID:           id,
+		SecretHash:   sum[:],
+		Family:       family,
+		Username:     username,
+		CredentialID: credID,
+		Auth:         auth,
+		Expires:      time.Now().Add(lifetime),
+	}
+	return rt, id + "." + secret, nil
+}
+
+// SplitRefreshToken returns the ID and the secret of the refresh token value.
+func SplitRefreshToken(value string) (id, secret string, err error) {
+	id, secret, found := strings.Cut(value, ".")
+	if !found || id == "" || secret == "" {
+		return "", "", ErrMalformedRefresh
+	}
+	return id, secret, nil
+}
+
+// Verify tells if the secret is the secret of the refresh token.
+func (rt *RefreshToken) Verify(secret string) bool {
+	sum := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(sum[:], rt.SecretHash) == 1
+}
+
+// Expired tells if the refresh token is expired.
+func (rt *RefreshToken) Expired() bool {
+	return rt.Expires.Before(time.Now())
+}
+
+func (rt RefreshToken) Data() []byte {
+	return dto.ToGOB(rt)
+}
+
+func NewRefreshTokenFromData(d []byte) *RefreshToken {
+	var rt RefreshToken
+	dto.FromGOB(d, &rt)
+	return &rt
+}
+
+func (r Revoked) Data() []byte {
+	return dto.ToGOB(r)
+}
+
+func NewRevokedFromData(d []byte) *Revoked {
+	var r Revoked
+	dto.FromGOB(d, &r)
+	return &r
+}
+
+// Expired tells if the access token is expired.
+func (i *Issued) Expired() bool {
+	return i.Expires.Before(time.Now())
+}
+
+func (i Issued) Data() []byte {
+	return dto.ToGOB(i)
+}
+
+func NewIssuedFromData(d []byte) *Issued {
+	var i Issued
+	dto.FromGOB(d, &i)
+	return &i
+}
+
+func randomString(n int) (_ string, err error) {
+	defer err2.Handle(&err)
+
+	b := make([]byte, n)
+	_ = try.To1(rand.Read(b))
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
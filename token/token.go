@@ -0,0 +1,413 @@
+/*
+Package token builds and verifies the JWT access tokens of the server.
+
+The tokens are signed with the asymmetric signing key (ES256 or EdDSA) when the
+keys are given with Init. The public keys are published as JWKS, which means
+that the other services can verify the tokens without the shared secret. Every
+token has the kid header of its signing key. Without the signing keys the
+tokens are signed with the shared HMAC secret as before.
+
+The claims are compatible with findy-common-go/jwt, i.e. the user (DID) is in
+the un claim.
+*/
+package token
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/golang/glog"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// DefaultLifetime is the default lifetime of the tokens when they aren't
+// refreshed with the refresh tokens.
+const DefaultLifetime = 72 * time.Hour
+
+// DefaultRefreshedLifetime is the default lifetime of the access tokens when
+// the refresh tokens are in use. The revoked tokens stay valid only this long
+// for the verifiers which don't check the revocation list.
+const DefaultRefreshedLifetime = 15 * time.Minute
+
+// DefaultElevatedLifetime is the default lifetime of the elevated tokens.
+const DefaultElevatedLifetime = 5 * time.Minute
+
+// ACRStepUp is the authentication context class (acr claim) of the elevated
+// tokens, which are issued after the step-up re-authentication with the user
+// verification.
+const ACRStepUp = "urn:findy:acr:stepup"
+
+// The optional authentication claims, which tell how the user authenticated.
+// The auth_time claim is always set when the token is issued for the
+// authentication, and ClaimAuthTime is accepted only for compatibility.
+const (
+	ClaimAuthTime     = "auth_time"
+	ClaimAMR          = "amr"
+	ClaimAAGUID       = "aaguid"
+	ClaimCredentialID = "cid"
+	ClaimUV           = "uv"
+)
+
+// The authentication method references (RFC 8176) of our tokens.
+const (
+	// AMRHardwareKey is used when the credential is device bound.
+	AMRHardwareKey = "hwk"
+
+	// AMRSoftwareKey is used when the credential can be backed up or synced
+	// between devices, i.e. it's a synced passkey.
+	AMRSoftwareKey = "swk"
+
+	// AMRUser is used when the authenticator performed the user
+	// verification.
+	AMRUser = "user"
+)
+
+// defaultSecret is the HMAC secret of findy-common-go/jwt, only for the
+// development environments.
+const defaultSecret = "mySuperSecretKeyLol"
+
+var (
+	secret    = []byte(defaultSecret)
+	secretSet = false
+
+	cfg = Config{Lifetime: DefaultLifetime}
+
+	knownClaims = map[string]bool{
+		ClaimAuthTime:     true,
+		ClaimAMR:          true,
+		ClaimAAGUID:       true,
+		ClaimCredentialID: true,
+		ClaimUV:           true,
+	}
+
+	isRevoked = func(string) bool { return false }
+
+	// ErrInvalid is returned when the token cannot be verified.
+	ErrInvalid = errors.New("invalid token")
+
+	// ErrRevoked is returned when the token is revoked.
+	ErrRevoked = errors.New("token revoked")
+
+	// ErrClientToken is returned when the access token of the OIDC client is
+	// used as our own login token.
+	ErrClientToken = errors.New("login token required")
+
+	// ErrNoSigningKey is returned when the asymmetric signing key is needed
+	// but the tokens are signed with the HMAC secret.
+	ErrNoSigningKey = errors.New("no signing key")
+
+	// ErrDefaultSecret is returned when neither the signing keys nor the HMAC
+	// secret are given, i.e. the tokens would be signed with the built-in
+	// development secret.
+	ErrDefaultSecret = errors.New("signing keys or JWT secret required")
+)
+
+// Config is the configuration of the issued tokens.
+type Config struct {
+	Lifetime time.Duration
+	Issuer   string
+	Audience []string
+
+	// Claims are the optional authentication claims added to the tokens,
+	// e.g. ClaimAMR.
+	Claims []string
+}
+
+// Auth tells how the user authenticated. The configured claims are built
+// from it.
+type Auth struct {
+	Time         time.Time
+	AMR          []string
+	AAGUID       string
+	CredentialID string
+	UV           bool
+
+	// JKT is the JWK thumbprint of the client's DPoP key. If it's set, the
+	// token is bound to the key with the cnf claim.
+	JKT string
+}
+
+// CredentialBytes returns the ID of the credential used in the login, or nil
+// if it isn't known.
+func (a *Auth) CredentialBytes() []byte {
+	if a == nil {
+		return nil
+	}
+	id, err := base64.RawURLEncoding.DecodeString(a.CredentialID)
+	if err != nil {
+		return nil
+	}
+	return id
+}
+
+// Claims are the claims of our access tokens.
+type Claims struct {
+	Username string `json:"un"`
+	Label    string `json:"label,omitempty"`
+
+	ACR          string           `json:"acr,omitempty"`
+	AuthTime     *jwt.NumericDate `json:"auth_time,omitempty"`
+	AMR          []string         `json:"amr,omitempty"`
+	AAGUID       string           `json:"aaguid,omitempty"`
+	CredentialID string           `json:"cid,omitempty"`
+	UV           *bool            `json:"uv,omitempty"`
+
+	Confirmation *Confirmation `json:"cnf,omitempty"`
+
+	// ClientID is the OIDC client (RFC 9068) the token is issued to. It's
+	// empty in our own login tokens.
+	ClientID string `json:"client_id,omitempty"`
+
+	jwt.RegisteredClaims
+}
+
+// Configure sets the configuration of the tokens issued after the call.
+func Configure(c Config) error {
+	if c.Lifetime <= 0 {
+		return fmt.Errorf("illegal token lifetime: %v", c.Lifetime)
+	}
+	for _, claim := range c.Claims {
+		if !knownClaims[claim] {
+			return fmt.Errorf("unknown token claim: %s", claim)
+		}
+	}
+	cfg = c
+	return nil
+}
+
+// SetSecret sets the HMAC secret. If the signing keys are in use, the HMAC
+// tokens are still accepted when the secret is set, which allows the
+// migration to the asymmetric keys.
+func SetSecret(s string) {
+	secret = []byte(s)
+	secretSet = true
+}
+
+// CheckSigning returns ErrDefaultSecret if the tokens would be signed with the
+// built-in development secret, which everyone knows.
+func CheckSigning() error {
+	if theKeys.signer() == nil && string(secret) == defaultSecret {
+		return ErrDefaultSecret
+	}
+	return nil
+}
+
+// Build builds a signed token for the user, which is usually the DID. The
+// auth can be nil if the token isn't issued for the authentication.
+func Build(user, label string, auth *Auth) (string, error) {
+	ts, _, err := Issue(user, label, auth)
+	return ts, err
+}
+
+// Issue builds a signed token like Build, and returns its claims as well.
+func Issue(user, label string, auth *Auth) (ts string, claims *Claims, err error) {
+	return IssueForClient(user, label, "", auth)
+}
+
+// IssueForClient builds the signed token like Issue for the OIDC client. The
+// client's tokens aren't login tokens of our own, see FirstParty, and their
+// audience is the client, i.e. the services of our audience don't accept
+// them.
+func IssueForClient(
+	user, label, clientID string,
+	auth *Auth,
+) (ts string, claims *Claims, err error) {
+	defer err2.Handle(&err, "build token")
+
+	claims = try.To1(newClaims(user, label, cfg.Lifetime))
+	if clientID != "" {
+		claims.ClientID = clientID
+		claims.Audience = jwt.ClaimStrings{clientID}
+	}
+	if auth != nil {
+		claims.setAuth(auth)
+	}
+	return try.To1(sign(claims)), claims, nil
+}
+
+// IssueElevated builds the short lived elevated token after the step-up
+// re-authentication. The acr and auth_time claims are always set.
+func IssueElevated(
+	user, label string,
+	auth *Auth,
+	lifetime time.Duration,
+) (ts string, claims *Claims, err error) {
+	defer err2.Handle(&err, "build elevated token")
+
+	claims = try.To1(newClaims(user, label, lifetime))
+	claims.setAuth(auth)
+	claims.ACR = ACRStepUp
+	claims.AuthTime = jwt.NewNumericDate(auth.Time)
+	return try.To1(sign(claims)), claims, nil
+}
+
+// FirstParty tells if the token is our own login token, i.e. it isn't issued
+// to the OIDC client.
+func (c *Claims) FirstParty() bool {
+	return c.ClientID == ""
+}
+
+// Elevated tells if the token is the elevated token.
+func (c *Claims) Elevated() bool {
+	return c.ACR == ACRStepUp && c.AuthTime != nil
+}
+
+func newClaims(user, label string, lifetime time.Duration) (_ *Claims, err error) {
+	defer err2.Handle(&err)
+
+	now := time.Now()
+	return &Claims{
+		Username: user,
+		Label:    label,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        try.To1(randomString(16)),
+			Issuer:    cfg.Issuer,
+			Audience:  cfg.Audience,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(lifetime)),
+		},
+	}, nil
+}
+
+// sign signs the access token with the current signing key or with the HMAC
+// secret.
+func sign(claims jwt.Claims) (string, error) {
+	k := theKeys.signer()
+	if k == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).
+			SignedString(secret)
+	}
+	return k.sign(claims)
+}
+
+// Sign signs the other tokens than the access tokens, e.g. the OIDC ID
+// tokens, with the current signing key. They can be verified only with the
+// published keys, i.e. ErrNoSigningKey is returned without the signing keys.
+func Sign(claims jwt.Claims) (string, error) {
+	k := theKeys.signer()
+	if k == nil {
+		return "", ErrNoSigningKey
+	}
+	return k.sign(claims)
+}
+
+// ParseClaims verifies the token signed with Sign, and parses its claims. The
+// HMAC tokens aren't accepted, and the expiration time is required.
+func ParseClaims(ts string, claims jwt.Claims) (err error) {
+	defer err2.Handle(&err, func(err error) error {
+		return fmt.Errorf("%w: %w", ErrInvalid, err)
+	})
+
+	_ = try.To1(jwt.ParseWithClaims(ts, claims, keyFunc,
+		jwt.WithValidMethods([]string{"ES256", "EdDSA"}),
+		jwt.WithExpirationRequired()))
+	return nil
+}
+
+// SigningAlgorithm returns the alg of the current signing key, or empty
+// string if the HMAC secret is used.
+func SigningAlgorithm() string {
+	k := theKeys.signer()
+	if k == nil {
+		return ""
+	}
+	return k.method.Alg()
+}
+
+// Parse verifies the token and returns its claims.
+func Parse(ts string) (_ *Claims, err error) {
+	defer err2.Handle(&err, func(err error) error {
+		return fmt.Errorf("%w: %w", ErrInvalid, err)
+	})
+
+	claims := new(Claims)
+	_ = try.To1(jwt.ParseWithClaims(ts, claims, keyFunc,
+		jwt.WithValidMethods([]string{"ES256", "EdDSA", "HS256"}),
+		jwt.WithExpirationRequired()))
+	if claims.ID != "" && isRevoked(claims.ID) {
+		return nil, ErrRevoked
+	}
+	return claims, nil
+}
+
+// SetRevocationCheck sets the function which tells if the token ID (jti) is
+// revoked.
+func SetRevocationCheck(f func(jti string) bool) {
+	isRevoked = f
+}
+
+// IsValidUser tells if the authorization header values have a valid bearer
+// token of the user.
+func IsValidUser(user string, authorization []string) bool {
+	claims, err := FromBearer(authorization)
+	return err == nil && user != "" && claims.Username == user
+}
+
+// FromBearer returns the claims of the first valid bearer token of the
+// authorization header values. The DPoP bound tokens aren't bearer tokens,
+// they are accepted only with the proof, see FromDPoP.
+func FromBearer(authorization []string) (claims *Claims, err error) {
+	const prefix = "Bearer "
+
+	err = fmt.Errorf("%w: bearer token missing", ErrInvalid)
+	for _, a := range authorization {
+		if !strings.HasPrefix(a, prefix) {
+			continue
+		}
+		claims, err = Parse(strings.TrimPrefix(a, prefix))
+		if err == nil && claims.Confirmation != nil {
+			err = fmt.Errorf("%w: DPoP bound token without proof", ErrDPoP)
+		}
+		if err == nil {
+			return claims, nil
+		}
+		glog.V(3).Infoln("token:", err)
+	}
+	return nil, err
+}
+
+// setAuth sets the auth_time and the configured authentication claims, and
+// the key binding. The auth_time is the time of the login, which is carried
+// over the refreshes, i.e. the refreshed token isn't a new login.
+func (c *Claims) setAuth(auth *Auth) {
+	if auth.JKT != "" {
+		c.Confirmation = &Confirmation{JKT: auth.JKT}
+	}
+	c.AuthTime = jwt.NewNumericDate(auth.Time)
+	for _, claim := range cfg.Claims {
+		switch claim {
+		case ClaimAMR:
+			c.AMR = auth.AMR
+		case ClaimAAGUID:
+			c.AAGUID = auth.AAGUID
+		case ClaimCredentialID:
+			c.CredentialID = auth.CredentialID
+		case ClaimUV:
+			uv := auth.UV
+			c.UV = &uv
+		}
+	}
+}
+
+func keyFunc(token *jwt.Token) (any, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if theKeys.signer() != nil && !secretSet {
+			return nil, errors.New("HMAC tokens not accepted")
+		}
+		return secret, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	k := theKeys.lookup(kid)
+	if k == nil {
+		return nil, fmt.Errorf("unknown kid: %s", kid)
+	}
+	if k.method.Alg() != token.Method.Alg() {
+		return nil, fmt.Errorf("wrong algorithm for kid: %s", kid)
+	}
+	return k.public, nil
+}
@@ -0,0 +1,271 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func writePrivate(t *testing.T, k crypto.Signer) string {
+	t.Helper()
+	der := try.To1(x509.MarshalPKCS8PrivateKey(k))
+	return writePEM(t, "PRIVATE KEY", der)
+}
+
+func writePublic(t *testing.T, k crypto.Signer) string {
+	t.Helper()
+	der := try.To1(x509.MarshalPKIXPublicKey(k.Public()))
+	return writePEM(t, "PUBLIC KEY", der)
+}
+
+func writePEM(t *testing.T, typ string, der []byte) string {
+	t.Helper()
+	f := try.To1(os.CreateTemp(t.TempDir(), "*.pem"))
+	defer f.Close()
+	try.To(pem.Encode(f, &pem.Block{Type: typ, Bytes: der}))
+	return f.Name()
+}
+
+func bearer(ts string) []string {
+	return []string{"Bearer " + ts}
+}
+
+func TestHMAC(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	try.To(Init(""))
+	assert.Equal(SigningKeyID(), "")
+	assert.SLen(PublicKeys().Keys, 0)
+
+	ts := try.To1(Build("did:test", "label", nil))
+	claims := try.To1(Parse(ts))
+	assert.Equal(claims.Username, "did:test")
+	assert.Equal(claims.Label, "label")
+	assert.That(IsValidUser("did:test", bearer(ts)))
+	assert.That(!IsValidUser("did:other", bearer(ts)))
+	assert.That(!IsValidUser("did:test", []string{ts}))
+}
+
+func TestAsymmetricKeys(t *testing.T) {
+	defer assert.PushTester(t)()
+	defer func() { _ = Init("") }()
+
+	ecKey := try.To1(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+	_, edKey := try.To2(ed25519.GenerateKey(rand.Reader))
+
+	// the old HMAC token before the migration
+	try.To(Init(""))
+	hmacToken := try.To1(Build("did:test", "", nil))
+
+	try.To(Init(writePrivate(t, ecKey)))
+	ecKid := SigningKeyID()
+	assert.NotEmpty(ecKid)
+	ecToken := try.To1(Build("did:test", "", nil))
+	assert.That(IsValidUser("did:test", bearer(ecToken)))
+	assert.That(!IsValidUser("did:test", bearer(hmacToken)))
+
+	// rotate: EdDSA is the new signing key and the old one is for verification
+	try.To(Init(writePrivate(t, edKey) + "," + writePublic(t, ecKey)))
+	edKid := SigningKeyID()
+	assert.NotEqual(edKid, ecKid)
+	edToken := try.To1(Build("did:test", "", nil))
+	assert.That(IsValidUser("did:test", bearer(edToken)))
+	assert.That(IsValidUser("did:test", bearer(ecToken)))
+
+	parsed, _ := try.To2(jwt.NewParser().ParseUnverified(edToken, &Claims{}))
+	assert.Equal(parsed.Header["kid"].(string), edKid)
+	assert.Equal(parsed.Header["alg"].(string), "EdDSA")
+
+	jwks := PublicKeys()
+	assert.SLen(jwks.Keys, 2)
+	assert.Equal(jwks.Keys[0].Kid, edKid)
+	assert.Equal(jwks.Keys[0].Kty, "OKP")
+	assert.Equal(jwks.Keys[1].Kid, ecKid)
+	assert.Equal(jwks.Keys[1].Kty, "EC")
+	assert.NotEmpty(jwks.Keys[1].Y)
+
+	// the old key is retired
+	try.To(Init(writePrivate(t, edKey)))
+	assert.That(!IsValidUser("did:test", bearer(ecToken)))
+
+	// the HMAC tokens are accepted only when the secret is set explicitly
+	defer func() { secretSet = false }()
+	SetSecret(defaultSecret)
+	assert.That(IsValidUser("did:test", bearer(hmacToken)))
+
+	// the built-in secret is refused without the signing keys
+	assert.NoError(CheckSigning())
+	try.To(Init(""))
+	assert.Error(CheckSigning())
+	try.To(Init(writePrivate(t, edKey)))
+
+	// the signing key must be private
+	assert.Error(Init(writePublic(t, ecKey)))
+}
+
+func TestSign(t *testing.T) {
+	defer assert.PushTester(t)()
+	defer func() { _ = Init("") }()
+
+	try.To(Init(""))
+	_, err := Sign(jwt.MapClaims{"sub": "did:test"})
+	assert.Error(err)
+	assert.Empty(SigningAlgorithm())
+
+	ecKey := try.To1(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+	try.To(Init(writePrivate(t, ecKey)))
+	assert.Equal(SigningAlgorithm(), "ES256")
+	ts := try.To1(Sign(jwt.MapClaims{"sub": "did:test"}))
+
+	claims := jwt.MapClaims{}
+	parsed := try.To1(jwt.ParseWithClaims(ts, claims, keyFunc))
+	assert.Equal(parsed.Header["kid"].(string), SigningKeyID())
+	assert.Equal(claims["sub"].(string), "did:test")
+}
+
+func TestElevated(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	plain := try.To1(Parse(try.To1(Build("did:test", "", &Auth{Time: time.Now()}))))
+	assert.ThatNot(plain.Elevated())
+
+	authTime := time.Now().Add(-time.Second)
+	ts, claims := try.To2(IssueElevated("did:test", "", &Auth{Time: authTime}, time.Minute))
+	assert.That(claims.Elevated())
+	parsed := try.To1(Parse(ts))
+	assert.That(parsed.Elevated())
+	assert.Equal(parsed.ACR, ACRStepUp)
+	assert.Equal(parsed.AuthTime.Unix(), authTime.Unix())
+	assert.That(parsed.ExpiresAt.Sub(parsed.IssuedAt.Time) == time.Minute)
+
+	ts, _ = try.To2(IssueElevated("did:test", "", &Auth{Time: authTime}, -time.Minute))
+	_, err := Parse(ts)
+	assert.Error(err)
+}
+
+func TestJWKSHandler(t *testing.T) {
+	defer assert.PushTester(t)()
+	defer func() { _ = Init("") }()
+
+	_, edKey := try.To2(ed25519.GenerateKey(rand.Reader))
+	try.To(Init(writePrivate(t, edKey)))
+
+	w := httptest.NewRecorder()
+	JWKSHandler(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	var jwks JWKS
+	try.To(json.NewDecoder(w.Result().Body).Decode(&jwks))
+	assert.SLen(jwks.Keys, 1)
+	assert.Equal(jwks.Keys[0].Kid, SigningKeyID())
+	assert.Equal(jwks.Keys[0].Alg, "EdDSA")
+}
+
+func TestRefresh(t *testing.T) {
+	defer assert.PushTester(t)()
+	defer func() { _ = Init("") }()
+
+	_, key1 := try.To2(ed25519.GenerateKey(rand.Reader))
+	_, key2 := try.To2(ed25519.GenerateKey(rand.Reader))
+	f := writePrivate(t, key1)
+	try.To(Init(f))
+	kid1 := SigningKeyID()
+
+	try.To(refresh())
+	assert.Equal(SigningKeyID(), kid1)
+
+	try.To(os.Rename(writePrivate(t, key2), f))
+	future := time.Now().Add(time.Minute)
+	try.To(os.Chtimes(f, future, future))
+	try.To(refresh())
+	assert.NotEqual(SigningKeyID(), kid1)
+
+	assert.Error(Init(filepath.Join(t.TempDir(), "missing.pem")))
+}
+
+func TestConfiguredClaims(t *testing.T) {
+	defer assert.PushTester(t)()
+	defer func() { cfg = Config{Lifetime: DefaultLifetime} }()
+
+	auth := &Auth{
+		Time:         time.Now().Add(-time.Second),
+		AMR:          []string{AMRHardwareKey, AMRUser},
+		AAGUID:       "12c85a48-4baf-47bd-b51f-f192871a1511",
+		CredentialID: "Y3JlZA",
+		UV:           true,
+	}
+
+	// by default only the compatible claims and the auth_time
+	claims := try.To1(Parse(try.To1(Build("did:test", "", auth))))
+	assert.Equal(claims.AuthTime.Unix(), auth.Time.Unix())
+	assert.That(claims.FirstParty())
+	assert.Equal(claims.AAGUID, "")
+	assert.SLen(claims.AMR, 0)
+	assert.That(claims.UV == nil)
+
+	assert.Error(Configure(Config{Lifetime: time.Hour, Claims: []string{"foo"}}))
+	assert.Error(Configure(Config{}))
+
+	try.To(Configure(Config{
+		Lifetime: time.Hour,
+		Issuer:   "https://auth.example.com",
+		Audience: []string{"vault", "agency"},
+		Claims: []string{ClaimAuthTime, ClaimAMR, ClaimAAGUID,
+			ClaimCredentialID, ClaimUV},
+	}))
+	claims = try.To1(Parse(try.To1(Build("did:test", "", auth))))
+	assert.Equal(claims.Issuer, "https://auth.example.com")
+	assert.SLen(claims.Audience, 2)
+	assert.That(claims.ExpiresAt.Sub(claims.IssuedAt.Time) == time.Hour)
+	assert.Equal(claims.AuthTime.Unix(), auth.Time.Unix())
+	assert.SLen(claims.AMR, 2)
+	assert.Equal(claims.AAGUID, auth.AAGUID)
+	assert.Equal(claims.CredentialID, auth.CredentialID)
+	assert.That(*claims.UV)
+
+	_, claims = try.To2(IssueForClient("did:test", "", "dashboard", auth))
+	assert.Equal(claims.ClientID, "dashboard")
+	assert.ThatNot(claims.FirstParty())
+
+	// no auth, no auth claims
+	claims = try.To1(Parse(try.To1(Build("did:test", "", nil))))
+	assert.That(claims.AuthTime == nil)
+	assert.That(claims.UV == nil)
+}
+
+func TestParseClaims(t *testing.T) {
+	defer assert.PushTester(t)()
+	defer func() { _ = Init("") }()
+
+	exp := jwt.NewNumericDate(time.Now().Add(time.Minute))
+	try.To(Init(""))
+	hmacToken := try.To1(Build("did:test", "", nil))
+
+	ecKey := try.To1(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+	try.To(Init(writePrivate(t, ecKey)))
+	ts := try.To1(Sign(jwt.MapClaims{"sub": "did:test", "exp": exp}))
+	claims := jwt.MapClaims{}
+	try.To(ParseClaims(ts, claims))
+	assert.Equal(claims["sub"].(string), "did:test")
+
+	assert.Error(ParseClaims(ts+"x", jwt.MapClaims{}))
+	assert.Error(ParseClaims(try.To1(Sign(jwt.MapClaims{"sub": "did:test"})),
+		jwt.MapClaims{}))
+
+	// the HMAC tokens aren't accepted even with the secret
+	defer func() { secretSet = false }()
+	SetSecret(defaultSecret)
+	assert.Error(ParseClaims(hmacToken, &Claims{}))
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/ceremony"
+	"github.com/findy-network/findy-agent-auth/enclave"
+	"github.com/findy-network/findy-agent-auth/token"
+	"github.com/findy-network/findy-agent-auth/user"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang/glog"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type revokedList struct {
+	Revoked []token.Revoked `json:"revoked"`
+}
+
+// refreshLock serializes the refresh token rotation, i.e. the same refresh
+// token cannot be used twice in parallel.
+var refreshLock sync.Mutex
+
+// revokedPurgeInterval is how often the expired tokens are removed from the
+// revocation list.
+const revokedPurgeInterval = time.Hour
+
+// refreshLifetime is the lifetime of the refresh tokens. If it's zero, the
+// refresh tokens aren't issued.
+func refreshLifetime() time.Duration {
+	return time.Duration(refreshLifetimeHours) * time.Hour
+}
+
+// accessLifetime is the lifetime of the access tokens. The default is short
+// when the tokens can be refreshed.
+func accessLifetime() time.Duration {
+	switch {
+	case jwtLifetime > 0:
+		return time.Duration(jwtLifetime) * time.Minute
+	case refreshLifetime() > 0:
+		return token.DefaultRefreshedLifetime
+	default:
+		return token.DefaultLifetime
+	}
+}
+
+// loginTokens issues the tokens for the successful login. If the JWK
+// thumbprint of the client's DPoP key is given, the tokens are bound to it.
+func loginTokens(u *user.User, cred *webauthn.Credential, jkt string) (*AccessToken, error) {
+	auth := user.AuthOf(cred)
+	auth.JKT = jkt
+	return issueTokens(u, cred.ID, auth, "")
+}
+
+// dpopThumbprint verifies the DPoP proof of the token request if it's sent,
+// and returns the JWK thumbprint of the proof's key.
+func dpopThumbprint(r *http.Request) (string, error) {
+	proofs := r.Header.Values(ceremony.DPoPHeader)
+	switch len(proofs) {
+	case 0:
+		return "", nil
+	case 1:
+		return token.VerifyDPoPProof(proofs[0], r.Method, token.RequestURL(r), "")
+	}
+	return "", fmt.Errorf("%w: one DPoP proof allowed", token.ErrDPoP)
+}
+
+// issueTokens issues the access token, and the refresh token if they are in
+// use. The empty family starts a new refresh token family.
+func issueTokens(
+	u *user.User,
+	credID []byte,
+	auth *token.Auth,
+	family string,
+) (_ *AccessToken, err error) {
+	defer err2.Handle(&err, "issue tokens")
+
+	ts, claims := try.To2(token.Issue(u.DID, u.DisplayName, auth))
+	try.To(recordAccess(u.Name, credID, claims))
+	at := &AccessToken{Token: ts}
+	if claims.Confirmation != nil {
+		at.TokenType = ceremony.DPoPHeader
+	}
+	if refreshLifetime() <= 0 {
+		return at, nil
+	}
+	rt, value := try.To2(token.NewRefreshToken(u.Name, credID, auth, family,
+		refreshLifetime()))
+	rt.AccessJTI = claims.ID
+	rt.AccessExpires = claims.ExpiresAt.Time
+	try.To(enclave.PutRefreshToken(rt))
+	at.RefreshToken = value
+	return at, nil
+}
+
+// refreshTokens rotates the refresh token and issues a new access token. If
+// the refresh token is already used, the whole token family is revoked.
+func refreshTokens(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	defer err2.Handle(&err, markErrBadRequest)
+
+	var req refreshRequest
+	try.To(json.NewDecoder(r.Body).Decode(&req))
+	id, secret := try.To2(token.SplitRefreshToken(req.RefreshToken))
+
+	refreshLock.Lock()
+	defer refreshLock.Unlock()
+
+	rt, exists := try.To2(enclave.GetRefreshToken(id))
+	if !exists || !rt.Verify(secret) {
+		err2.Throwf("invalid refresh token")
+	}
+	// the refresh tokens of the DPoP clients are bound to the same key
+	if rt.Auth != nil && rt.Auth.JKT != "" &&
+		try.To1(dpopThumbprint(r)) != rt.Auth.JKT {
+		err2.Throwf("DPoP proof of the token's key required")
+	}
+	if rt.Used {
+		glog.Warningln("refresh token reused, revoking family of", rt.Username)
+		try.To(revokeTokens(func(t *token.RefreshToken) bool {
+			return t.Family == rt.Family
+		}))
+		err2.Throwf("refresh token already used")
+	}
+	if rt.Expired() {
+		try.To(enclave.RemoveRefreshToken(rt.ID))
+		err2.Throwf("refresh token expired")
+	}
+	u := try.To1(enclave.GetExistingUser(rt.Username))
+	try.To(requireEnabled(u))
+	if !u.IsUsableCredential(rt.CredentialID) {
+		try.To(revokeTokens(func(t *token.RefreshToken) bool {
+			return t.Family == rt.Family
+		}))
+		err2.Throwf("credential revoked")
+	}
+
+	defer err2.Handle(&err, markErrInternal)
+
+	rt.Used = true
+	try.To(enclave.PutRefreshToken(rt))
+	at := try.To1(issueTokens(u, rt.CredentialID, rt.Auth, rt.Family))
+
+	jsonResponse(w, at, nil)
+	glog.V(1).Infoln("refresh tokens", u.Name)
+}
+
+// logout revokes the access token of the request and the refresh tokens
+// issued with it. The refresh token can be given in the body as well.
+func logout(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	defer err2.Handle(&err, markErrBadRequest)
+
+	claims := try.To1(loginClaims(r))
+
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		glog.V(3).Infoln("logout without refresh token:", err)
+	}
+	var refreshID, refreshFamily string
+	if req.RefreshToken != "" {
+		id, secret := try.To2(token.SplitRefreshToken(req.RefreshToken))
+		rt, exists := try.To2(enclave.GetRefreshToken(id))
+		if exists && rt.Verify(secret) {
+			refreshID, refreshFamily = rt.ID, rt.Family
+		}
+	}
+
+	defer err2.Handle(&err, markErrInternal)
+
+	try.To(revokeAccess(claims.ID, claims.ExpiresAt.Time))
+	try.To(revokeTokens(func(t *token.RefreshToken) bool {
+		return t.AccessJTI == claims.ID ||
+			(refreshID != "" && t.Family == refreshFamily)
+	}))
+
+	jsonResponse(w, "Logout Success", nil)
+	glog.V(1).Infoln("logout", claims.Username)
+}
+
+// revokedTokens returns the revocation list for the other services. Only the
+// tokens which aren't expired yet are listed.
+func revokedTokens(w http.ResponseWriter, _ *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	defer err2.Handle(&err, markErrInternal)
+
+	all := try.To1(enclave.GetRevoked())
+	list := revokedList{Revoked: make([]token.Revoked, 0, len(all))}
+	now := time.Now().Unix()
+	for _, revoked := range all {
+		if revoked.Expires >= now {
+			list.Revoked = append(list.Revoked, revoked)
+		}
+	}
+	jsonResponse(w, list, nil)
+}
+
+// revokedTicker removes the expired tokens from the revocation list with the
+// interval.
+func revokedTicker(interval time.Duration) (done chan<- struct{}) {
+	ticker := time.NewTicker(interval)
+	doneCh := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-doneCh:
+				return
+			case now := <-ticker.C:
+				if err := purgeRevoked(now); err != nil {
+					glog.Errorln("purge revoked:", err)
+				}
+			}
+		}
+	}()
+	return doneCh
+}
+
+// purgeRevoked removes the tokens expired before now from the revocation
+// list and the records of the issued tokens. They aren't valid anyway.
+func purgeRevoked(now time.Time) (err error) {
+	defer err2.Handle(&err)
+
+	for _, revoked := range try.To1(enclave.GetRevoked()) {
+		if revoked.Expires < now.Unix() {
+			try.To(enclave.RemoveRevoked(revoked.JTI))
+		}
+	}
+	for _, issued := range try.To1(enclave.GetIssued()) {
+		if issued.Expires.Before(now) {
+			try.To(enclave.RemoveIssued(issued.JTI))
+		}
+	}
+	return nil
+}
+
+// recordAccess records the issued access token of the user and the
+// credential, that it can be revoked with the user's other tokens.
+func recordAccess(username string, credID []byte, claims *token.Claims) error {
+	return enclave.PutIssued(&token.Issued{
+		JTI:          claims.ID,
+		Username:     username,
+		CredentialID: credID,
+		Expires:      claims.ExpiresAt.Time,
+	})
+}
+
+// revokeCredentialTokens revokes the tokens issued to the credential, e.g.
+// when the device is stolen.
+func revokeCredentialTokens(username string, credID []byte) (err error) {
+	defer err2.Handle(&err)
+
+	try.To(revokeIssued(func(i *token.Issued) bool {
+		return i.Username == username && bytes.Equal(i.CredentialID, credID)
+	}))
+	return revokeTokens(func(t *token.RefreshToken) bool {
+		return t.Username == username && bytes.Equal(t.CredentialID, credID)
+	})
+}
+
+// revokeUserTokens revokes all the tokens issued to the user, e.g. when the
+// user is disabled or deleted.
+func revokeUserTokens(username string) (err error) {
+	defer err2.Handle(&err)
+
+	try.To(revokeIssued(func(i *token.Issued) bool {
+		return i.Username == username
+	}))
+	return revokeTokens(func(t *token.RefreshToken) bool {
+		return t.Username == username
+	})
+}
+
+// revokeIssued revokes the access tokens selected by the filter. The records
+// of the revoked and the expired tokens are removed.
+func revokeIssued(filter func(i *token.Issued) bool) (err error) {
+	defer err2.Handle(&err, "revoke issued")
+
+	for _, i := range try.To1(enclave.GetIssued()) {
+		switch {
+		case filter(i):
+			glog.V(1).Infoln("revoke access token of", i.Username)
+			try.To(revokeAccess(i.JTI, i.Expires))
+		case !i.Expired():
+			continue
+		}
+		try.To(enclave.RemoveIssued(i.JTI))
+	}
+	return nil
+}
+
+// revokeTokens removes the refresh tokens selected by the filter and revokes
+// the access tokens issued with them. The expired refresh tokens are removed
+// as well.
+func revokeTokens(filter func(t *token.RefreshToken) bool) (err error) {
+	defer err2.Handle(&err, "revoke tokens")
+
+	for _, t := range try.To1(enclave.GetRefreshTokens()) {
+		switch {
+		case filter(t):
+			glog.V(1).Infoln("revoke refresh token of", t.Username)
+			try.To(revokeAccess(t.AccessJTI, t.AccessExpires))
+		case !t.Expired():
+			continue
+		}
+		try.To(enclave.RemoveRefreshToken(t.ID))
+	}
+	return nil
+}
+
+// revokeAccess adds the access token to the revocation list until it expires.
+func revokeAccess(jti string, expires time.Time) error {
+	if jti == "" || expires.Before(time.Now()) {
+		return nil
+	}
+	return enclave.PutRevoked(token.Revoked{JTI: jti, Expires: expires.Unix()})
+}
+
+// isRevoked is the revocation check of the tokens. If the revocation list
+// cannot be read, the token is treated as revoked.
+func isRevoked(jti string) bool {
+	revoked, err := enclave.IsRevoked(jti)
+	if err != nil {
+		glog.Errorln("revocation check:", err)
+		return true
+	}
+	return revoked
+}
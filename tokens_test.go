@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/enclave"
+	"github.com/findy-network/findy-agent-auth/token"
+	"github.com/findy-network/findy-agent-auth/user"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestTokenLifecycle(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	const name = "token-lifecycle-user"
+	u := user.New(name, name, "")
+	u.DID = "token-lifecycle-did"
+	phone := &webauthn.Credential{ID: []byte("phone")}
+	laptop := &webauthn.Credential{ID: []byte("laptop")}
+	u.AddCredential(*phone)
+	u.AddCredential(*laptop)
+	try.To(enclave.PutUser(u))
+
+	r := newMuxWithRoutes()
+	call := func(method, path, body, bearer string) (int, []byte) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		return res.StatusCode, try.To1(io.ReadAll(res.Body))
+	}
+	refresh := func(rt string) (int, *AccessToken) {
+		code, data := call("POST", urlRefresh, `{"refresh_token":"`+rt+`"}`, "")
+		var at AccessToken
+		if code == http.StatusOK {
+			try.To(json.Unmarshal(data, &at))
+		}
+		return code, &at
+	}
+	valid := func(at *AccessToken) bool {
+		return token.IsValidUser(u.DID, []string{"Bearer " + at.Token})
+	}
+	isListed := func(jti string) bool {
+		_, data := call("GET", urlRevoked, "", "")
+		return strings.Contains(string(data), `"`+jti+`"`)
+	}
+
+	t.Run("rotation and reuse", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		at1 := try.To1(loginTokens(u, phone, ""))
+		assert.NotEmpty(at1.RefreshToken)
+
+		code, at2 := refresh(at1.RefreshToken)
+		assert.Equal(code, http.StatusOK)
+		assert.NotEqual(at2.RefreshToken, at1.RefreshToken)
+		assert.That(valid(at2))
+		// the refresh isn't a new login
+		assert.Equal(try.To1(token.Parse(at2.Token)).AuthTime.Unix(),
+			try.To1(token.Parse(at1.Token)).AuthTime.Unix())
+		jti := try.To1(token.Parse(at2.Token)).ID
+		assert.That(!isListed(jti))
+
+		// reuse of the rotated token revokes the whole family
+		code, _ = refresh(at1.RefreshToken)
+		assert.Equal(code, http.StatusBadRequest)
+		code, _ = refresh(at2.RefreshToken)
+		assert.Equal(code, http.StatusBadRequest)
+		assert.That(!valid(at2))
+		assert.That(isListed(jti))
+
+		code, _ = refresh("garbage")
+		assert.Equal(code, http.StatusBadRequest)
+	})
+	t.Run("logout", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		at := try.To1(loginTokens(u, phone, ""))
+		code, _ := call("POST", urlLogout, "", "")
+		assert.Equal(code, http.StatusBadRequest)
+
+		code, _ = call("POST", urlLogout, "", at.Token)
+		assert.Equal(code, http.StatusOK)
+		assert.That(!valid(at))
+		code, _ = refresh(at.RefreshToken)
+		assert.Equal(code, http.StatusBadRequest)
+	})
+	t.Run("stolen device", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		stolen := try.To1(loginTokens(u, laptop, ""))
+		mine := try.To1(loginTokens(u, phone, ""))
+
+		elevated, _ := try.To2(token.IssueElevated(u.DID, u.DisplayName,
+			user.AuthOf(phone), time.Minute))
+		code, _ := call("DELETE", "/credentials/"+name+"/"+
+			base64.RawURLEncoding.EncodeToString(laptop.ID), "", elevated)
+		assert.Equal(code, http.StatusOK)
+
+		assert.That(!valid(stolen))
+		code, _ = refresh(stolen.RefreshToken)
+		assert.Equal(code, http.StatusBadRequest)
+
+		assert.That(valid(mine))
+		code, _ = refresh(mine.RefreshToken)
+		assert.Equal(code, http.StatusOK)
+	})
+	t.Run("refresh disabled", func(t *testing.T) {
+		defer assert.PushTester(t)()
+		defer func(h int) { refreshLifetimeHours = h }(refreshLifetimeHours)
+
+		refreshLifetimeHours = 0
+		at := try.To1(loginTokens(u, phone, ""))
+		assert.Empty(at.RefreshToken)
+		assert.That(valid(at))
+
+		// the tokens without the refresh tokens are revoked as well
+		try.To(revokeCredentialTokens(u.Name, phone.ID))
+		assert.That(!valid(at))
+	})
+	t.Run("user revoked", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		at := try.To1(loginTokens(u, phone, ""))
+		ts, claims := try.To2(token.IssueElevated(u.DID, u.DisplayName,
+			user.AuthOf(phone), time.Minute))
+		try.To(recordAccess(u.Name, phone.ID, claims))
+		elevated := &AccessToken{Token: ts}
+		assert.That(valid(elevated))
+
+		try.To(revokeUserTokens(u.Name))
+		assert.That(!valid(at))
+		assert.That(!valid(elevated))
+		assert.That(isListed(claims.ID))
+	})
+	t.Run("expired revocations", func(t *testing.T) {
+		defer assert.PushTester(t)()
+
+		const jti = "expired-revocation"
+		try.To(enclave.PutRevoked(token.Revoked{
+			JTI:     jti,
+			Expires: time.Now().Add(-time.Minute).Unix(),
+		}))
+		// the listing doesn't have side effects
+		assert.That(!isListed(jti))
+		assert.That(try.To1(enclave.IsRevoked(jti)))
+
+		try.To(purgeRevoked(time.Now()))
+		assert.That(!try.To1(enclave.IsRevoked(jti)))
+	})
+}
+
+func TestAccessLifetime(t *testing.T) {
+	defer assert.PushTester(t)()
+	defer func(l, h int) {
+		jwtLifetime, refreshLifetimeHours = l, h
+	}(jwtLifetime, refreshLifetimeHours)
+
+	jwtLifetime, refreshLifetimeHours = 0, 24
+	assert.Equal(accessLifetime(), token.DefaultRefreshedLifetime)
+	refreshLifetimeHours = 0
+	assert.Equal(accessLifetime(), token.DefaultLifetime)
+	jwtLifetime = 5
+	assert.Equal(accessLifetime(), 5*time.Minute)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/findy-network/findy-agent-auth/ceremony"
+	"github.com/findy-network/findy-agent-auth/enclave"
+	"github.com/findy-network/findy-agent-auth/token"
+	"github.com/findy-network/findy-agent-auth/transaction"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+type transactionRequest struct {
+	Data string `json:"data"`
+}
+
+// transactionOptions are the assertion options with the binding of the
+// transaction, which allows the client to check what it's signing.
+type transactionOptions struct {
+	protocol.PublicKeyCredentialRequestOptions
+	Transaction ceremony.TransactionBinding `json:"transaction"`
+}
+
+type transactionReceipt struct {
+	ID           string `json:"id"`
+	Receipt      string `json:"receipt"`
+	Hash         string `json:"hash"`
+	CredentialID string `json:"credential_id"`
+	Time         int64  `json:"time"`
+}
+
+// transactionRecord is the confirmed transaction with its data.
+type transactionRecord struct {
+	transactionReceipt
+	Data string `json:"data"`
+}
+
+// BeginTransaction starts the confirmation of the transaction data. The
+// challenge of the assertion is derived from the hash of the data, and the
+// user verification is required. Valid JWT of the user is required. The
+// receipts are signed with the asymmetric keys, i.e. -jwt-keys are needed.
+func BeginTransaction(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	if token.SigningAlgorithm() == "" {
+		try.To(markErrInternal(fmt.Errorf("transaction receipt: %w",
+			token.ErrNoSigningKey)))
+	}
+
+	defer err2.Handle(&err, markErrBadRequest)
+
+	claims := try.To1(loginClaims(r))
+	u, exists := try.To2(enclave.GetUserByDID(claims.Username))
+	if !exists {
+		err2.Throwf("user not exist")
+	}
+	try.To(requireEnabled(u))
+	var req transactionRequest
+	try.To(json.NewDecoder(http.MaxBytesReader(w, r.Body,
+		2*transaction.MaxDataSize)).Decode(&req))
+	if req.Data == "" {
+		err2.Throwf("transaction data missing")
+	}
+	tx := try.To1(transaction.New(u.DID, req.Data))
+
+	defer err2.Handle(&err, markErrInternal)
+
+	options, sessionData := try.To2(webAuthn.BeginLogin(u,
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+		withChallenge(tx.Challenge())))
+	// the session data has the challenge generated by the library
+	sessionData.Challenge = tx.Challenge().String()
+	// the pending transaction is the state of the ceremony, i.e. it's
+	// confirmed only once and it expires with the ceremony
+	try.To(saveCeremony("transaction", sessionData, tx, r, w))
+
+	jsonResponse(w, transactionOptions{
+		PublicKeyCredentialRequestOptions: options.Response,
+		Transaction:                       tx.TransactionBinding,
+	}, nil)
+	glog.V(1).Infoln("begin transaction", u.Name)
+}
+
+// FinishTransaction verifies the assertion of the transaction and returns the
+// signed confirmation receipt. The record of the transaction data and the
+// receipt is kept in the enclave.
+func FinishTransaction(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	defer err2.Handle(&err, markErrBadRequest)
+
+	var tx transaction.Transaction
+	sessionData := try.To1(getCeremony("transaction", &tx, r))
+	if tx.Challenge().String() != sessionData.Challenge {
+		try.To(ceremony.ErrTransactionMismatch)
+	}
+	u := try.To1(enclave.GetExistingUserByWebAuthnID(sessionData.UserID))
+	try.To(requireEnabled(u))
+	if u.DID != tx.DID {
+		err2.Throwf("transaction of the other user")
+	}
+	credential := try.To1(webAuthn.FinishLogin(u, sessionData, r))
+	if !credential.Flags.UserVerified {
+		err2.Throwf("user verification required")
+	}
+	try.To(updateLoginCredential(u, credential))
+
+	defer err2.Handle(&err, markErrInternal)
+
+	ts, receipt := try.To2(tx.Receipt(credential.ID, jwtIssuer))
+	rec := tx.Record(ts, receipt)
+	try.To(enclave.PutTransaction(rec))
+
+	jsonResponse(w, receiptOf(rec), nil)
+	glog.V(1).Infoln("finish transaction", u.Name)
+}
+
+// getTransaction returns the confirmed transaction with its data and receipt
+// by the receipt ID. Valid JWT of the user, who confirmed it, is required.
+func getTransaction(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer err2.Handle(&err, func(err error) error {
+		jsonResponse(w, err.Error(), err)
+		return nil
+	})
+
+	defer err2.Handle(&err, markErrBadRequest)
+
+	claims := try.To1(loginClaims(r))
+	u, exists := try.To2(enclave.GetUserByDID(claims.Username))
+	if !exists {
+		err2.Throwf("user not exist")
+	}
+	try.To(requireEnabled(u))
+
+	defer err2.Handle(&err, markErrInternal)
+
+	rec, exists := try.To2(enclave.GetTransaction(mux.Vars(r)["receiptID"]))
+	// the other users' transactions aren't told apart from the missing ones
+	if !exists || rec.DID != claims.Username {
+		try.To(markErrBadRequest(transaction.ErrNotFound))
+	}
+	jsonResponse(w, transactionRecord{
+		transactionReceipt: receiptOf(rec),
+		Data:               rec.Payload,
+	}, nil)
+}
+
+func receiptOf(rec *transaction.Record) transactionReceipt {
+	return transactionReceipt{
+		ID:           rec.ID,
+		Receipt:      rec.Receipt,
+		Hash:         rec.Hash,
+		CredentialID: rec.CredentialID,
+		Time:         rec.Confirmed.Unix(),
+	}
+}
+
+func withChallenge(c protocol.URLEncodedBase64) webauthn.LoginOption {
+	return func(opts *protocol.PublicKeyCredentialRequestOptions) {
+		opts.Challenge = c
+	}
+}
@@ -0,0 +1,154 @@
+/*
+Package transaction implements the transaction confirmation, where the user
+approves the transaction, e.g. a credential offer, with the WebAuthn assertion.
+
+The challenge of the assertion is derived from the hash of the transaction
+data:
+
+	challenge = SHA-256(nonce || SHA-256(data))
+
+The random nonce keeps the challenges unique even if the same data is
+confirmed twice. The client gets the hash and the nonce with the assertion
+options, which means that it can check what it's signing with
+ceremony.TransactionBinding. After the verified
+assertion the server issues the Receipt signed with the asymmetric key, and
+keeps the Record of the confirmed transaction data.
+*/
+package transaction
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/ceremony"
+	"github.com/findy-network/findy-agent-auth/token"
+	"github.com/findy-network/findy-common-go/dto"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// ReceiptLifetime is the time the receipt can be presented to the services.
+// The Record of the transaction is kept after it.
+const ReceiptLifetime = 24 * time.Hour
+
+// MaxDataSize is the maximum size of the transaction data in bytes.
+const MaxDataSize = 64 * 1024
+
+const nonceLength = 32
+
+// ErrNotFound is returned when the record of the transaction doesn't exist.
+var ErrNotFound = errors.New("transaction not found")
+
+// Transaction is the pending transaction, which waits for the confirmation.
+type Transaction struct {
+	ceremony.TransactionBinding
+
+	// DID is the user who must confirm the transaction.
+	DID  string
+	Data string
+
+	Created time.Time
+}
+
+// New returns a new transaction of the user with the random nonce.
+func New(did, data string) (_ *Transaction, err error) {
+	defer err2.Handle(&err, "new transaction")
+
+	if len(data) > MaxDataSize {
+		return nil, errors.New("transaction data too large")
+	}
+	nonce := make([]byte, nonceLength)
+	try.To1(rand.Read(nonce))
+	return &Transaction{
+		TransactionBinding: ceremony.TransactionBinding{
+			Hash:  ceremony.TransactionHash(data),
+			Nonce: nonce,
+		},
+		DID:     did,
+		Data:    data,
+		Created: time.Now(),
+	}, nil
+}
+
+// Receipt is the claims of the signed confirmation receipt. The subject is
+// the user's DID and the issued at time is the confirmation time.
+type Receipt struct {
+	Hash         string `json:"txn_hash"`
+	CredentialID string `json:"cid"`
+
+	jwt.RegisteredClaims
+}
+
+// Receipt returns the receipt of the transaction confirmed with the
+// credential. It's signed with the asymmetric key, i.e. token.ErrNoSigningKey
+// is returned without the signing keys.
+func (t *Transaction) Receipt(credentialID []byte, issuer string) (
+	ts string, r *Receipt, err error,
+) {
+	defer err2.Handle(&err, "receipt")
+
+	now := time.Now()
+	r = &Receipt{
+		Hash:         t.Hash.String(),
+		CredentialID: base64.RawURLEncoding.EncodeToString(credentialID),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        t.Nonce.String(),
+			Issuer:    issuer,
+			Subject:   t.DID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ReceiptLifetime)),
+		},
+	}
+	return try.To1(token.Sign(r)), r, nil
+}
+
+// Record is the confirmed transaction with its data and the receipt, which
+// is kept after the receipt has expired.
+type Record struct {
+	ID           string // ID of the receipt
+	DID          string
+	Payload      string // the confirmed transaction data
+	Hash         string
+	CredentialID string
+	Confirmed    time.Time
+	Receipt      string
+}
+
+// Record returns the record of the transaction with its receipt.
+func (t *Transaction) Record(ts string, r *Receipt) *Record {
+	return &Record{
+		ID:           r.ID,
+		DID:          t.DID,
+		Payload:      t.Data,
+		Hash:         r.Hash,
+		CredentialID: r.CredentialID,
+		Confirmed:    r.IssuedAt.Time,
+		Receipt:      ts,
+	}
+}
+
+func (r Record) Key() []byte {
+	return []byte(r.ID)
+}
+
+func (r Record) Data() []byte {
+	return dto.ToGOB(r)
+}
+
+func NewRecordFromData(data []byte) *Record {
+	var r Record
+	dto.FromGOB(data, &r)
+	return &r
+}
+
+// ParseReceipt verifies the receipt and returns its claims.
+func ParseReceipt(ts string) (_ *Receipt, err error) {
+	defer err2.Handle(&err, "parse receipt")
+
+	r := new(Receipt)
+	try.To(token.ParseClaims(ts, r))
+	return r, nil
+}
@@ -0,0 +1,70 @@
+package transaction
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/findy-network/findy-agent-auth/token"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestBinding(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	const data = `{"type":"credential_offer","id":"1"}`
+	tx1 := try.To1(New("did:test", data))
+	tx2 := try.To1(New("did:test", data))
+	assert.That(bytes.Equal(tx1.Hash, tx2.Hash))
+	assert.ThatNot(bytes.Equal(tx1.Challenge(), tx2.Challenge()))
+
+	assert.NoError(tx1.Verify(data, tx1.Challenge()))
+	assert.Error(tx1.Verify(data+" ", tx1.Challenge()))
+	assert.Error(tx1.Verify(data, tx2.Challenge()))
+
+	_, err := New("did:test", string(make([]byte, MaxDataSize+1)))
+	assert.Error(err)
+}
+
+func TestReceipt(t *testing.T) {
+	defer assert.PushTester(t)()
+	defer func() { try.To(token.Init("")) }()
+
+	tx := try.To1(New("did:test", "data"))
+	try.To(token.Init(""))
+	_, _, err := tx.Receipt([]byte("cred"), "issuer")
+	assert.That(errors.Is(err, token.ErrNoSigningKey))
+
+	ecKey := try.To1(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+	keyFile := filepath.Join(t.TempDir(), "jwt.pem")
+	try.To(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY",
+		Bytes: try.To1(x509.MarshalPKCS8PrivateKey(ecKey))}), 0o600))
+	try.To(token.Init(keyFile))
+
+	ts, r := try.To2(tx.Receipt([]byte("cred"), "issuer"))
+	parsed := try.To1(ParseReceipt(ts))
+	assert.Equal(parsed.Hash, r.Hash)
+	assert.Equal(parsed.Hash, tx.Hash.String())
+	assert.Equal(parsed.CredentialID, "Y3JlZA")
+	assert.Equal(parsed.Subject, "did:test")
+	assert.That(parsed.IssuedAt != nil)
+	assert.That(parsed.ExpiresAt.Sub(parsed.IssuedAt.Time) == ReceiptLifetime)
+
+	_, err = ParseReceipt(ts[:len(ts)-2])
+	assert.Error(err)
+
+	rec := NewRecordFromData(tx.Record(ts, r).Data())
+	assert.Equal(string(rec.Key()), parsed.ID)
+	assert.Equal(rec.Payload, "data")
+	assert.Equal(rec.Receipt, ts)
+	assert.Equal(rec.Confirmed.Unix(), parsed.IssuedAt.Unix())
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/findy-network/findy-agent-auth/acator/authn"
+	"github.com/findy-network/findy-agent-auth/ceremony"
+	"github.com/findy-network/findy-agent-auth/enclave"
+	"github.com/findy-network/findy-agent-auth/token"
+	"github.com/findy-network/findy-agent-auth/transaction"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestTransaction(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	ecKey := try.To1(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+	keyFile := filepath.Join(t.TempDir(), "jwt.pem")
+	try.To(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY",
+		Bytes: try.To1(x509.MarshalPKCS8PrivateKey(ecKey))}), 0o600))
+	try.To(token.Init(keyFile))
+	defer func() { try.To(token.Init(jwtKeys)) }()
+
+	server := httptest.NewServer(newMuxWithRoutes())
+	defer server.Close()
+
+	cmd := authn.Cmd{
+		SubCmd:   "register",
+		UserName: "txn-user",
+		URL:      server.URL,
+		AAGUID:   "12c85a48-4baf-47bd-b51f-f192871a1511",
+		Key:      "15308490f1e4026284594dd08d31291bc8ef2aeac730d0daf6ff87bb92d4336c",
+		Origin:   defaultOrigin,
+	}
+	_ = try.To1(cmd.Exec(nil))
+	cmd.SubCmd = "login"
+	var at AccessToken
+	try.To(json.Unmarshal([]byte(try.To1(cmd.Exec(nil)).Token), &at))
+
+	const data = `{"type":"proof_request","connection":"abc"}`
+	cmd.SubCmd = "confirm"
+	cmd.Token = at.Token
+	cmd.Transaction = data
+	var res transactionReceipt
+	try.To(json.Unmarshal([]byte(try.To1(cmd.Exec(nil)).Token), &res))
+
+	u := try.To1(enclave.GetExistingUser("txn-user"))
+	receipt := try.To1(transaction.ParseReceipt(res.Receipt))
+	assert.Equal(receipt.Hash, res.Hash)
+	assert.Equal(receipt.Hash, ceremony.TransactionHash(data).String())
+	assert.Equal(receipt.CredentialID, res.CredentialID)
+	assert.Equal(receipt.Subject, u.DID)
+	assert.Equal(receipt.IssuedAt.Unix(), res.Time)
+
+	get := func(id, token string) (int, *transactionRecord) {
+		req := try.To1(http.NewRequest("GET", server.URL+
+			strings.Replace(urlTransaction, "{receiptID}", id, 1), nil))
+		req.Header.Set("Authorization", "Bearer "+token)
+		res := try.To1(http.DefaultClient.Do(req))
+		defer res.Body.Close()
+		var rec transactionRecord
+		if res.StatusCode == http.StatusOK {
+			try.To(json.NewDecoder(res.Body).Decode(&rec))
+		}
+		return res.StatusCode, &rec
+	}
+	code, rec := get(res.ID, at.Token)
+	assert.Equal(code, http.StatusOK)
+	assert.Equal(rec.Data, data)
+	assert.Equal(rec.Receipt, res.Receipt)
+	other := try.To1(token.Build("did:other", "", nil))
+	code, _ = get(res.ID, other)
+	assert.Equal(code, http.StatusBadRequest)
+
+	u.Disabled = true
+	try.To(enclave.PutUser(u))
+	code, _ = get(res.ID, at.Token)
+	assert.Equal(code, http.StatusForbidden)
+	u.Disabled = false
+	try.To(enclave.PutUser(u))
+
+	call := func(body, token string) int {
+		req := try.To1(http.NewRequest("POST", server.URL+urlBeginTransaction,
+			strings.NewReader(body)))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res := try.To1(http.DefaultClient.Do(req))
+		defer res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(call(`{"data":"x"}`, ""), http.StatusBadRequest)
+	assert.Equal(call(`{"data":""}`, at.Token), http.StatusBadRequest)
+	assert.Equal(call(`{"data":"`+strings.Repeat("x", transaction.MaxDataSize+1)+`"}`,
+		at.Token), http.StatusBadRequest)
+}
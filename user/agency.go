@@ -0,0 +1,250 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/findy-network/findy-common-go/jwt"
+	"github.com/findy-network/findy-common-go/rpc"
+	"github.com/golang/glog"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// agencyFailureThreshold is the number of the consecutive failures which
+	// open the circuit, i.e. the calls fail fast.
+	agencyFailureThreshold = 5
+
+	// agencyOpenTimeout is how long the circuit stays open before the next
+	// trial call.
+	agencyOpenTimeout = 30 * time.Second
+
+	agencyHealthTimeout = 5 * time.Second
+)
+
+// ErrAgencyUnavailable is returned when the circuit breaker is open, i.e. the
+// agency has failed too many times.
+var ErrAgencyUnavailable = errors.New("agency unavailable")
+
+// agency is the long-lived connection to the agency shared by the requests.
+// The connection is opened again when the certificates are changed. The JWT of
+// the admin is made for every call, i.e. the connection outlives the tokens.
+type agency struct {
+	sync.Mutex
+
+	cfg      *rpc.ClientCfg
+	adminID  string
+	conn     *grpc.ClientConn
+	certTime time.Time
+
+	// the circuit breaker
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+var theAgency = &agency{}
+
+// CloseAgency closes the shared agency connection.
+func CloseAgency() {
+	theAgency.reset(nil)
+}
+
+// AgencyHealthTicker checks the health of the agency connection with the
+// interval. It also opens the connection again if the certificates are
+// changed.
+func AgencyHealthTicker(interval time.Duration) (done chan<- struct{}) {
+	ticker := time.NewTicker(interval)
+	doneCh := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-doneCh:
+				return
+			case <-ticker.C:
+				if err := theAgency.check(); err != nil {
+					glog.Warningln("agency health:", err)
+				}
+			}
+		}
+	}()
+	return doneCh
+}
+
+func (a *agency) reset(cfg *rpc.ClientCfg) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.close()
+	a.cfg = cfg
+	a.failures, a.openUntil, a.probing = 0, time.Time{}, false
+}
+
+// close closes the connection. Caller must hold the lock.
+func (a *agency) close() {
+	if a.conn != nil {
+		if err := a.conn.Close(); err != nil {
+			glog.Warningln("close agency connection:", err)
+		}
+		a.conn = nil
+	}
+}
+
+// connection returns the shared connection of the admin. The connection is
+// opened if it isn't open yet, if the certificates are changed, or if the
+// agency has refused the credentials.
+func (a *agency) connection(adminID string) (_ *grpc.ClientConn, err error) {
+	defer err2.Handle(&err, "agency connection")
+
+	a.Lock()
+	defer a.Unlock()
+
+	if a.cfg == nil {
+		return nil, errors.New("agency connection not initialized")
+	}
+	certTime := certModTime(a.cfg)
+	if a.conn != nil && (a.adminID != adminID || certTime.After(a.certTime)) {
+		glog.V(1).Infoln("agency certificates or admin changed, reconnecting")
+		a.close()
+	}
+	if a.conn == nil {
+		cfg := *a.cfg
+		cfg.JWT = "" // see adminCredentials
+		cfg.Opts = append(cfg.Opts[:len(cfg.Opts):len(cfg.Opts)],
+			grpc.WithPerRPCCredentials(adminCredentials{
+				adminID: adminID,
+				secure:  cfg.RequireTransportSecurity(),
+			}))
+		a.conn = try.To1(rpc.ClientConn(cfg))
+		a.adminID = adminID
+		a.certTime = certTime
+	}
+	return a.conn, nil
+}
+
+// adminCredentials makes the fresh JWT of the admin for every call. The
+// static token of client.TryOpen would expire during the connection.
+type adminCredentials struct {
+	adminID string
+	secure  bool
+}
+
+func (c adminCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + jwt.BuildJWT(c.adminID)}, nil
+}
+
+func (c adminCredentials) RequireTransportSecurity() bool {
+	return c.secure
+}
+
+// allow tells if the circuit breaker allows the call. When the open circuit
+// has timed out, only one trial call is allowed at a time. The caller must call
+// release after the call on every path, or record the result.
+func (a *agency) allow(now time.Time) error {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.failures < agencyFailureThreshold {
+		return nil
+	}
+	if now.Before(a.openUntil) || a.probing {
+		return ErrAgencyUnavailable
+	}
+	a.probing = true
+	return nil
+}
+
+// release ends the trial call even if the call wasn't made, e.g. the
+// connection cannot be opened. The result isn't recorded.
+func (a *agency) release() {
+	a.Lock()
+	defer a.Unlock()
+
+	a.probing = false
+}
+
+// record records the result of the call to the circuit breaker. The
+// connection is opened again for the next call if the agency has refused the
+// credentials.
+func (a *agency) record(err error, now time.Time) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.probing = false
+	if status.Code(err) == codes.Unauthenticated {
+		glog.Warningln("agency refused the credentials, reconnecting:", err)
+		a.close()
+	}
+	if !isAgencyFailure(err) {
+		a.failures = 0
+		return
+	}
+	a.failures++
+	if a.failures >= agencyFailureThreshold {
+		a.openUntil = now.Add(agencyOpenTimeout)
+		glog.Warningf("agency failed %d times, failing fast until %v",
+			a.failures, a.openUntil)
+	}
+}
+
+// check calls the gRPC health service of the agency. The agency which doesn't
+// implement the service is healthy when it answers.
+func (a *agency) check() (err error) {
+	a.Lock()
+	adminID, connected := a.adminID, a.conn != nil
+	a.Unlock()
+	if !connected {
+		return nil
+	}
+
+	conn, err := a.connection(adminID)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), agencyHealthTimeout)
+	defer cancel()
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if status.Code(err) == codes.Unimplemented {
+		err = nil
+	}
+	a.record(err, time.Now())
+	return err
+}
+
+// isAgencyFailure tells if the error means that the agency is down or too
+// slow. The other errors, e.g. the canceled request, aren't the agency's
+// failures.
+func isAgencyFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// certModTime returns the latest modification time of the client's
+// certificate files.
+func certModTime(cfg *rpc.ClientCfg) (latest time.Time) {
+	if cfg.PKI == nil {
+		return latest
+	}
+	for _, name := range []string{
+		cfg.PKI.Server.CertFile,
+		cfg.PKI.Client.CertFile,
+		cfg.PKI.Client.KeyFile,
+	} {
+		if fi, err := os.Stat(name); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
@@ -0,0 +1,117 @@
+package user
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/findy-network/findy-common-go/agency/client"
+	"github.com/findy-network/findy-common-go/jwt"
+	"github.com/findy-network/findy-common-go/rpc"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAgencyBreaker(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	a := &agency{}
+	now := time.Now()
+	unavailable := status.Error(codes.Unavailable, "agency down")
+
+	for i := 0; i < agencyFailureThreshold-1; i++ {
+		assert.NoError(a.allow(now))
+		a.record(unavailable, now)
+	}
+	// not the agency's failures
+	a.record(status.Error(codes.Canceled, "client went away"), now)
+	a.record(context.Canceled, now)
+	assert.Equal(a.failures, 0)
+
+	for i := 0; i < agencyFailureThreshold; i++ {
+		a.record(unavailable, now)
+	}
+	assert.Equal(a.allow(now), ErrAgencyUnavailable)
+
+	// one trial call when the open timeout is passed
+	later := now.Add(agencyOpenTimeout)
+	assert.NoError(a.allow(later))
+	assert.Equal(a.allow(later), ErrAgencyUnavailable)
+	a.record(status.Error(codes.DeadlineExceeded, "too slow"), later)
+	assert.Equal(a.allow(later), ErrAgencyUnavailable)
+
+	later = later.Add(agencyOpenTimeout)
+	assert.NoError(a.allow(later))
+	a.record(nil, later)
+	assert.NoError(a.allow(later))
+	assert.NoError(a.allow(later))
+
+	// the trial call which isn't made doesn't keep the circuit open
+	for i := 0; i < agencyFailureThreshold; i++ {
+		a.record(unavailable, later)
+	}
+	later = later.Add(agencyOpenTimeout)
+	assert.NoError(a.allow(later))
+	a.release()
+	assert.NoError(a.allow(later))
+}
+
+func TestAgencyConnection(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	a := &agency{}
+	_, err := a.connection("findy-root")
+	assert.Error(err)
+
+	a.reset(client.BuildInsecureClientConnBase("localhost", 50059, nil))
+	defer a.reset(nil)
+
+	conn := try.To1(a.connection("findy-root"))
+	assert.That(conn == try.To1(a.connection("findy-root")), "connection is shared")
+	conn = try.To1(a.connection("other-admin"))
+	assert.That(conn != try.To1(a.connection("findy-root")), "admin changed")
+
+	conn = try.To1(a.connection("findy-root"))
+	a.record(status.Error(codes.Unauthenticated, "token expired"), time.Now())
+	assert.That(conn != try.To1(a.connection("findy-root")), "credentials refused")
+}
+
+func TestAdminCredentials(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	creds := adminCredentials{adminID: "findy-root"}
+	assert.ThatNot(creds.RequireTransportSecurity())
+	md := try.To1(creds.GetRequestMetadata(context.Background()))
+	assert.That(jwt.IsValidUser("findy-root", []string{md["authorization"]}))
+}
+
+func TestCertModTime(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	dir := t.TempDir()
+	pki := &rpc.PKI{
+		Server: rpc.CertFiles{CertFile: filepath.Join(dir, "server.crt")},
+		Client: rpc.CertFiles{
+			CertFile: filepath.Join(dir, "client.crt"),
+			KeyFile:  filepath.Join(dir, "client.key"),
+		},
+	}
+	cfg := &rpc.ClientCfg{PKI: pki}
+	assert.That(certModTime(&rpc.ClientCfg{}).IsZero())
+	assert.That(certModTime(cfg).IsZero())
+
+	then := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, name := range []string{pki.Server.CertFile, pki.Client.CertFile, pki.Client.KeyFile} {
+		try.To(os.WriteFile(name, []byte("cert"), 0o600))
+		try.To(os.Chtimes(name, then, then))
+	}
+	assert.That(certModTime(cfg).Equal(then))
+
+	renewed := then.Add(time.Minute)
+	try.To(os.Chtimes(pki.Client.CertFile, renewed, renewed))
+	assert.That(certModTime(cfg).Equal(renewed))
+}
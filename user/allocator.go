@@ -0,0 +1,152 @@
+package user
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	ops "github.com/findy-network/findy-common-go/grpc/ops/v1"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+	"github.com/mr-tron/base58"
+)
+
+// The allocator kinds for NewAllocator.
+const (
+	// AllocatorGRPC onboards the user to the findy core agency.
+	AllocatorGRPC = "grpc"
+
+	// AllocatorLocal makes the did:key or did:peer locally without the
+	// agency.
+	AllocatorLocal = "local"
+
+	// AllocatorNoop doesn't allocate anything. The user gets the random
+	// identifier, which is needed as the subject of the tokens.
+	AllocatorNoop = "noop"
+)
+
+// The DID methods of the local allocator.
+const (
+	DIDMethodKey  = "key"
+	DIDMethodPeer = "peer"
+)
+
+// ed25519Multicodec is the multicodec prefix of the Ed25519 public key.
+var ed25519Multicodec = []byte{0xed, 0x01}
+
+// Allocator allocates the cloud agent, i.e. the DID, for the new user.
+type Allocator interface {
+	// Allocate returns the DID of the user's new cloud agent. The adminID is
+	// the agency admin used by the gRPC onboarding.
+	Allocate(ctx context.Context, adminID string, u *User) (did string, err error)
+}
+
+// ErrOffboardUnsupported is returned when the allocator cannot remove the
+// cloud agent.
+var ErrOffboardUnsupported = errors.New("cloud agent offboarding not supported")
+
+// Offboarder removes or archives the cloud agent of the deleted user. It's
+// implemented by the allocators.
+type Offboarder interface {
+	// Offboard removes the cloud agent of the user's DID.
+	Offboard(ctx context.Context, adminID string, u *User) error
+}
+
+var allocator Allocator = GRPCAllocator{}
+
+// SetAllocator sets the allocator used by AllocateCloudAgent.
+func SetAllocator(a Allocator) {
+	allocator = a
+}
+
+// NewAllocator returns the allocator of the kind. The didMethod is used only
+// by the local allocator.
+func NewAllocator(kind, didMethod string) (Allocator, error) {
+	switch kind {
+	case AllocatorGRPC:
+		return GRPCAllocator{}, nil
+	case AllocatorLocal:
+		if didMethod != DIDMethodKey && didMethod != DIDMethodPeer {
+			return nil, fmt.Errorf("unknown DID method: %s", didMethod)
+		}
+		return LocalAllocator{Method: didMethod}, nil
+	case AllocatorNoop:
+		return NoopAllocator{}, nil
+	}
+	return nil, fmt.Errorf("unknown allocator: %s", kind)
+}
+
+// GRPCAllocator onboards the user to the agency over gRPC. The connection is
+// configured with Init, and it's shared by all the allocations. When the
+// agency keeps failing, the allocations fail fast with ErrAgencyUnavailable.
+type GRPCAllocator struct{}
+
+func (GRPCAllocator) Allocate(ctx context.Context, adminID string, u *User) (did string, err error) {
+	defer err2.Handle(&err, "onboard")
+
+	try.To(theAgency.allow(time.Now()))
+	defer theAgency.release()
+	conn := try.To1(theAgency.connection(adminID))
+
+	agencyClient := ops.NewAgencyServiceClient(conn)
+	result, err := agencyClient.Onboard(ctx, &ops.Onboarding{
+		Email:         u.Name,
+		PublicDIDSeed: u.PublicDIDSeed,
+	})
+	theAgency.record(err, time.Now())
+	try.To(err)
+	glog.V(1).Infoln("result:", result.GetOk(), result.GetResult().CADID)
+	if !result.GetOk() {
+		return "", fmt.Errorf("%w: %v", ErrOnboardingRejected, u.Name)
+	}
+	return result.GetResult().CADID, nil
+}
+
+// Offboard returns ErrOffboardUnsupported, because the agency API (ops.v1)
+// doesn't have the offboarding yet. The admin removes the cloud agent in the
+// agency before the account can be deleted.
+func (GRPCAllocator) Offboard(context.Context, string, *User) error {
+	return ErrOffboardUnsupported
+}
+
+// LocalAllocator makes the DID of the new random Ed25519 key without the
+// agency. The public DID seed of the client isn't used, because the same seed
+// would give the same DID, i.e. the account of the other user. The private key
+// isn't stored, i.e. the DID is only the identifier of the user.
+type LocalAllocator struct {
+	// Method is DIDMethodKey or DIDMethodPeer (numalgo 0).
+	Method string
+}
+
+func (a LocalAllocator) Allocate(context.Context, string, *User) (did string, err error) {
+	defer err2.Handle(&err, "local DID")
+
+	pub, _ := try.To2(ed25519.GenerateKey(rand.Reader))
+	mb := "z" + base58.Encode(append(ed25519Multicodec, pub...))
+	if a.Method == DIDMethodPeer {
+		return "did:peer:0" + mb, nil
+	}
+	return "did:key:" + mb, nil
+}
+
+// Offboard does nothing, because the local DID has no agent.
+func (LocalAllocator) Offboard(context.Context, string, *User) error {
+	return nil
+}
+
+// NoopAllocator doesn't allocate the cloud agent.
+type NoopAllocator struct{}
+
+func (NoopAllocator) Allocate(context.Context, string, *User) (string, error) {
+	return "urn:uuid:" + uuid.NewString(), nil
+}
+
+// Offboard does nothing.
+func (NoopAllocator) Offboard(context.Context, string, *User) error {
+	return nil
+}
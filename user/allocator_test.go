@@ -0,0 +1,86 @@
+package user_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/user"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestNewAllocator(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	_, err := user.NewAllocator("unknown", "")
+	assert.Error(err)
+	_, err = user.NewAllocator(user.AllocatorLocal, "web")
+	assert.Error(err)
+	_ = try.To1(user.NewAllocator(user.AllocatorGRPC, ""))
+	_ = try.To1(user.NewAllocator(user.AllocatorNoop, ""))
+}
+
+func TestLocalAllocator(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	const seed = "000000000000000000000000Steward1"
+	ctx := context.Background()
+	keyAllocator := try.To1(user.NewAllocator(user.AllocatorLocal, user.DIDMethodKey))
+	peerAllocator := try.To1(user.NewAllocator(user.AllocatorLocal, user.DIDMethodPeer))
+
+	// the same seed doesn't give the same DID to the other user
+	did := try.To1(keyAllocator.Allocate(ctx, "", user.New("a", "a", seed)))
+	assert.That(strings.HasPrefix(did, "did:key:z6Mk"), did)
+	assert.NotEqual(try.To1(keyAllocator.Allocate(ctx, "", user.New("b", "b", seed))), did)
+
+	peer := try.To1(peerAllocator.Allocate(ctx, "", user.New("a", "a", seed)))
+	assert.That(strings.HasPrefix(peer, "did:peer:0z6Mk"), peer)
+	assert.NotEqual(strings.TrimPrefix(peer, "did:peer:0"), strings.TrimPrefix(did, "did:key:"))
+
+	random1 := try.To1(keyAllocator.Allocate(ctx, "", user.New("a", "a", "")))
+	random2 := try.To1(keyAllocator.Allocate(ctx, "", user.New("a", "a", "")))
+	assert.NotEqual(random1, random2)
+}
+
+func TestAllocateCloudAgent(t *testing.T) {
+	defer assert.PushTester(t)()
+	defer user.SetAllocator(user.GRPCAllocator{})
+
+	user.SetAllocator(user.NoopAllocator{})
+	u := user.New("noop-user", "noop-user", "")
+	try.To(u.AllocateCloudAgent(context.Background(), "findy-root", time.Second))
+	assert.That(strings.HasPrefix(u.DID, "urn:uuid:"), u.DID)
+
+	user.SetAllocator(user.LocalAllocator{Method: user.DIDMethodKey})
+	u = user.New("local-user", "local-user", "")
+	try.To(u.AllocateCloudAgent(context.Background(), "findy-root", time.Second))
+	assert.That(strings.HasPrefix(u.DID, "did:key:"), u.DID)
+
+	admin := user.New("findy-root", "findy-root", "")
+	try.To(admin.AllocateCloudAgent(context.Background(), "findy-root", time.Second))
+	assert.Equal(admin.DID, "findy-root")
+}
+
+func TestOffboardCloudAgent(t *testing.T) {
+	defer assert.PushTester(t)()
+	defer user.SetAllocator(user.GRPCAllocator{})
+
+	ctx := context.Background()
+	u := user.New("offboard-user", "offboard-user", "")
+	d := try.To1(u.OffboardCloudAgent(ctx, "findy-root", time.Second))
+	assert.Equal(d.Offboard, user.OffboardNone)
+	assert.NotEmpty(d.ID)
+
+	u.DID = "offboard-did"
+	d = try.To1(u.OffboardCloudAgent(ctx, "findy-root", time.Second))
+	assert.Equal(d.Offboard, user.OffboardRetained)
+	assert.Equal(d.DID, u.DID)
+	assert.NotEmpty(d.OffboardError)
+
+	user.SetAllocator(user.LocalAllocator{Method: user.DIDMethodKey})
+	d = try.To1(u.OffboardCloudAgent(ctx, "findy-root", time.Second))
+	assert.Equal(d.Offboard, user.OffboardRemoved)
+	assert.Empty(d.OffboardError)
+}
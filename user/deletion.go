@@ -0,0 +1,101 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/findy-network/findy-common-go/dto"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/lainio/err2"
+)
+
+// The results of the cloud agent offboarding.
+const (
+	// OffboardRemoved means that the cloud agent is removed or archived.
+	OffboardRemoved = "removed"
+
+	// OffboardRetained means that the allocator cannot offboard, and the
+	// cloud agent stays in the agency, i.e. the admin must remove it.
+	OffboardRetained = "retained"
+
+	// OffboardNone means that the user didn't have the cloud agent, e.g. the
+	// allocation was still pending.
+	OffboardNone = "none"
+
+	// OffboardManual means that the admin has removed the cloud agent in the
+	// agency, because the allocator cannot offboard.
+	OffboardManual = "manual"
+)
+
+// PendingDeletion is the deletion of the account, which waits for the admin
+// to remove the cloud agent in the agency, because the allocator cannot
+// offboard. The account is disabled meanwhile.
+type PendingDeletion struct {
+	Requested time.Time
+	Actor     string // DID of the user or the admin who deleted the account
+	Reason    string
+}
+
+// Deletion is the record of the deleted account, which is kept for the data
+// retention bookkeeping. It doesn't include the user's name, only the DID
+// needed to follow up the cloud agent in the agency.
+type Deletion struct {
+	ID            string
+	DID           string
+	Deleted       time.Time
+	Actor         string // DID of the user or the admin who deleted the account
+	Offboard      string
+	OffboardError string
+}
+
+func (d Deletion) Key() []byte {
+	return []byte(d.ID)
+}
+
+func (d Deletion) Data() []byte {
+	return dto.ToGOB(d)
+}
+
+func NewDeletionFromData(data []byte) *Deletion {
+	var d Deletion
+	dto.FromGOB(data, &d)
+	return &d
+}
+
+// OffboardCloudAgent removes the cloud agent of the user with the allocator
+// set with SetAllocator, and returns the deletion record of the account. If the
+// allocator cannot offboard, the agent is retained, which is recorded but isn't
+// an error. The caller removes the user and stores the record.
+func (u *User) OffboardCloudAgent(ctx context.Context, adminID string, timeout time.Duration) (d *Deletion, err error) {
+	defer err2.Handle(&err, "offboard")
+
+	d = &Deletion{
+		ID:       uuid.NewString(),
+		DID:      u.DID,
+		Deleted:  time.Now(),
+		Offboard: OffboardNone,
+	}
+	if u.DID == "" || u.Name == adminID {
+		return d, nil
+	}
+
+	err = ErrOffboardUnsupported
+	if offboarder, ok := allocator.(Offboarder); ok {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		err = offboarder.Offboard(ctx, adminID, u)
+	}
+	switch {
+	case err == nil:
+		d.Offboard = OffboardRemoved
+	case errors.Is(err, ErrOffboardUnsupported):
+		glog.Warningln("cloud agent retained in agency:", u.DID)
+		d.Offboard = OffboardRetained
+		d.OffboardError = err.Error()
+	default:
+		return nil, err
+	}
+	return d, nil
+}
@@ -0,0 +1,121 @@
+package user
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/lainio/err2/try"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultOnboardingBackoff is the default delay before the first retry of the
+// failed cloud agent allocation. The delay is doubled after every failure.
+const DefaultOnboardingBackoff = 10 * time.Second
+
+// MaxOnboardingBackoff is the maximum delay between the retries. The retries
+// of the transient failures don't stop, because the agency can be down e.g.
+// for the maintenance. The rejected allocation isn't retried.
+const MaxOnboardingBackoff = 30 * time.Minute
+
+// The statuses of the onboarding. The rejected status is terminal.
+const (
+	OnboardingReady    = "ready"
+	OnboardingPending  = "pending"
+	OnboardingRejected = "rejected"
+)
+
+// ErrOnboardingRejected is returned when the cloud agent allocation fails
+// permanently, e.g. the agency refuses it. It isn't retried.
+var ErrOnboardingRejected = errors.New("cloud agent allocation rejected")
+
+// Onboarding is the state of the pending cloud agent allocation, which is
+// retried in the background.
+type Onboarding struct {
+	// ID is the random ID of the onboarding, which the onboarding ID of the
+	// client refers to.
+	ID string
+
+	Started     time.Time
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+
+	// Rejected is set when the allocation has failed permanently.
+	Rejected bool
+}
+
+// OnboardingStatus returns the status of the cloud agent allocation.
+func (u *User) OnboardingStatus() string {
+	switch {
+	case u.DID != "":
+		return OnboardingReady
+	case u.IsOnboardingRejected():
+		return OnboardingRejected
+	}
+	return OnboardingPending
+}
+
+// IsOnboardingPending tells if the failed allocation waits for the retry.
+func (u *User) IsOnboardingPending() bool {
+	return u.DID == "" && u.Onboarding != nil && !u.Onboarding.Rejected
+}
+
+// IsOnboardingRejected tells if the allocation has failed permanently.
+func (u *User) IsOnboardingRejected() bool {
+	return u.DID == "" && u.Onboarding != nil && u.Onboarding.Rejected
+}
+
+// IsOnboardingDue tells if the allocation should be retried now.
+func (u *User) IsOnboardingDue(now time.Time) bool {
+	return u.IsOnboardingPending() && !now.Before(u.Onboarding.NextAttempt)
+}
+
+// OnboardingFailed records the failed allocation and schedules the next
+// attempt with the exponential backoff. The permanent failure isn't retried.
+func (u *User) OnboardingFailed(err error, now time.Time, backoff time.Duration) {
+	if u.Onboarding == nil {
+		u.Onboarding = &Onboarding{ID: newOnboardingID(), Started: now}
+	}
+	u.Onboarding.Attempts++
+	u.Onboarding.LastError = err.Error()
+	if isPermanentFailure(err) {
+		u.Onboarding.Rejected = true
+		u.Onboarding.NextAttempt = time.Time{}
+		return
+	}
+	u.Onboarding.NextAttempt = now.Add(OnboardingDelay(u.Onboarding.Attempts, backoff))
+}
+
+func newOnboardingID() string {
+	id := make([]byte, 16)
+	try.To1(rand.Read(id))
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+// isPermanentFailure tells if the allocation cannot succeed by retrying, i.e.
+// the agency has refused it.
+func isPermanentFailure(err error) bool {
+	if errors.Is(err, ErrOnboardingRejected) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.AlreadyExists:
+		return true
+	}
+	return false
+}
+
+// OnboardingDelay returns the delay after the attempt.
+func OnboardingDelay(attempts int, backoff time.Duration) time.Duration {
+	if backoff <= 0 {
+		backoff = DefaultOnboardingBackoff
+	}
+	d := backoff
+	for i := 1; i < attempts && d < MaxOnboardingBackoff; i++ {
+		d *= 2
+	}
+	return min(d, MaxOnboardingBackoff)
+}
@@ -0,0 +1,50 @@
+package user_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/user"
+	"github.com/lainio/err2/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestOnboardingFailed(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	assert.Equal(user.OnboardingDelay(1, time.Second), time.Second)
+	assert.Equal(user.OnboardingDelay(3, time.Second), 4*time.Second)
+	assert.Equal(user.OnboardingDelay(100, time.Second), user.MaxOnboardingBackoff)
+	assert.Equal(user.OnboardingDelay(1, 0), user.DefaultOnboardingBackoff)
+
+	now := time.Now()
+	u := user.New("pending", "pending", "")
+	assert.ThatNot(u.IsOnboardingPending())
+	u.OnboardingFailed(errors.New("down"), now, time.Second)
+	u.OnboardingFailed(errors.New("still down"), now, time.Second)
+	assert.That(u.IsOnboardingPending())
+	assert.Equal(u.OnboardingStatus(), user.OnboardingPending)
+	assert.Equal(u.Onboarding.Attempts, 2)
+	assert.Equal(u.Onboarding.LastError, "still down")
+	assert.ThatNot(u.IsOnboardingDue(now))
+	assert.That(u.IsOnboardingDue(now.Add(2 * time.Second)))
+
+	u.DID = "did:test"
+	assert.ThatNot(u.IsOnboardingPending())
+	assert.Equal(u.OnboardingStatus(), user.OnboardingReady)
+
+	// the rejection is final
+	u = user.New("rejected", "rejected", "")
+	u.OnboardingFailed(fmt.Errorf("%w: agency", user.ErrOnboardingRejected), now, time.Second)
+	assert.ThatNot(u.IsOnboardingPending())
+	assert.That(u.IsOnboardingRejected())
+	assert.ThatNot(u.IsOnboardingDue(now.Add(user.MaxOnboardingBackoff)))
+	assert.Equal(u.OnboardingStatus(), user.OnboardingRejected)
+
+	u = user.New("invalid", "invalid", "")
+	u.OnboardingFailed(status.Error(codes.InvalidArgument, "bad seed"), now, time.Second)
+	assert.That(u.IsOnboardingRejected())
+}
@@ -0,0 +1,54 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"time"
+
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// DefaultReRegistrationLifetime is how long the registration code of the
+// forced re-registration is valid by default.
+const DefaultReRegistrationLifetime = 24 * time.Hour
+
+// ReRegistration is the pending re-registration forced by the admin. Only the
+// hash of the one-time registration code is stored.
+type ReRegistration struct {
+	CodeHash []byte
+	Expires  time.Time
+}
+
+// ForceReRegistration removes all the user's credentials and returns the
+// one-time code, which the user needs to register the new authenticator. The
+// user keeps the DID, i.e. the cloud agent. The caller revokes the tokens.
+func (u *User) ForceReRegistration(lifetime time.Duration) (code string, err error) {
+	defer err2.Handle(&err, "force re-registration")
+
+	buf := make([]byte, 32)
+	try.To1(rand.Read(buf))
+	code = base64.RawURLEncoding.EncodeToString(buf)
+	hash := sha256.Sum256([]byte(code))
+
+	u.Credentials = nil
+	u.DisabledCredentials = nil
+	u.CredentialMetas = nil
+	u.ReRegistration = &ReRegistration{
+		CodeHash: hash[:],
+		Expires:  time.Now().Add(lifetime),
+	}
+	return code, nil
+}
+
+// VerifyReRegistration tells if the code is the valid registration code of the
+// pending re-registration.
+func (u *User) VerifyReRegistration(code string, now time.Time) bool {
+	if u.ReRegistration == nil || code == "" || now.After(u.ReRegistration.Expires) {
+		return false
+	}
+	hash := sha256.Sum256([]byte(code))
+	return subtle.ConstantTimeCompare(hash[:], u.ReRegistration.CodeHash) == 1
+}
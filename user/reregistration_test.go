@@ -0,0 +1,32 @@
+package user_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/findy-network/findy-agent-auth/user"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestForceReRegistration(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	u := user.New("re-register", "re-register", "")
+	u.DID = "did:test"
+	u.AddCredential(webauthn.Credential{ID: []byte("lost")})
+	assert.ThatNot(u.VerifyReRegistration("", time.Now()))
+
+	code := try.To1(u.ForceReRegistration(time.Minute))
+	assert.NotEmpty(code)
+	assert.SLen(u.Credentials, 0)
+	assert.SLen(u.CredentialMetas, 0)
+	assert.Equal(u.DID, "did:test")
+
+	now := time.Now()
+	assert.That(u.VerifyReRegistration(code, now))
+	assert.ThatNot(u.VerifyReRegistration(code+"x", now))
+	assert.ThatNot(u.VerifyReRegistration("", now))
+	assert.ThatNot(u.VerifyReRegistration(code, now.Add(2*time.Minute)))
+}
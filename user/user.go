@@ -1,25 +1,25 @@
 package user
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/binary"
-	"fmt"
+	"errors"
 	"time"
 
+	"github.com/findy-network/findy-agent-auth/token"
 	"github.com/findy-network/findy-common-go/agency/client"
 	"github.com/findy-network/findy-common-go/dto"
-	ops "github.com/findy-network/findy-common-go/grpc/ops/v1"
-	"github.com/findy-network/findy-common-go/jwt"
 	"github.com/findy-network/findy-common-go/rpc"
 	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/golang/glog"
+	"github.com/google/uuid"
 	"github.com/lainio/err2"
 	"github.com/lainio/err2/try"
 	"google.golang.org/grpc"
-
-	"github.com/lainio/err2/assert"
 )
 
 var baseCfg *rpc.ClientCfg
@@ -42,6 +42,7 @@ func InitWithOpts(certPath, addr string, port int, insecure bool, opts []grpc.Di
 		glog.V(1).Info("Establishing SECURE connection to agency")
 		baseCfg = client.BuildClientConnBase(certPath, addr, port, opts)
 	}
+	theAgency.reset(baseCfg)
 }
 
 // User represents the user model
@@ -51,12 +52,92 @@ type User struct {
 	PublicDIDSeed string // seed for the public DID
 	DisplayName   string // shortened version of the Name
 	DID           string
+	Created       time.Time // when the registration began
 	//JWT         string // remove this from here and make a method
 	Credentials []webauthn.Credential
+
+	// DisabledCredentials are IDs of the credentials which cannot be used for
+	// login anymore, e.g. because of the clone warning.
+	DisabledCredentials [][]byte
+
+	// CredentialMetas is our own bookkeeping of the credentials, i.e. the data
+	// which isn't part of the webauthn.Credential.
+	CredentialMetas []CredentialMeta
+
+	// Onboarding is set when the cloud agent allocation has failed and it's
+	// retried in the background. It's kept after the allocation.
+	Onboarding *Onboarding
+
+	// Disabled is set by the admin. The disabled user cannot log in.
+	Disabled bool
+
+	// ReRegistration is set when the admin has forced the user to register
+	// the authenticator again.
+	ReRegistration *ReRegistration
+
+	// PendingDeletion is set when the account cannot be deleted before the
+	// admin has removed the cloud agent.
+	PendingDeletion *PendingDeletion
+}
+
+// CredentialMeta is the metadata of the credential we maintain ourselves.
+type CredentialMeta struct {
+	ID       []byte
+	Nickname string
+	Created  time.Time
+	LastUsed time.Time
+}
+
+// CredentialInfo is presentation of the credential for the credential
+// management API.
+type CredentialInfo struct {
+	ID         string     `json:"id"`
+	AAGUID     string     `json:"aaguid"`
+	Nickname   string     `json:"nickname,omitempty"`
+	Created    *time.Time `json:"created,omitempty"`
+	LastUsed   *time.Time `json:"lastUsed,omitempty"`
+	Transports []string   `json:"transports,omitempty"`
+	SignCount  uint32     `json:"signCount"`
+	Disabled   bool       `json:"disabled,omitempty"`
+}
+
+var (
+	// ErrCredentialNotFound is returned when the credential ID isn't one of
+	// the user's credentials.
+	ErrCredentialNotFound = errors.New("credential not found")
+
+	// ErrLastCredential is returned when the removal of the credential would
+	// leave the user without any usable credential.
+	ErrLastCredential = errors.New("cannot remove the last credential")
+)
+
+// JWT builds the access token of the user. The cred is the credential used
+// in the login, and the authentication claims are built from it. It can be nil.
+func (u User) JWT(cred *webauthn.Credential) (string, error) {
+	return token.Build(u.DID, u.DisplayName, AuthOf(cred))
 }
 
-func (u User) JWT() string {
-	return jwt.BuildJWTWithLabel(u.DID, u.DisplayName)
+// AuthOf tells how the user authenticated with the credential.
+func AuthOf(cred *webauthn.Credential) *token.Auth {
+	if cred == nil {
+		return nil
+	}
+	auth := &token.Auth{
+		Time:         time.Now(),
+		AMR:          []string{token.AMRHardwareKey},
+		CredentialID: base64.RawURLEncoding.EncodeToString(cred.ID),
+		UV:           cred.Flags.UserVerified,
+	}
+	if cred.Flags.BackupEligible {
+		auth.AMR[0] = token.AMRSoftwareKey
+	}
+	if cred.Flags.UserVerified {
+		auth.AMR = append(auth.AMR, token.AMRUser)
+	}
+	if aaguid, err := uuid.FromBytes(cred.Authenticator.AAGUID); err == nil {
+		auth.AAGUID = aaguid.String()
+	}
+	return auth
 }
 
 func (u User) Key() []byte {
@@ -80,6 +161,7 @@ func New(name, displayName, seed string) *User {
 		Name:          name,
 		DisplayName:   displayName,
 		PublicDIDSeed: seed,
+		Created:       time.Now(),
 	}
 }
 
@@ -111,14 +193,184 @@ func (u User) WebAuthnIcon() string {
 	return ""
 }
 
+// IsRegistered tells if the user has finished the registration. The user
+// without the credentials, the DID and the re-registration is in the middle of
+// the registration ceremony, or it's left by the abandoned one.
+func (u *User) IsRegistered() bool {
+	return len(u.Credentials) > 0 || u.DID != "" || u.ReRegistration != nil
+}
+
+// IsAbandoned tells if the unregistered user is left by the registration
+// ceremony, which has expired by now. The users stored before the creation
+// time are old enough.
+func (u *User) IsAbandoned(now time.Time, ceremonyTimeout time.Duration) bool {
+	return !u.IsRegistered() && now.Sub(u.Created) > ceremonyTimeout
+}
+
 // AddCredential associates the credential to the user
 func (u *User) AddCredential(cred webauthn.Credential) {
 	u.Credentials = append(u.Credentials, cred)
+	u.CredentialMetas = append(u.CredentialMetas, CredentialMeta{
+		ID:      cred.ID,
+		Created: time.Now(),
+	})
+}
+
+// UpdateCredential replaces the stored credential having the same ID with the
+// given one. It's used to persist authenticator data like the signature counter
+// after the login, and that's why it also updates the last use time. It
+// returns false if the credential isn't found.
+func (u *User) UpdateCredential(cred webauthn.Credential) bool {
+	for i := range u.Credentials {
+		if bytes.Equal(u.Credentials[i].ID, cred.ID) {
+			u.Credentials[i] = cred
+			u.metaOf(cred.ID).LastUsed = time.Now()
+			return true
+		}
+	}
+	return false
+}
+
+// SetCredentialNickname sets the user given name for the credential.
+func (u *User) SetCredentialNickname(id []byte, nickname string) error {
+	if u.credentialIndex(id) == -1 {
+		return ErrCredentialNotFound
+	}
+	u.metaOf(id).Nickname = nickname
+	return nil
+}
+
+// RemoveCredential removes the credential and its metadata from the user. The
+// user must have at least one usable credential left.
+func (u *User) RemoveCredential(id []byte) error {
+	i := u.credentialIndex(id)
+	if i == -1 {
+		return ErrCredentialNotFound
+	}
+	if !u.IsDisabledCredential(id) && len(u.WebAuthnCredentials()) <= 1 {
+		return ErrLastCredential
+	}
+	u.Credentials = append(u.Credentials[:i], u.Credentials[i+1:]...)
+	for j, disabledID := range u.DisabledCredentials {
+		if bytes.Equal(disabledID, id) {
+			u.DisabledCredentials = append(u.DisabledCredentials[:j],
+				u.DisabledCredentials[j+1:]...)
+			break
+		}
+	}
+	for j, meta := range u.CredentialMetas {
+		if bytes.Equal(meta.ID, id) {
+			u.CredentialMetas = append(u.CredentialMetas[:j],
+				u.CredentialMetas[j+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// CredentialInfos returns the user's credentials with their metadata.
+func (u *User) CredentialInfos() []CredentialInfo {
+	infos := make([]CredentialInfo, 0, len(u.Credentials))
+	for _, cred := range u.Credentials {
+		meta := u.credentialMeta(cred.ID)
+		info := CredentialInfo{
+			ID:        base64.RawURLEncoding.EncodeToString(cred.ID),
+			Nickname:  meta.Nickname,
+			Created:   timeOrNil(meta.Created),
+			LastUsed:  timeOrNil(meta.LastUsed),
+			SignCount: cred.Authenticator.SignCount,
+			Disabled:  u.IsDisabledCredential(cred.ID),
+		}
+		if aaguid, err := uuid.FromBytes(cred.Authenticator.AAGUID); err == nil {
+			info.AAGUID = aaguid.String()
+		}
+		for _, transport := range cred.Transport {
+			info.Transports = append(info.Transports, string(transport))
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+func (u User) credentialIndex(id []byte) int {
+	for i, cred := range u.Credentials {
+		if bytes.Equal(cred.ID, id) {
+			return i
+		}
+	}
+	return -1
+}
+
+// credentialMeta returns the metadata of the credential, or the zero value if
+// there is none, e.g. credentials registered before we started to keep the
+// metadata.
+func (u User) credentialMeta(id []byte) CredentialMeta {
+	for _, meta := range u.CredentialMetas {
+		if bytes.Equal(meta.ID, id) {
+			return meta
+		}
+	}
+	return CredentialMeta{ID: id}
+}
+
+// metaOf returns the metadata entry of the credential for the update. The
+// entry is created if it doesn't exist.
+func (u *User) metaOf(id []byte) *CredentialMeta {
+	for i := range u.CredentialMetas {
+		if bytes.Equal(u.CredentialMetas[i].ID, id) {
+			return &u.CredentialMetas[i]
+		}
+	}
+	u.CredentialMetas = append(u.CredentialMetas, CredentialMeta{ID: id})
+	return &u.CredentialMetas[len(u.CredentialMetas)-1]
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// DisableCredential marks the credential unusable for the login. It returns
+// false if the credential isn't found.
+func (u *User) DisableCredential(id []byte) bool {
+	found := u.credentialIndex(id) != -1
+	if found && !u.IsDisabledCredential(id) {
+		u.DisabledCredentials = append(u.DisabledCredentials, id)
+	}
+	return found
+}
+
+// IsDisabledCredential tells if the credential is disabled.
+func (u User) IsDisabledCredential(id []byte) bool {
+	for _, disabledID := range u.DisabledCredentials {
+		if bytes.Equal(disabledID, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUsableCredential tells if the credential is the user's credential and it
+// isn't disabled.
+func (u User) IsUsableCredential(id []byte) bool {
+	return u.credentialIndex(id) != -1 && !u.IsDisabledCredential(id)
 }
 
-// WebAuthnCredentials returns credentials owned by the user
+// WebAuthnCredentials returns credentials owned by the user. Disabled
+// credentials are not included.
 func (u User) WebAuthnCredentials() []webauthn.Credential {
-	return u.Credentials
+	if len(u.DisabledCredentials) == 0 {
+		return u.Credentials
+	}
+	creds := make([]webauthn.Credential, 0, len(u.Credentials))
+	for _, cred := range u.Credentials {
+		if !u.IsDisabledCredential(cred.ID) {
+			creds = append(creds, cred)
+		}
+	}
+	return creds
 }
 
 // CredentialExcludeList returns a CredentialDescriptor array filled
@@ -135,10 +387,12 @@ func (u User) CredentialExcludeList() []protocol.CredentialDescriptor {
 	return credentialExcludeList
 }
 
-// AllocateCloudAgent allocates new cloud agent from the agency. adminID is part
-// of the security for the current agency ecosystem. It must match what's
-// configured to server side i.e. agency.
-func (u *User) AllocateCloudAgent(adminID string, timeout time.Duration) (err error) {
+// AllocateCloudAgent allocates new cloud agent with the allocator set with
+// SetAllocator, by default from the agency. adminID is part of the security
+// for the current agency ecosystem. It must match what's configured to server
+// side i.e. agency. The allocation is canceled when the ctx is done or the
+// timeout expires.
+func (u *User) AllocateCloudAgent(ctx context.Context, adminID string, timeout time.Duration) (err error) {
 	defer err2.Handle(&err)
 
 	glog.V(1).Infoln("starting cloud agent allocation for", u.Name)
@@ -150,28 +404,17 @@ func (u *User) AllocateCloudAgent(adminID string, timeout time.Duration) (err er
 		return nil
 	}
 
-	// cloud agent already allocated?
+	// cloud agent already allocated, e.g. new authenticator or re-registration?
 	if u.DID != "" {
-		assert.That(len(u.Credentials) > 1, "programming error")
 		glog.V(1).Infoln("=== cloud agent already allocated")
 		return nil
 	}
 
-	conn := client.TryOpen(adminID, baseCfg)
-	defer conn.Close()
-
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	agencyClient := ops.NewAgencyServiceClient(conn)
-	result := try.To1(agencyClient.Onboard(ctx, &ops.Onboarding{
-		Email:         u.Name,
-		PublicDIDSeed: u.PublicDIDSeed,
-	}))
-	glog.V(1).Infoln("result:", result.GetOk(), result.GetResult().CADID)
-	if !result.GetOk() {
-		return fmt.Errorf("cannot allocate cloud agent for %v", u.Name)
-	}
-	u.DID = result.GetResult().CADID
+	// the record of the retried onboarding is kept, that the client can
+	// poll the ready status with its ID
+	u.DID = try.To1(allocator.Allocate(ctx, adminID, u))
 
 	return nil
 }
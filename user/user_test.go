@@ -9,9 +9,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/findy-network/findy-agent-auth/token"
 	"github.com/findy-network/findy-agent-auth/user"
 	ops "github.com/findy-network/findy-common-go/grpc/ops/v1"
 	"github.com/findy-network/findy-common-go/rpc"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/golang/glog"
 	"github.com/lainio/err2"
 	"github.com/lainio/err2/assert"
@@ -98,5 +100,74 @@ func TestOnboardInsecure(t *testing.T) {
 	defer assert.PopTester()
 	u := user.New("username", "displayName", "seed")
 
-	try.To(u.AllocateCloudAgent("findy-root", 3*time.Second))
+	try.To(u.AllocateCloudAgent(context.Background(), "findy-root", 3*time.Second))
+}
+
+func TestDisableCredential(t *testing.T) {
+	assert.PushTester(t)
+	defer assert.PopTester()
+	u := user.New("username", "displayName", "")
+	u.AddCredential(webauthn.Credential{ID: []byte("first")})
+	u.AddCredential(webauthn.Credential{ID: []byte("second")})
+
+	assert.ThatNot(u.DisableCredential([]byte("not-exist")))
+	assert.That(u.DisableCredential([]byte("first")))
+	assert.That(u.DisableCredential([]byte("first")))
+	assert.SLen(u.DisabledCredentials, 1)
+	assert.SLen(u.WebAuthnCredentials(), 1)
+	assert.SLen(u.CredentialExcludeList(), 2)
+
+	cred := webauthn.Credential{ID: []byte("second")}
+	cred.Authenticator.SignCount = 2
+	assert.That(u.UpdateCredential(cred))
+	assert.Equal(u.Credentials[1].Authenticator.SignCount, uint32(2))
+	assert.ThatNot(u.UpdateCredential(webauthn.Credential{ID: []byte("x")}))
+}
+
+func TestCredentialInfos(t *testing.T) {
+	assert.PushTester(t)
+	defer assert.PopTester()
+	u := user.New("username", "displayName", "")
+	u.AddCredential(webauthn.Credential{ID: []byte("first")})
+	u.Credentials = append(u.Credentials, webauthn.Credential{ID: []byte("legacy")})
+
+	infos := u.CredentialInfos()
+	assert.SLen(infos, 2)
+	assert.NotNil(infos[0].Created)
+	assert.Nil(infos[0].LastUsed)
+	assert.Nil(infos[1].Created)
+	assert.SLen(u.CredentialMetas, 1)
+}
+
+func TestJWTClaims(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	try.To(token.Configure(token.Config{
+		Lifetime: token.DefaultLifetime,
+		Claims:   []string{token.ClaimAMR, token.ClaimAAGUID, token.ClaimUV},
+	}))
+	defer func() {
+		_ = token.Configure(token.Config{Lifetime: token.DefaultLifetime})
+	}()
+
+	u := user.New("jwt-claims-user", "jwt-claims-user", "")
+	u.DID = "did:jwt-claims"
+
+	cred := &webauthn.Credential{ID: []byte("device-bound")}
+	cred.Flags.UserVerified = true
+	cred.Authenticator.AAGUID = make([]byte, 16)
+	claims := try.To1(token.Parse(try.To1(u.JWT(cred))))
+	assert.Equal(claims.Username, u.DID)
+	assert.SLen(claims.AMR, 2)
+	assert.Equal(claims.AMR[0], token.AMRHardwareKey)
+	assert.Equal(claims.AMR[1], token.AMRUser)
+	assert.Equal(claims.AAGUID, "00000000-0000-0000-0000-000000000000")
+	assert.That(*claims.UV)
+
+	synced := &webauthn.Credential{ID: []byte("synced")}
+	synced.Flags.BackupEligible = true
+	claims = try.To1(token.Parse(try.To1(u.JWT(synced))))
+	assert.SLen(claims.AMR, 1)
+	assert.Equal(claims.AMR[0], token.AMRSoftwareKey)
+	assert.That(!*claims.UV)
 }